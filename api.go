@@ -1,11 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
 
 	"github.com/mailway-app/config"
 
@@ -26,7 +26,10 @@ type APIResponse struct {
 
 // FIXME: merge domain config and domain rule
 func getAPIDomainConfig(instance *config.Config, domain string) (*Domain, error) {
-	url := fmt.Sprintf("%s/instance/%s/domain/%s", API_BASE_URL, instance.ServerId, strings.ToLower(domain))
+	if ascii, err := normalizeDomain(domain); err == nil {
+		domain = ascii
+	}
+	url := fmt.Sprintf("%s/instance/%s/domain/%s", API_BASE_URL, instance.ServerId, domain)
 	log.Debugf("request to %s", url)
 
 	req, err := retryablehttp.NewRequest(http.MethodGet, url, nil)
@@ -66,6 +69,9 @@ func getAPIDomainConfig(instance *config.Config, domain string) (*Domain, error)
 		if jsonErr != nil {
 			return nil, errors.Wrap(jsonErr, "failed to parse API envelope")
 		}
+		if err := validateDomainRateLimits(c.RateLimits); err != nil {
+			return nil, err
+		}
 		return &c, nil
 	}
 
@@ -79,6 +85,9 @@ func getAPIDomainConfig(instance *config.Config, domain string) (*Domain, error)
 
 func getAPIDomainRules(instance *config.Config, domain string) (DomainRules, error) {
 	var domainRules DomainRules
+	if ascii, err := normalizeDomain(domain); err == nil {
+		domain = ascii
+	}
 	url := fmt.Sprintf("%s/instance/%s/domain/%s/rules", API_BASE_URL, instance.ServerId, domain)
 	log.Debugf("request to %s", url)
 	req, err := retryablehttp.NewRequest(http.MethodGet, url, nil)
@@ -118,3 +127,59 @@ func getAPIDomainRules(instance *config.Config, domain string) (DomainRules, err
 	}
 	return domainRules, nil
 }
+
+type APIUser struct {
+	Domains []string `json:"domains"`
+}
+
+// The domains the user can send from, none if the credentials are invalid
+func getAPIUserDomains(instance *config.Config, username string, password string) ([]string, error) {
+	url := fmt.Sprintf("%s/instance/%s/auth", API_BASE_URL, instance.ServerId)
+	log.Debugf("request to %s", url)
+
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not marshall credentials")
+	}
+	req, err := retryablehttp.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+instance.ServerJWT)
+	req.Header.Set("User-Agent", "fwdr")
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not send request")
+	}
+	if res.Body != nil {
+		defer res.Body.Close()
+	}
+
+	switch res.StatusCode {
+	case 200:
+	case 401, 403, 404:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("unexpected response from API: %s", res.Status)
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read body")
+	}
+	var d APIResponse
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, errors.Wrap(err, "failed to parse API envelope")
+	}
+	if !d.Ok {
+		return nil, errors.Errorf("API failed with: %s", d.Error)
+	}
+	var user APIUser
+	if err := json.Unmarshal(d.Data, &user); err != nil {
+		return nil, errors.Wrap(err, "failed to parse API envelope")
+	}
+	return user.Domains, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	wordDecoder   = &mime.WordDecoder{CharsetReader: charsetReader}
+	addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+	caseFolder    = cases.Fold()
+)
+
+// charsetReader converts from the given charset to UTF-8. The WHATWG index
+// covers the charsets found in the wild, including ISO-8859-x and windows-125x.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset == "" || charset == "utf-8" || charset == "us-ascii" {
+		return input, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, errors.Errorf("unsupported charset: %s", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// decodeHeader decodes the RFC 2047 encoded-words of a header value. The raw
+// value is returned if it can't be decoded.
+func decodeHeader(v string) string {
+	decoded, err := wordDecoder.DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+	return decoded
+}
+
+// normalize brings a value in a canonical form for matching: Unicode NFC and
+// case folded.
+func normalize(v string) string {
+	return caseFolder.String(norm.NFC.String(v))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeHeader(t *testing.T) {
+	assert.Equal(t, decodeHeader("=?UTF-8?B?w4fDoCBtYXJjaGU=?="), "Çà marche")
+	assert.Equal(t, decodeHeader("=?ISO-8859-1?Q?Caf=E9?="), "Café")
+	assert.Equal(t, decodeHeader("=?windows-1252?Q?=80_100?="), "€ 100")
+	assert.Equal(t, decodeHeader("=?ISO-8859-15?Q?=A4?="), "€")
+	assert.Equal(t, decodeHeader("plain"), "plain")
+	assert.Equal(t, decodeHeader("=?x-unknown?Q?a?="), "=?x-unknown?Q?a?=")
+}
+
+func TestNormalize(t *testing.T) {
+	// e followed by a combining acute accent
+	assert.Equal(t, normalize("Café"), normalize("CAFÉ"))
+	assert.Equal(t, normalize("Straße"), "strasse")
+}
+
+func TestMatchEncodedSubject(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: a@gmail.com
+Subject: =?ISO-8859-1?Q?R=E9sum=E9?= =?UTF-8?B?IMOgIGpvdXI=?=
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`)
+
+	matches := []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_SUBJECT, Value: "Résumé à jour"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+
+	matches = []Match{
+		{Type: MATCH_REGEX, Field: FIELD_SUBJECT, Value: "résumé*"},
+	}
+	v, err = HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
+
+func TestMatchEncodedFromName(t *testing.T) {
+	email := makeEmail(`From: =?windows-1252?Q?Andr=E9?= <andre@b.ee>
+To: a@gmail.com
+Subject: test
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`)
+
+	matches := []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_FROM, Value: "andre@b.ee"},
+		{Type: MATCH_LITERAL, Field: FIELD_FROM_NAME, Value: "andré"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+
+	matches = []Match{
+		{Type: MATCH_REGEX, Field: FIELD_FROM_NAME, Value: "andre*"},
+	}
+	v, err = HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, false)
+}
+
+func TestMatchLatin1Body(t *testing.T) {
+	email := makeEmail("From: sven@b.ee\r\n" +
+		"To: a@gmail.com\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Facture r=E9gl=E9e\r\n")
+
+	matches := []Match{
+		{Type: MATCH_REGEX, Field: FIELD_BODY, Value: "*réglée*"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
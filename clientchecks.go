@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Checks of the behaviour and the identity of the clients
+type ClientChecks struct {
+	GreetDelay           time.Duration // before the banner, the clients talking meanwhile are early talkers
+	RejectEarlyTalkers   bool
+	RejectInvalidHELO    bool
+	FCrDNS               bool // look up the forward-confirmed reverse DNS of the clients
+	RejectUnknownClients bool // without forward-confirmed reverse DNS
+	Resolver             Resolver
+}
+
+// Outcome of the HELO hygiene checks
+type HELOStatus string
+
+const (
+	HELO_OK        HELOStatus = "ok"
+	HELO_INVALID   HELOStatus = "invalid"   // not a domain nor an address literal
+	HELO_NOT_FQDN  HELOStatus = "not-fqdn"  // a single label
+	HELO_BARE_IP   HELOStatus = "bare-ip"   // an IP address outside of brackets
+	HELO_LOCALHOST HELOStatus = "localhost" // localhost or one of its subdomains
+	HELO_OURS      HELOStatus = "ours"      // our own hostname
+	HELO_MISMATCH  HELOStatus = "mismatch"  // an address literal other than the client address
+
+	METRIC_EARLY_TALKERS   = "early_talkers"
+	METRIC_REJECTED_HELO   = "rejected_helo"
+	METRIC_UNKNOWN_CLIENTS = "unknown_clients"
+)
+
+var heloReasons = map[HELOStatus]string{
+	HELO_INVALID:   "invalid hostname",
+	HELO_NOT_FQDN:  "need fully-qualified hostname",
+	HELO_BARE_IP:   "address literals must be in brackets",
+	HELO_LOCALHOST: "localhost isn't a valid hostname",
+	HELO_OURS:      "that's our hostname",
+	HELO_MISMATCH:  "address literal doesn't match the client address",
+}
+
+// RFC 5321 section 4.1.1.1, the HELO argument is the FQDN of the client or
+// its address literal, [192.0.2.1] or [IPv6:2001:db8::1]
+func checkHELOName(name string, remoteIP string, hostname string) HELOStatus {
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+		literal := name[1 : len(name)-1]
+		if len(literal) > 5 && strings.EqualFold(literal[:5], "IPv6:") {
+			literal = literal[5:]
+		}
+		ip := net.ParseIP(literal)
+		if ip == nil {
+			return HELO_INVALID
+		}
+		if !ip.Equal(net.ParseIP(remoteIP)) {
+			return HELO_MISMATCH
+		}
+		return HELO_OK
+	}
+	if net.ParseIP(name) != nil {
+		return HELO_BARE_IP
+	}
+
+	name = strings.TrimSuffix(name, ".")
+	ascii, err := normalizeDomain(name)
+	if err != nil || len(ascii) == 0 || len(ascii) > 253 {
+		return HELO_INVALID
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return HELO_INVALID
+		}
+	}
+	switch {
+	case ascii == "localhost" || strings.HasSuffix(ascii, ".localhost") || ascii == "localhost.localdomain":
+		return HELO_LOCALHOST
+	case strings.EqualFold(ascii, strings.TrimSuffix(hostname, ".")):
+		return HELO_OURS
+	case !strings.Contains(ascii, "."):
+		return HELO_NOT_FQDN
+	}
+	return HELO_OK
+}
+
+// The submission clients and the trusted peers aren't rejected
+func heloHandler(s *session, name string) error {
+	if !s.snapshot.ClientChecks.RejectInvalidHELO || s.listener.Submission || s.xclient {
+		return nil
+	}
+	status := checkHELOName(name, s.remoteIP, s.srv.Hostname)
+	if status == HELO_OK {
+		return nil
+	}
+	log.Warnf("%s sent an invalid HELO %s: %s", s.remoteIP, name, status)
+	metrics.Add(METRIC_REJECTED_HELO, 1)
+	return errors.Errorf("550 5.7.1 Helo command rejected: %s", heloReasons[status])
+}
+
+type FCrDNSResult struct {
+	IP        string
+	Host      string // empty if the reverse DNS isn't confirmed
+	Temporary bool   // the lookup failed
+}
+
+// The first name of the client address resolving to it
+func (c *ClientChecks) lookupFCrDNS(ip string) *FCrDNSResult {
+	result := &FCrDNSResult{IP: ip}
+	ctx, cancel := context.WithTimeout(context.Background(), DNS_TIMEOUT)
+	defer cancel()
+
+	isTemporary := func(err error) bool {
+		dnsErr, ok := err.(*net.DNSError)
+		return !ok || !dnsErr.IsNotFound
+	}
+	names, err := c.Resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		result.Temporary = isTemporary(err)
+		return result
+	}
+	client := net.ParseIP(ip)
+	for _, name := range names {
+		addrs, err := c.Resolver.LookupHost(ctx, name)
+		if err != nil {
+			result.Temporary = result.Temporary || isTemporary(err)
+			continue
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr).Equal(client) {
+				result.Host = strings.TrimSuffix(name, ".")
+				result.Temporary = false
+				return result
+			}
+		}
+	}
+	return result
+}
+
+// Local and trusted clients aren't looked up in DNS
+func (s *session) isCheckedClient() bool {
+	ip := net.ParseIP(s.remoteIP)
+	return ip != nil && !ip.IsLoopback() && !isTrustedIP(ip, s.snapshot.TrustedNetworks)
+}
+
+// Forward-confirmed reverse DNS of the client, looked up again if XCLIENT
+// changed its address. The confirmed name is used in the Received header.
+func (s *session) fcrdnsResult() *FCrDNSResult {
+	if s.fcrdns != nil && s.fcrdns.IP == s.remoteIP {
+		return s.fcrdns
+	}
+	s.fcrdns = &FCrDNSResult{IP: s.remoteIP}
+	if !s.snapshot.ClientChecks.FCrDNS || !s.isCheckedClient() {
+		return s.fcrdns
+	}
+	s.fcrdns = s.snapshot.ClientChecks.lookupFCrDNS(s.remoteIP)
+	if s.fcrdns.Host == "" {
+		log.Infof("%s has no forward-confirmed reverse DNS", s.remoteIP)
+	} else if s.remoteHost == "unknown" {
+		s.remoteHost = s.fcrdns.Host
+	}
+	return s.fcrdns
+}
+
+// The reply to a client without forward-confirmed reverse DNS, if they are
+// rejected
+func (s *session) unknownClientError() error {
+	if !s.snapshot.ClientChecks.RejectUnknownClients || !s.isCheckedClient() {
+		return nil
+	}
+	result := s.fcrdnsResult()
+	if result.Host != "" {
+		return nil
+	}
+	metrics.Add(METRIC_UNKNOWN_CLIENTS, 1)
+	if result.Temporary {
+		return errors.Errorf("450 4.7.25 Client host rejected: cannot find your hostname, [%s]", s.remoteIP)
+	}
+	return errors.Errorf("550 5.7.25 Client host rejected: cannot find your hostname, [%s]", s.remoteIP)
+}
+
+// Reject the early talkers and the blocked or unknown clients before the
+// banner, except on the submission listeners where the users authenticate
+// later
+func connectHandler(s *session) error {
+	if s.listener.Submission {
+		return nil
+	}
+	if s.earlyTalker {
+		log.Warnf("%s talked before the greeting", s.remoteIP)
+		metrics.Add(METRIC_EARLY_TALKERS, 1)
+		if s.snapshot.ClientChecks.RejectEarlyTalkers {
+			return errors.New("554 5.5.0 Protocol error: talked before the greeting")
+		}
+	}
+	if err := s.dnsblError("554"); err != nil {
+		return err
+	}
+	return s.unknownClientError()
+}
+
+// The client address can change with XCLIENT, it's checked again for each
+// recipient. Authenticated clients aren't rejected.
+func checkClient(s *session) error {
+	if s.authenticated {
+		return nil
+	}
+	if err := s.dnsblError("550"); err != nil {
+		return err
+	}
+	s.fcrdnsResult()
+	return s.unknownClientError()
+}
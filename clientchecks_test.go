@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckHELOName(t *testing.T) {
+	for name, expected := range map[string]HELOStatus{
+		"mail.example.com":         HELO_OK,
+		"mail.example.com.":        HELO_OK,
+		"mail.bücher.de":           HELO_OK,
+		"[192.0.2.1]":              HELO_OK,
+		"[IPv6:2001:db8::1]":       HELO_MISMATCH,
+		"[192.0.2.2]":              HELO_MISMATCH,
+		"[mail.example.com]":       HELO_INVALID,
+		"":                         HELO_INVALID,
+		"mail..example.com":        HELO_INVALID,
+		"mail_server.example.com":  HELO_INVALID,
+		"192.0.2.1":                HELO_BARE_IP,
+		"localhost":                HELO_LOCALHOST,
+		"LOCALHOST.localdomain":    HELO_LOCALHOST,
+		"mx.test.local":            HELO_OURS,
+		"MX.test.local.":           HELO_OURS,
+		"workstation":              HELO_NOT_FQDN,
+		"-invalid-.example.com":    HELO_INVALID,
+		"a.b.c.d.e.f.example.com.": HELO_OK,
+	} {
+		assert.Equal(t, expected, checkHELOName(name, "192.0.2.1", "mx.test.local"), name)
+	}
+	assert.Equal(t, HELO_OK, checkHELOName("[IPv6:2001:db8::1]", "2001:db8::1", "mx.test.local"))
+}
+
+// withClientChecks checks the clients with the connect and HELO handlers
+func withClientChecks(checks ClientChecks) testServerOption {
+	return func(t *testing.T, ts *testServer) {
+		snapshot := &Snapshot{ClientChecks: checks}
+		ts.srv.Snapshot = func() *Snapshot { return snapshot }
+		ts.srv.HandlerConnect = connectHandler
+		ts.srv.HandlerHelo = heloHandler
+	}
+}
+
+func TestEarlyTalker(t *testing.T) {
+	addr := startTestServer(t, &Server{}, withClientChecks(ClientChecks{GreetDelay: 100 * time.Millisecond, RejectEarlyTalkers: true}))
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	conn.Write([]byte("EHLO client.example.com\r\n"))
+	_, msg, err := c.ReadResponse(220)
+	assert.NotNil(t, err)
+	assert.Equal(t, "5.5.0 Protocol error: talked before the greeting", msg)
+
+	// waiting for the banner
+	c = dialTestServer(t, addr)
+	cmd(t, c, 250, "EHLO client.example.com")
+}
+
+func TestHELOReject(t *testing.T) {
+	addr := startTestServer(t, &Server{}, withClientChecks(ClientChecks{RejectInvalidHELO: true}))
+	c := dialTestServer(t, addr)
+	assert.Equal(t, "5.7.1 Helo command rejected: localhost isn't a valid hostname",
+		cmd(t, c, 550, "EHLO localhost"))
+	cmd(t, c, 550, "HELO workstation")
+	cmd(t, c, 250, "EHLO client.example.com")
+
+	// not checked
+	addr = startTestServer(t, &Server{}, withClientChecks(ClientChecks{}))
+	c = dialTestServer(t, addr)
+	cmd(t, c, 250, "EHLO localhost")
+}
+
+func TestFCrDNS(t *testing.T) {
+	dns, _ := startFakeDNS(t, map[string]string{
+		"1.2.0.192.in-addr.arpa": "mail.example.com",
+		"mail.example.com":       "192.0.2.1",
+		"2.2.0.192.in-addr.arpa": "forged.example.com",
+		"forged.example.com":     "198.51.100.1",
+	})
+	snapshot := &Snapshot{ClientChecks: ClientChecks{
+		FCrDNS:               true,
+		RejectUnknownClients: true,
+		Resolver:             newResolver(dns),
+	}}
+	session := func(ip string) *session {
+		return &session{snapshot: snapshot, remoteIP: ip, remoteHost: "unknown", listener: &Listener{}}
+	}
+
+	s := session("192.0.2.1")
+	assert.Nil(t, checkClient(s))
+	assert.Equal(t, "mail.example.com", s.fcrdns.Host)
+	assert.Equal(t, "mail.example.com", s.remoteHost)
+
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		s = session(ip)
+		err := checkClient(s)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, "550 5.7.25 Client host rejected: cannot find your hostname, ["+ip+"]", err.Error())
+		}
+		assert.Equal(t, "", s.fcrdns.Host)
+		assert.Equal(t, "unknown", s.remoteHost)
+	}
+
+	// local and authenticated clients
+	assert.Nil(t, checkClient(session("127.0.0.1")))
+	s = session("192.0.2.3")
+	s.authenticated = true
+	assert.Nil(t, checkClient(s))
+}
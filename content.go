@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Size        int
+}
+
+// Content of the email as seen by the rules, extracted from the MIME tree
+type EmailContent struct {
+	Text        string
+	Attachments []Attachment
+	Size        int
+}
+
+// Lazily parsed content, shared between the copies of an Email
+type lazyContent struct {
+	once    sync.Once
+	content *EmailContent
+	err     error
+}
+
+func NewEmail(envelope EmailEnvelope, msg *mail.Message, raw *io.SectionReader) Email {
+	return Email{
+		Envelope: envelope,
+		Data:     msg,
+		Raw:      raw,
+		content:  new(lazyContent),
+	}
+}
+
+// Content parses the MIME tree on first use. The original email is read
+// again, so the body of email.Data isn't consumed.
+func (email Email) Content() (*EmailContent, error) {
+	if email.content == nil {
+		return parseContent(email)
+	}
+	email.content.once.Do(func() {
+		email.content.content, email.content.err = parseContent(email)
+	})
+	return email.content.content, email.content.err
+}
+
+// A malformed message is the sender's data, retrying won't fix it: its
+// content is empty and doesn't match the rules
+func parseContent(email Email) (*EmailContent, error) {
+	content := &EmailContent{Size: int(email.Raw.Size())}
+	msg, err := mail.ReadMessage(email.Reader())
+	if err != nil {
+		log.Warnf("could not read message content: %s", err)
+		return content, nil
+	}
+
+	text := new(strings.Builder)
+	if err := walkPart(textproto.MIMEHeader(msg.Header), msg.Body, content, text); err != nil {
+		log.Warnf("could not parse MIME, the content is ignored: %s", err)
+		return &EmailContent{Size: content.Size}, nil
+	}
+	content.Text = text.String()
+	return content, nil
+}
+
+func decodeTransferEncoding(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+func walkPart(header textproto.MIMEHeader, body io.Reader, content *EmailContent, text *strings.Builder) error {
+	mediatype, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediatype = "text/plain"
+	}
+
+	if strings.HasPrefix(mediatype, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := walkPart(part.Header, part, content, text); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := ioutil.ReadAll(decodeTransferEncoding(header, body))
+	if err != nil {
+		return err
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dparams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	filename = decodeHeader(filename)
+
+	if disposition == "attachment" || filename != "" {
+		content.Attachments = append(content.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: mediatype,
+			Size:        len(data),
+		})
+		return nil
+	}
+
+	switch mediatype {
+	case "text/plain":
+		text.WriteString(decodeCharset(params["charset"], data))
+	case "text/html":
+		text.WriteString(htmlToText([]byte(decodeCharset(params["charset"], data))))
+	}
+	return nil
+}
+
+func decodeCharset(charset string, data []byte) string {
+	reader, err := charsetReader(charset, bytes.NewReader(data))
+	if err != nil {
+		return string(data)
+	}
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return string(data)
+	}
+	return string(decoded)
+}
+
+func htmlToText(data []byte) string {
+	out := new(strings.Builder)
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	skip := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return out.String()
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				skip = true
+			case "br", "p", "div", "tr", "li":
+				out.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				skip = false
+			}
+		case html.TextToken:
+			if !skip {
+				out.Write(tokenizer.Text())
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const multipartEmail = "From: sven@b.ee\r\n" +
+	"To: a@gmail.com\r\n" +
+	"Subject: invoice\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Please find the invoice =3D attached.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<html><head><style>p {}</style></head><body><p>Invoice <b>#42</b></p></body></html>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"invoice.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"=?UTF-8?Q?setup.exe?=\"\r\n" +
+	"\r\n" +
+	"MZ\r\n" +
+	"--outer--\r\n"
+
+func TestParseContent(t *testing.T) {
+	email := makeEmail(multipartEmail)
+
+	content, err := email.Content()
+	assert.Nil(t, err)
+	assert.Contains(t, content.Text, "Please find the invoice = attached.")
+	assert.Contains(t, content.Text, "Invoice #42")
+	assert.NotContains(t, content.Text, "p {}")
+	assert.Equal(t, content.Size, len(multipartEmail))
+	assert.Equal(t, content.Attachments, []Attachment{
+		{Filename: "invoice.pdf", ContentType: "application/pdf", Size: 9},
+		{Filename: "setup.exe", ContentType: "application/octet-stream", Size: 2},
+	})
+}
+
+func TestParseContentOnce(t *testing.T) {
+	email := makeEmail(multipartEmail)
+
+	a, err := email.Content()
+	assert.Nil(t, err)
+	b, err := email.Content()
+	assert.Nil(t, err)
+	assert.True(t, a == b, "content was parsed twice")
+}
+
+func TestMatchAttachment(t *testing.T) {
+	email := makeEmail(multipartEmail)
+
+	matches := []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_ATTACHMENT_CONTENT_TYPE, Value: "application/pdf"},
+		{Type: MATCH_REGEX, Field: FIELD_ATTACHMENT_FILENAME, Value: "*.exe"},
+		{Type: MATCH_LITERAL, Field: FIELD_ATTACHMENT_COUNT, Value: "2"},
+		{Type: MATCH_REGEX, Field: FIELD_BODY, Value: "*invoice #42*"},
+		{Type: MATCH_GREATER, Field: FIELD_SIZE, Value: "100"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+
+	matches = []Match{
+		{Type: MATCH_LESS, Field: FIELD_SIZE, Value: "100"},
+	}
+	v, err = HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, false)
+}
+
+func TestMatchNoAttachment(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: a@gmail.com
+Subject: test
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`)
+
+	matches := []Match{
+		{Type: MATCH_REGEX, Field: FIELD_ATTACHMENT_FILENAME, Value: "*"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, false)
+
+	matches = []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_ATTACHMENT_COUNT, Value: "0"},
+		{Type: MATCH_REGEX, Field: FIELD_BODY, Value: "hello*"},
+	}
+	v, err = HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
+
+func TestMatchMalformedMIME(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: a@gmail.com
+Subject: test
+Content-Type: multipart/mixed; boundary="b"
+
+--b
+Content-Type: text/plain
+
+Hello world!
+--b
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: base64
+
+not base64!
+--b--
+`)
+
+	// the content is ignored instead of failing the rules
+	matches := []Match{
+		{Type: MATCH_REGEX, Field: FIELD_BODY, Value: "hello*"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, false)
+
+	matches = []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_ATTACHMENT_COUNT, Value: "0"},
+	}
+	v, err = HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
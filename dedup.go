@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	METRIC_DUPLICATES = "duplicates"
+
+	DEDUP_SAVE_INTERVAL = 10 * time.Second
+)
+
+var (
+	DEDUP_TTL = 24 * time.Hour
+
+	// declare as var to be able to replace it in testing
+	DEDUP_FILE = "/var/lib/mailway/dedup.json"
+)
+
+type dedupEntry struct {
+	ID      string    `json:"id"` // of the mail which completed the actions
+	Expires time.Time `json:"expires"`
+}
+
+// Deliveries persisted in a JSON file, loaded on first use. An upstream MTA
+// retrying a message after a temporary failure doesn't get the actions which
+// already completed run again. The file is written at most every
+// DEDUP_SAVE_INTERVAL and on close, the deliveries since the last write are
+// forgotten if the process is killed.
+type dedupStore struct {
+	sync.Mutex
+	file    string
+	entries map[string]*dedupEntry
+	changed bool // since the last write
+
+	saveLock sync.Mutex
+	saved    time.Time
+}
+
+// Identity of a message for the deduplication, the headers we add change
+// with each attempt and aren't part of it. Empty without a Message-ID.
+type messageFingerprint struct {
+	messageID string
+	bodyHash  string
+}
+
+func fingerprintMessage(data *io.SectionReader) (messageFingerprint, error) {
+	var fp messageFingerprint
+	msg, err := mail.ReadMessage(io.NewSectionReader(data, 0, data.Size()))
+	if err != nil {
+		return fp, errors.Wrap(err, "could not read message")
+	}
+	messageID := strings.TrimSpace(msg.Header.Get("Message-ID"))
+	if messageID == "" {
+		return fp, nil
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, msg.Body); err != nil {
+		return fp, errors.Wrap(err, "could not read body")
+	}
+	fp.messageID = messageID
+	fp.bodyHash = hex.EncodeToString(hash.Sum(nil))
+	return fp, nil
+}
+
+// Message-ID, recipient and body hash
+func dedupKey(fp messageFingerprint, rcpt string) string {
+	key := sha256.Sum256([]byte(fp.messageID + "\x00" + strings.ToLower(rcpt) + "\x00" + fp.bodyHash))
+	return hex.EncodeToString(key[:])
+}
+
+// Returns the id of the mail which was delivered to all the keys, empty if
+// one of them wasn't
+func (d *dedupStore) get(keys []string, now time.Time) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.entries == nil {
+		if err := d.load(); err != nil {
+			return "", err
+		}
+	}
+	id := ""
+	for _, key := range keys {
+		entry, ok := d.entries[key]
+		if !ok || now.After(entry.Expires) {
+			return "", nil
+		}
+		id = entry.ID
+	}
+	return id, nil
+}
+
+func (d *dedupStore) add(keys []string, id string, now time.Time, ttl time.Duration) error {
+	d.Lock()
+	if d.entries == nil {
+		if err := d.load(); err != nil {
+			d.Unlock()
+			return err
+		}
+	}
+	for _, key := range keys {
+		d.entries[key] = &dedupEntry{ID: id, Expires: now.Add(ttl)}
+	}
+	d.changed = true
+	d.Unlock()
+
+	d.saveLock.Lock()
+	defer d.saveLock.Unlock()
+	if time.Since(d.saved) < DEDUP_SAVE_INTERVAL {
+		return nil
+	}
+	return d.save()
+}
+
+func (d *dedupStore) load() error {
+	entries := make(map[string]*dedupEntry)
+	content, err := ioutil.ReadFile(d.file)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read deduplication store")
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &entries); err != nil {
+			return errors.Wrap(err, "failed to parse deduplication store")
+		}
+	}
+	d.entries = entries
+	d.saved = time.Now()
+	return nil
+}
+
+func (d *dedupStore) Close() error {
+	d.saveLock.Lock()
+	defer d.saveLock.Unlock()
+	return d.save()
+}
+
+// Write the unexpired entries if they changed, replacing the file atomically
+func (d *dedupStore) save() error {
+	d.saved = time.Now()
+	d.Lock()
+	if !d.changed {
+		d.Unlock()
+		return nil
+	}
+	for key, entry := range d.entries {
+		if d.saved.After(entry.Expires) {
+			delete(d.entries, key)
+		}
+	}
+	content, err := json.Marshal(d.entries)
+	d.changed = false
+	d.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "could not encode deduplication store")
+	}
+
+	if err := d.write(content); err != nil {
+		// written again on the next save
+		d.Lock()
+		d.changed = true
+		d.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (d *dedupStore) write(content []byte) error {
+	if err := os.MkdirAll(path.Dir(d.file), 0755); err != nil {
+		return errors.Wrap(err, "could not create deduplication directory")
+	}
+	tmp := d.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return errors.Wrap(err, "could not write deduplication store")
+	}
+	return errors.Wrap(os.Rename(tmp, d.file), "could not write deduplication store")
+}
+
+// The store is kept across reloads as long as its file doesn't change
+var dedupStores struct {
+	sync.Mutex
+	store *dedupStore
+}
+
+func openDedup(settings *Settings) *dedupStore {
+	file := DEDUP_FILE
+	if v := settings.DedupFile; v != "" {
+		file = v
+	}
+
+	dedupStores.Lock()
+	defer dedupStores.Unlock()
+	if dedupStores.store != nil && dedupStores.store.file == file {
+		return dedupStores.store
+	}
+	if dedupStores.store != nil {
+		if err := dedupStores.store.Close(); err != nil {
+			log.Errorf("could not save the deduplication store: %s", err)
+		}
+	}
+	dedupStores.store = &dedupStore{file: file}
+	return dedupStores.store
+}
+
+// The keys of the recipients of the group, for an action if target isn't
+// empty
+func dedupKeys(fp messageFingerprint, group rcptGroup, target string) []string {
+	keys := make([]string, len(group.rcpts))
+	for i, rcpt := range group.rcpts {
+		keys[i] = dedupKey(fp, rcpt)
+		if target != "" {
+			key := sha256.Sum256([]byte(keys[i] + "\x00" + target))
+			keys[i] = hex.EncodeToString(key[:])
+		}
+	}
+	return keys
+}
+
+// The id recorded for the group, of its first recipient
+func (group rcptGroup) mailID(s *session) string {
+	if len(group.mails) > 0 {
+		return group.mails[0].id.String()
+	}
+	return s.id.String()
+}
+
+func dedupEnabled(s *session, fp messageFingerprint) bool {
+	return s.snapshot.DedupTTL > 0 && s.snapshot.Dedup != nil && fp.messageID != ""
+}
+
+// Returns true if the message was already processed for all the recipients
+// of the group, the hit is recorded in maildb. Errors of the store let the
+// message be processed again.
+func isDuplicate(s *session, fp messageFingerprint, group rcptGroup) bool {
+	if !dedupEnabled(s, fp) {
+		return false
+	}
+	id, err := s.snapshot.Dedup.get(dedupKeys(fp, group, ""), time.Now())
+	if err != nil {
+		log.Errorf("deduplication: %s", err)
+		return false
+	}
+	if id == "" {
+		return false
+	}
+	log.Infof("message %s to %s already processed as %s", fp.messageID, strings.Join(group.rcpts, ", "), id)
+	metrics.Add(METRIC_DUPLICATES, 1)
+	if err := mailDBSetGroup(s, group, "duplicate_of", id); err != nil {
+		log.Errorf("mailDBSet duplicate_of: %s", err)
+	}
+	return true
+}
+
+// The completed actions of a group, also used by the list expansions once
+// the session moved on. Nil if the deduplication is disabled.
+type dedupActions struct {
+	store *dedupStore
+	ttl   time.Duration
+	fp    messageFingerprint
+	group rcptGroup
+	id    string
+}
+
+func newDedupActions(s *session, fp messageFingerprint, group rcptGroup) *dedupActions {
+	if !dedupEnabled(s, fp) {
+		return nil
+	}
+	return &dedupActions{
+		store: s.snapshot.Dedup,
+		ttl:   s.snapshot.DedupTTL,
+		fp:    fp,
+		group: group,
+		id:    group.mailID(s),
+	}
+}
+
+// Returns true if an action, identified by its type and destination, already
+// completed for the message when it was processed before. The other actions
+// of a message which failed are run again.
+func (d *dedupActions) done(target string) bool {
+	if d == nil {
+		return false
+	}
+	id, err := d.store.get(dedupKeys(d.fp, d.group, target), time.Now())
+	if err != nil {
+		log.Errorf("deduplication: %s", err)
+		return false
+	}
+	if id == "" {
+		return false
+	}
+	log.Infof("message %s: %s already done as %s", d.fp.messageID, target, id)
+	metrics.Add(METRIC_DUPLICATES, 1)
+	return true
+}
+
+// Record that an action completed, as soon as it did. An empty target
+// records that all the actions of the group did.
+func (d *dedupActions) record(target string) {
+	if d == nil {
+		return
+	}
+	if err := d.store.add(dedupKeys(d.fp, d.group, target), d.id, time.Now(), d.ttl); err != nil {
+		log.Errorf("deduplication: %s", err)
+	}
+}
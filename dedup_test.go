@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func withDedup(t *testing.T) *dedupStore {
+	dir, err := ioutil.TempDir("", "dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &dedupStore{file: path.Join(dir, "dedup.json")}
+}
+
+func fingerprint(t *testing.T, raw string) messageFingerprint {
+	fp, err := fingerprintMessage(io.NewSectionReader(strings.NewReader(raw), 0, int64(len(raw))))
+	assert.Nil(t, err)
+	return fp
+}
+
+func TestFingerprintMessage(t *testing.T) {
+	fp := fingerprint(t, "Received: from a by b; attempt 1\r\nMessage-ID: <1@b.ee>\r\nSubject: test\r\n\r\nHello\r\n")
+	assert.Equal(t, "<1@b.ee>", fp.messageID)
+
+	// the headers we add don't count
+	assert.Equal(t, fp, fingerprint(t, "Received: from a by b; attempt 2\r\nMessage-ID: <1@b.ee>\r\nSubject: test\r\n\r\nHello\r\n"))
+	assert.NotEqual(t, fp, fingerprint(t, "Message-ID: <1@b.ee>\r\nSubject: test\r\n\r\nHello again\r\n"))
+	assert.Equal(t, messageFingerprint{}, fingerprint(t, "Subject: test\r\n\r\nHello\r\n"))
+
+	assert.Equal(t, dedupKey(fp, "A@test.local"), dedupKey(fp, "a@test.local"))
+	assert.NotEqual(t, dedupKey(fp, "a@test.local"), dedupKey(fp, "b@test.local"))
+}
+
+func TestDedupStore(t *testing.T) {
+	store := withDedup(t)
+	now := time.Now()
+
+	id, err := store.get([]string{"a", "b"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+	assert.Nil(t, store.add([]string{"a", "b"}, "id1", now, time.Hour))
+	id, err = store.get([]string{"a", "b"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "id1", id)
+
+	// all the keys are needed
+	id, err = store.get([]string{"a", "c"}, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+
+	// persisted on close
+	_, err = os.Stat(store.file)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, store.Close())
+	store = &dedupStore{file: store.file}
+	id, err = store.get([]string{"b"}, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, "id1", id)
+
+	// expired
+	id, err = store.get([]string{"a"}, now.Add(2*time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, "", id)
+
+	// dropped on the next write
+	assert.Nil(t, store.add([]string{"c"}, "id2", now.Add(-2*time.Hour), time.Hour))
+	assert.Len(t, store.entries, 3)
+	assert.Nil(t, store.Close())
+	assert.Len(t, store.entries, 2)
+}
+
+func TestOpenDedup(t *testing.T) {
+	t.Cleanup(func() { dedupStores.store = nil })
+	dir := path.Dir(withDedup(t).file)
+
+	store := openDedup(&Settings{})
+	assert.Equal(t, DEDUP_FILE, store.file)
+	assert.True(t, store == openDedup(&Settings{}))
+
+	// saved when the file changes
+	store = openDedup(&Settings{DedupFile: path.Join(dir, "a.json")})
+	assert.Nil(t, store.add([]string{"a"}, "id1", time.Now(), time.Hour))
+	other := openDedup(&Settings{DedupFile: path.Join(dir, "b.json")})
+	assert.Equal(t, path.Join(dir, "b.json"), other.file)
+	_, err := os.Stat(path.Join(dir, "a.json"))
+	assert.Nil(t, err)
+}
+
+func TestDedupSession(t *testing.T) {
+	store := withDedup(t)
+	fp := fingerprint(t, "Message-ID: <1@b.ee>\r\n\r\nHello\r\n")
+	group := rcptGroup{domain: "test.local", rcpts: []string{"a@test.local", "b@test.local"}}
+	s := &session{id: uuid.New(), snapshot: &Snapshot{DedupTTL: time.Hour, Dedup: store}}
+
+	assert.False(t, isDuplicate(s, fp, group))
+	newDedupActions(s, fp, group).record("")
+	id, err := store.get(dedupKeys(fp, group, ""), time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, s.id.String(), id)
+
+	// another recipient of the message
+	assert.False(t, isDuplicate(s, fp, rcptGroup{domain: "test.local", rcpts: []string{"a@test.local", "c@test.local"}}))
+
+	// without Message-ID or disabled
+	newDedupActions(s, messageFingerprint{}, group).record("")
+	assert.Len(t, store.entries, 2)
+	s.snapshot = &Snapshot{Dedup: store}
+	assert.False(t, isDuplicate(s, fp, group))
+	assert.Nil(t, newDedupActions(s, fp, group))
+}
+
+// A retried message only runs the actions which didn't complete
+func TestDedupActions(t *testing.T) {
+	store := withDedup(t)
+	fp := fingerprint(t, "Message-ID: <1@b.ee>\r\n\r\nHello\r\n")
+	mail := mailRecord{id: uuid.New()}
+	group := rcptGroup{domain: "test.local", rcpts: []string{"a@test.local"}, mails: []mailRecord{mail}}
+	s := &session{id: uuid.New(), snapshot: &Snapshot{DedupTTL: time.Hour, Dedup: store}}
+
+	actions := newDedupActions(s, fp, group)
+	assert.False(t, actions.done("send a@example.com"))
+	actions.record("send a@example.com")
+	assert.True(t, actions.done("send a@example.com"))
+	assert.False(t, actions.done("webhook https://example.com"))
+	// the message isn't processed until all its actions are
+	assert.False(t, isDuplicate(s, fp, group))
+
+	id, err := store.get(dedupKeys(fp, group, "send a@example.com"), time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, mail.id.String(), id)
+}
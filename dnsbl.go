@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DNS lookups, satisfied by net.Resolver, replaceable in testing
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Client IP addresses listed in DNS-based blocklists. Each zone listing the
+// client adds its weight to the score, the client is blocked once the score
+// reaches the threshold.
+type DNSBL struct {
+	Zones     []DNSBLZoneSettings
+	Threshold int
+	Reject    bool // reject the blocked clients, otherwise only flagged
+	CacheTTL  time.Duration
+	Resolver  Resolver
+}
+
+type DNSBLResult struct {
+	IP     string
+	Score  int
+	Listed []string // zones listing the IP address
+}
+
+func (r *DNSBLResult) String() string {
+	return fmt.Sprintf("score=%d listed=%s", r.Score, strings.Join(r.Listed, ","))
+}
+
+const (
+	METRIC_DNSBL_BLOCKED = "dnsbl_blocked"
+
+	// added to the mails of listed clients
+	DNSBL_HEADER = "X-Mailway-DNSBL"
+)
+
+var (
+	DNSBL_THRESHOLD = 1
+	DNSBL_CACHE_TTL = time.Hour
+	DNS_TIMEOUT     = 5 * time.Second
+
+	dnsblCache = &dnsCache{}
+)
+
+func (d *DNSBL) Enabled() bool {
+	return len(d.Zones) > 0
+}
+
+func (d *DNSBL) Blocked(r *DNSBLResult) bool {
+	return r.Score > 0 && r.Score >= d.Threshold
+}
+
+// Resolver sending its queries to addr, or the system resolver
+func newResolver(addr string) Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// Results of the queries, listed or not, kept for the cache TTL
+type dnsCache struct {
+	sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func (c *dnsCache) get(name string, now time.Time) ([]string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[name]
+	if !ok || now.After(entry.expires) {
+		delete(c.entries, name)
+		return nil, false
+	}
+	return entry.addrs, true
+}
+
+func (c *dnsCache) set(name string, addrs []string, now time.Time, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]dnsCacheEntry)
+	}
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[name] = dnsCacheEntry{addrs: addrs, expires: now.Add(ttl)}
+}
+
+// The name queried in the zones: the reversed octets of an IPv4 address, or
+// the reversed nibbles of an IPv6 address
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	const hex = "0123456789abcdef"
+	ip16 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hex[ip16[i]&0xf]), string(hex[ip16[i]>>4]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// Listings are in 127.0.0.0/8, 127.255.255.0/24 is used by some zones for
+// errors like a query limit exceeded
+func isListing(addr string) bool {
+	ip := net.ParseIP(addr).To4()
+	return ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255)
+}
+
+func (d *DNSBL) lookupZone(ctx context.Context, name string) ([]string, error) {
+	now := time.Now()
+	if addrs, ok := dnsblCache.get(name, now); ok {
+		return addrs, nil
+	}
+	addrs, err := d.Resolver.LookupHost(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		addrs = nil
+	}
+	dnsblCache.set(name, addrs, now, d.CacheTTL)
+	return addrs, nil
+}
+
+// Query the zones in parallel, a zone failing to answer doesn't list the
+// address
+func (d *DNSBL) Lookup(ip string) (*DNSBLResult, error) {
+	result := &DNSBLResult{IP: ip}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return result, errors.Errorf("invalid IP address %s", ip)
+	}
+	reversed := reverseIP(parsed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), DNS_TIMEOUT)
+	defer cancel()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, zone := range d.Zones {
+		wg.Add(1)
+		go func(zone DNSBLZoneSettings) {
+			defer wg.Done()
+			addrs, err := d.lookupZone(ctx, reversed+"."+zone.Zone)
+			if err != nil {
+				log.Warnf("DNSBL lookup of %s in %s failed: %s", ip, zone.Zone, err)
+				return
+			}
+			for _, addr := range addrs {
+				if isListing(addr) {
+					mu.Lock()
+					result.Score += zone.Weight
+					result.Listed = append(result.Listed, zone.Zone)
+					mu.Unlock()
+					return
+				}
+			}
+		}(zone)
+	}
+	wg.Wait()
+	sort.Strings(result.Listed)
+	return result, nil
+}
+
+// Listing of the client, looked up again if XCLIENT changed its address
+func (s *session) dnsblResult() *DNSBLResult {
+	if s.dnsbl != nil && s.dnsbl.IP == s.remoteIP {
+		return s.dnsbl
+	}
+	s.dnsbl = &DNSBLResult{IP: s.remoteIP}
+	if !s.snapshot.DNSBL.Enabled() || !s.isCheckedClient() {
+		return s.dnsbl
+	}
+	result, err := s.snapshot.DNSBL.Lookup(s.remoteIP)
+	if err != nil {
+		log.Errorf("DNSBL: %s", err)
+		return s.dnsbl
+	}
+	if len(result.Listed) > 0 {
+		log.Infof("%s is listed in DNSBL: %s", s.remoteIP, result)
+	}
+	s.dnsbl = result
+	return s.dnsbl
+}
+
+// The reply to a client reaching the threshold, if they are rejected
+func (s *session) dnsblError(code string) error {
+	result := s.dnsblResult()
+	if !s.snapshot.DNSBL.Reject || !s.snapshot.DNSBL.Blocked(result) {
+		return nil
+	}
+	metrics.Add(METRIC_DNSBL_BLOCKED, 1)
+	return errors.Errorf("%s 5.7.1 Service unavailable; client host [%s] blocked using %s",
+		code, result.IP, strings.Join(result.Listed, ", "))
+}
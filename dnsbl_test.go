@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS server answering the A and PTR queries of records, the other names
+// don't exist. Returns its address and the number of queries it received.
+func startFakeDNS(t *testing.T, records map[string]string) (string, *int64) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var queries int64
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if err := query.Unpack(buf[:n]); err != nil || len(query.Questions) != 1 {
+				continue
+			}
+			atomic.AddInt64(&queries, 1)
+			question := query.Questions[0]
+			name := strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")
+
+			reply := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+				Questions: query.Questions,
+			}
+			if value, ok := records[name]; !ok {
+				reply.RCode = dnsmessage.RCodeNameError
+			} else if question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypePTR {
+				var body dnsmessage.ResourceBody
+				if question.Type == dnsmessage.TypeA {
+					a := &dnsmessage.AResource{}
+					copy(a.A[:], net.ParseIP(value).To4())
+					body = a
+				} else {
+					body = &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(value + ".")}
+				}
+				reply.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   body,
+				}}
+			}
+			packed, err := reply.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(packed, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &queries
+}
+
+func withDNSBLCache(t *testing.T) {
+	prev := dnsblCache
+	dnsblCache = &dnsCache{}
+	t.Cleanup(func() { dnsblCache = prev })
+}
+
+func TestReverseIP(t *testing.T) {
+	assert.Equal(t, "1.2.0.192", reverseIP(net.ParseIP("192.0.2.1")))
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+		reverseIP(net.ParseIP("2001:db8::1")))
+}
+
+func TestDNSBLLookup(t *testing.T) {
+	withDNSBLCache(t)
+	addr, queries := startFakeDNS(t, map[string]string{
+		"1.2.0.192.zen.test":   "127.0.0.2",
+		"1.2.0.192.other.test": "127.0.0.4",
+		"1.2.0.192.error.test": "127.255.255.254",
+	})
+	dnsbl := DNSBL{
+		Zones: []DNSBLZoneSettings{
+			{Zone: "zen.test", Weight: 2},
+			{Zone: "other.test", Weight: 1},
+			{Zone: "error.test", Weight: 5},
+			{Zone: "clean.test", Weight: 5},
+		},
+		Threshold: 3,
+		CacheTTL:  time.Minute,
+		Resolver:  newResolver(addr),
+	}
+
+	result, err := dnsbl.Lookup("192.0.2.1")
+	assert.Nil(t, err)
+	assert.Equal(t, &DNSBLResult{IP: "192.0.2.1", Score: 3, Listed: []string{"other.test", "zen.test"}}, result)
+	assert.True(t, dnsbl.Blocked(result))
+
+	result, err = dnsbl.Lookup("192.0.2.2")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, result.Score)
+	assert.False(t, dnsbl.Blocked(result))
+
+	// cached, listed or not
+	count := atomic.LoadInt64(queries)
+	_, err = dnsbl.Lookup("192.0.2.1")
+	assert.Nil(t, err)
+	_, err = dnsbl.Lookup("192.0.2.2")
+	assert.Nil(t, err)
+	assert.Equal(t, count, atomic.LoadInt64(queries))
+
+	_, err = dnsbl.Lookup("invalid")
+	assert.NotNil(t, err)
+}
+
+func TestDNSBLReject(t *testing.T) {
+	withDNSBLCache(t)
+	dns, _ := startFakeDNS(t, map[string]string{"1.2.0.192.zen.test": "127.0.0.2"})
+	snapshot := &Snapshot{DNSBL: DNSBL{
+		Zones:     []DNSBLZoneSettings{{Zone: "zen.test", Weight: 1}},
+		Threshold: 1,
+		Reject:    true,
+		CacheTTL:  time.Minute,
+		Resolver:  newResolver(dns),
+	}}
+
+	addr := startTestServer(t, &Server{
+		Snapshot:       func() *Snapshot { return snapshot },
+		HandlerConnect: connectHandler,
+	}, withProxy("127.0.0.0/8"))
+	proxyHeader := func(ip string) dialOption {
+		return withPreamble([]byte("PROXY TCP4 " + ip + " 192.0.2.25 56324 25\r\n"))
+	}
+
+	var greeting string
+	dialTestServer(t, addr, proxyHeader("192.0.2.1"), withGreeting(554, &greeting))
+	assert.Equal(t, "5.7.1 Service unavailable; client host [192.0.2.1] blocked using zen.test", greeting)
+
+	dialTestServer(t, addr, proxyHeader("192.0.2.2"))
+
+	// authenticated clients aren't blocked on RCPT
+	s := &session{snapshot: snapshot, remoteIP: "192.0.2.1", listener: &Listener{}, domain: &Domain{Name: "test.local"}}
+	assert.NotNil(t, checkClient(s))
+	assert.Contains(t, s.makeMailHeader([]string{"c@test.local"}, "a@b.ee"), DNSBL_HEADER+": score=1 listed=zen.test")
+	s.authenticated = true
+	assert.Nil(t, checkClient(s))
+}
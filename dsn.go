@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// RFC 3461 parameters
+const (
+	DSN_RET_FULL = "FULL"
+	DSN_RET_HDRS = "HDRS"
+
+	DSN_NOTIFY_NEVER   = "NEVER"
+	DSN_NOTIFY_SUCCESS = "SUCCESS"
+	DSN_NOTIFY_FAILURE = "FAILURE"
+	DSN_NOTIFY_DELAY   = "DELAY"
+
+	// RFC 3464 section 2.3.3
+	DSN_ACTION_FAILED   = "failed"
+	DSN_ACTION_RELAYED  = "relayed"
+	DSN_ACTION_EXPANDED = "expanded"
+)
+
+// DSN parameters of a recipient, values are kept in their xtext form
+type DSNRcpt struct {
+	Notify []string
+	ORcpt  string
+}
+
+// DSN parameters of a mail transaction, values are kept in their xtext form
+type DSN struct {
+	Ret   string
+	EnvID string
+	Rcpts map[string]DSNRcpt
+}
+
+func (d DSN) Rcpt(rcpt string) DSNRcpt {
+	if d.Rcpts == nil {
+		return DSNRcpt{}
+	}
+	return d.Rcpts[rcpt]
+}
+
+// Without a NOTIFY parameter, a notice is sent on failure (RFC 3461 section
+// 4.1).
+func (r DSNRcpt) ShouldNotify(kind string) bool {
+	if len(r.Notify) == 0 {
+		return kind == DSN_NOTIFY_FAILURE || kind == DSN_NOTIFY_DELAY
+	}
+	for _, v := range r.Notify {
+		if v == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNotify(v string) ([]string, error) {
+	values := strings.Split(strings.ToUpper(v), ",")
+	for _, value := range values {
+		switch value {
+		case DSN_NOTIFY_NEVER:
+			if len(values) != 1 {
+				return nil, errors.New("NEVER can't be combined")
+			}
+		case DSN_NOTIFY_SUCCESS, DSN_NOTIFY_FAILURE, DSN_NOTIFY_DELAY:
+		default:
+			return nil, errors.Errorf("invalid NOTIFY value %s", value)
+		}
+	}
+	return values, nil
+}
+
+func parseORcpt(v string) (string, error) {
+	parts := strings.SplitN(v, ";", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", errors.Errorf("invalid ORCPT %s", v)
+	}
+	if _, err := xtextDecode(parts[1]); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+// RFC 3461 section 4, xtext encodes "+", "=" and characters outside of the
+// printable ASCII range as "+" followed by two hex digits.
+func xtextEncode(v string) string {
+	out := new(strings.Builder)
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(out, "+%02X", c)
+		} else {
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+func xtextDecode(v string) (string, error) {
+	out := new(strings.Builder)
+	for i := 0; i < len(v); i++ {
+		if v[i] != '+' {
+			out.WriteByte(v[i])
+			continue
+		}
+		if i+2 >= len(v) {
+			return "", errors.Errorf("invalid xtext %s", v)
+		}
+		c, err := strconv.ParseUint(v[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errors.Errorf("invalid xtext %s", v)
+		}
+		out.WriteByte(byte(c))
+		i += 2
+	}
+	return out.String(), nil
+}
+
+// ORCPT for a recipient, the one given by the client or the recipient itself
+func (d DSN) ORcpt(rcpt string) string {
+	if orcpt := d.Rcpt(rcpt).ORcpt; orcpt != "" {
+		return orcpt
+	}
+	return "rfc822;" + xtextEncode(rcpt)
+}
+
+// Build a delivery status notification (RFC 3464) for a recipient of the
+// email
+func makeNotice(instance *config.Config, envelope EmailEnvelope, rcpt string, action string, status string, diagnostic string, original io.Reader) ([]byte, error) {
+	hostname := instance.InstanceHostname
+
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+
+	headers := []string{
+		fmt.Sprintf("From: Mail Delivery System <MAILER-DAEMON@%s>", hostname),
+		fmt.Sprintf("To: <%s>", envelope.From),
+		fmt.Sprintf("Subject: Delivery Status Notification (%s)", action),
+		fmt.Sprintf("Date: %s", time.Now().Format(time.RFC1123Z)),
+		"Auto-Submitted: auto-replied",
+		"MIME-Version: 1.0",
+		fmt.Sprintf("Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"", w.Boundary()),
+	}
+
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "This is an automatically generated Delivery Status Notification.%s%s", CRLF, CRLF)
+	fmt.Fprintf(part, "Delivery to %s: %s%s", rcpt, action, CRLF)
+	if diagnostic != "" {
+		fmt.Fprintf(part, "%s%s", diagnostic, CRLF)
+	}
+
+	part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s%s", hostname, CRLF)
+	if envelope.DSN.EnvID != "" {
+		if envid, err := xtextDecode(envelope.DSN.EnvID); err == nil {
+			fmt.Fprintf(part, "Original-Envelope-Id: %s%s", envid, CRLF)
+		}
+	}
+	fmt.Fprintf(part, "Arrival-Date: %s%s%s", time.Now().Format(time.RFC1123Z), CRLF, CRLF)
+	fmt.Fprintf(part, "Final-Recipient: rfc822; %s%s", rcpt, CRLF)
+	if orcpt := envelope.DSN.Rcpt(rcpt).ORcpt; orcpt != "" {
+		parts := strings.SplitN(orcpt, ";", 2)
+		if addr, err := xtextDecode(parts[1]); err == nil {
+			fmt.Fprintf(part, "Original-Recipient: %s; %s%s", parts[0], addr, CRLF)
+		}
+	}
+	fmt.Fprintf(part, "Action: %s%s", action, CRLF)
+	fmt.Fprintf(part, "Status: %s%s", status, CRLF)
+	if diagnostic != "" {
+		fmt.Fprintf(part, "Diagnostic-Code: smtp; %s%s", diagnostic, CRLF)
+	}
+
+	// The full content is only returned for failures, unless the sender asked
+	// for the headers only (RFC 3461 section 4.3)
+	if original != nil {
+		if action == DSN_ACTION_FAILED && envelope.DSN.Ret != DSN_RET_HDRS {
+			part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/rfc822"}})
+			if err != nil {
+				return nil, err
+			}
+			if _, err := io.Copy(part, original); err != nil {
+				return nil, err
+			}
+		} else {
+			part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+			if err != nil {
+				return nil, err
+			}
+			// copy the header section as is, up to the first empty line
+			r := bufio.NewReader(original)
+			for {
+				line, err := r.ReadString('\n')
+				if strings.TrimRight(line, "\r\n") == "" {
+					break
+				}
+				io.WriteString(part, line)
+				if err != nil {
+					break
+				}
+			}
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return append([]byte(strings.Join(headers, CRLF)+CRLF+CRLF), body.Bytes()...), nil
+}
+
+// Send a delivery status notification to the sender of the email, if the
+// recipient asked for it
+func sendNotice(email Email, rcpt string, kind string, action string, status string, diagnostic string) {
+	if email.Envelope.From == "" {
+		// never notify the null sender, the email is a notice itself
+		return
+	}
+	if !email.Envelope.DSN.Rcpt(rcpt).ShouldNotify(kind) {
+		return
+	}
+
+	var original io.Reader
+	if email.Raw != nil {
+		original = email.Reader()
+	}
+	notice, err := makeNotice(email.instance(), email.Envelope, rcpt, action, status, diagnostic, original)
+	if err != nil {
+		log.Errorf("could not create %s notice: %s", action, err)
+		return
+	}
+	log.Infof("send %s notice for %s to %s", action, rcpt, email.Envelope.From)
+	envelope := EmailEnvelope{From: "", SMTPUTF8: email.Envelope.SMTPUTF8}
+	if err := sendMailoutData(email.instance(), envelope, email.Envelope.From, bytes.NewReader(notice)); err != nil {
+		log.Errorf("could not send %s notice: %s", action, err)
+	}
+}
+
+// The enhanced status code of an SMTP reply
+func replyStatus(reply string) string {
+	fields := strings.Fields(reply)
+	if len(fields) > 1 && strings.Count(fields[1], ".") == 2 {
+		return fields[1]
+	}
+	return "4.0.0"
+}
+
+// Notify the sender of the recipients which failed permanently when the
+// message is accepted for the others, a single SMTP reply can't tell them
+// apart
+func notifyFailedRcpts(s *session, from string, to []string, errs []error, data *io.SectionReader) {
+	email := Email{
+		Envelope: EmailEnvelope{
+			From:     from,
+			To:       to,
+			SMTPUTF8: s.smtputf8,
+			Body:     s.body,
+			DSN:      s.dsn,
+			Login:    s.login,
+		},
+		Raw:      data,
+		settings: s.snapshot,
+	}
+	for i, rcpt := range to {
+		if i < len(errs) && errs[i] != nil && isPermanentReply(errs[i].Error()) {
+			log.Warnf("accepted the message without %s: %s", rcpt, errs[i])
+			sendNotice(email, rcpt, DSN_NOTIFY_FAILURE, DSN_ACTION_FAILED, replyStatus(errs[i].Error()), errs[i].Error())
+		}
+	}
+}
+
+// A 5xx SMTP reply, the other failures are retried by the client
+func isPermanentReply(reply string) bool {
+	return strings.HasPrefix(reply, "5")
+}
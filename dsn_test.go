@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mailway-app/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXtext(t *testing.T) {
+	assert.Equal(t, "a+2Bb+3Dc@d.ee", xtextEncode("a+b=c@d.ee"))
+	assert.Equal(t, "j+C3+B6rg", xtextEncode("jörg"))
+
+	v, err := xtextDecode("a+2Bb+3Dc@d.ee")
+	assert.Nil(t, err)
+	assert.Equal(t, "a+b=c@d.ee", v)
+
+	_, err = xtextDecode("a+2")
+	assert.NotNil(t, err)
+	_, err = xtextDecode("a+zz")
+	assert.NotNil(t, err)
+}
+
+func TestParseNotify(t *testing.T) {
+	v, err := parseNotify("success,FAILURE")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{DSN_NOTIFY_SUCCESS, DSN_NOTIFY_FAILURE}, v)
+
+	_, err = parseNotify("NEVER,SUCCESS")
+	assert.NotNil(t, err)
+	_, err = parseNotify("SOMETIMES")
+	assert.NotNil(t, err)
+}
+
+func TestShouldNotify(t *testing.T) {
+	assert.True(t, DSNRcpt{}.ShouldNotify(DSN_NOTIFY_FAILURE))
+	assert.False(t, DSNRcpt{}.ShouldNotify(DSN_NOTIFY_SUCCESS))
+	assert.True(t, DSNRcpt{Notify: []string{DSN_NOTIFY_SUCCESS}}.ShouldNotify(DSN_NOTIFY_SUCCESS))
+	assert.False(t, DSNRcpt{Notify: []string{DSN_NOTIFY_NEVER}}.ShouldNotify(DSN_NOTIFY_FAILURE))
+}
+
+func TestDSNORcpt(t *testing.T) {
+	dsn := DSN{Rcpts: map[string]DSNRcpt{
+		"a@b.ee": {ORcpt: "rfc822;x@y.ee"},
+	}}
+	assert.Equal(t, "rfc822;x@y.ee", dsn.ORcpt("a@b.ee"))
+	assert.Equal(t, "rfc822;c+2Bd@b.ee", dsn.ORcpt("c+d@b.ee"))
+}
+
+func makeTestNotice(t *testing.T, ret string, action string) string {
+	envelope := EmailEnvelope{
+		From: "a@b.ee",
+		To:   []string{"c@test.local"},
+		DSN: DSN{Ret: ret, EnvID: "id+2B1", Rcpts: map[string]DSNRcpt{
+			"c@test.local": {ORcpt: "rfc822;orig@test.local"},
+		}},
+	}
+	original := "Subject: test\r\n\r\nsecret body\r\n"
+	notice, err := makeNotice(&config.Config{InstanceHostname: "mx.test.local"}, envelope, "c@test.local", action, "5.0.0", "", strings.NewReader(original))
+	assert.Nil(t, err)
+	return string(notice)
+}
+
+func TestMakeNotice(t *testing.T) {
+	notice := makeTestNotice(t, "", DSN_ACTION_FAILED)
+	assert.Contains(t, notice, "To: <a@b.ee>")
+	assert.Contains(t, notice, "Reporting-MTA: dns; mx.test.local")
+	assert.Contains(t, notice, "report-type=delivery-status")
+	assert.Contains(t, notice, "Original-Envelope-Id: id+1")
+	assert.Contains(t, notice, "Original-Recipient: rfc822; orig@test.local")
+	assert.Contains(t, notice, "Action: failed")
+	assert.Contains(t, notice, "message/rfc822")
+	assert.Contains(t, notice, "secret body")
+}
+
+func TestMakeNoticeHeadersOnly(t *testing.T) {
+	notice := makeTestNotice(t, DSN_RET_HDRS, DSN_ACTION_FAILED)
+	assert.Contains(t, notice, "text/rfc822-headers")
+	assert.Contains(t, notice, "Subject: test")
+	assert.NotContains(t, notice, "secret body")
+
+	// the content is only returned for failures
+	notice = makeTestNotice(t, DSN_RET_FULL, DSN_ACTION_RELAYED)
+	assert.NotContains(t, notice, "secret body")
+}
+
+func TestDSNParams(t *testing.T) {
+	withBufferLocation(t)
+
+	dsn := make(chan DSN, 1)
+	addr := startTestServer(t, &Server{
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			dsn <- s.dsn
+			return nil
+		},
+	})
+	c := dialTestServer(t, addr)
+
+	assert.Contains(t, cmd(t, c, 250, "EHLO client.local"), "DSN")
+	cmd(t, c, 501, "MAIL FROM:<a@b.ee> RET=SOME")
+	cmd(t, c, 501, "MAIL FROM:<a@b.ee> ENVID=a+zz")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee> RET=HDRS ENVID=abc+2B1")
+	cmd(t, c, 501, "RCPT TO:<c@test.local> NOTIFY=NEVER,SUCCESS")
+	cmd(t, c, 501, "RCPT TO:<c@test.local> ORCPT=rfc822")
+	cmd(t, c, 250, "RCPT TO:<c@test.local> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;d@test.local")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\nHello\r\n")
+
+	v := <-dsn
+	assert.Equal(t, DSN_RET_HDRS, v.Ret)
+	assert.Equal(t, "abc+2B1", v.EnvID)
+	assert.Equal(t, DSNRcpt{
+		Notify: []string{DSN_NOTIFY_SUCCESS, DSN_NOTIFY_FAILURE},
+		ORcpt:  "rfc822;d@test.local",
+	}, v.Rcpt("c@test.local"))
+}
+
+func TestSendSMTPDSN(t *testing.T) {
+	withBufferLocation(t)
+
+	dsn := make(chan DSN, 1)
+	addr := startTestServer(t, &Server{
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			dsn <- s.dsn
+			return nil
+		},
+	})
+
+	envelope := EmailEnvelope{
+		From: "a@b.ee",
+		To:   []string{"c@test.local"},
+		DSN: DSN{Ret: DSN_RET_HDRS, EnvID: "abc", Rcpts: map[string]DSNRcpt{
+			"c@test.local": {Notify: []string{DSN_NOTIFY_NEVER}, ORcpt: "rfc822;d@test.local"},
+		}},
+	}
+	ok, err := sendSMTP(addr, envelope, strings.NewReader("Subject: test\r\n\r\nHello\r\n"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	v := <-dsn
+	assert.Equal(t, envelope.DSN.Ret, v.Ret)
+	assert.Equal(t, envelope.DSN.EnvID, v.EnvID)
+	assert.Equal(t, envelope.DSN.Rcpts["c@test.local"], v.Rcpt("c@test.local"))
+}
@@ -1,17 +1,17 @@
 module github.com/mailway-app/forwarding
 
-go 1.13
+go 1.14
 
 require (
 	github.com/google/uuid v1.1.5
 	github.com/hashicorp/go-retryablehttp v0.6.8
-	github.com/magefile/mage v1.11.0 // indirect
 	github.com/mailway-app/config v0.0.0-20210513211133-2f31c01469d5
-	github.com/mailway-app/golib v0.0.0-20210228114125-ebf3924e7637
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.2.2
 	github.com/tidwall/match v1.0.3
-	golang.org/x/sys v0.0.0-20210511113859-b0526f3d8744 // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	golang.org/x/text v0.3.6
 	gopkg.in/yaml.v2 v2.4.0
 )
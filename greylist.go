@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Greylisting temporarily rejects the first delivery attempt of an unknown
+// (client network, sender, recipient) triplet. Mail servers retry later,
+// most spam software doesn't.
+type Greylisting struct {
+	Enabled  bool
+	Delay    time.Duration  // before a retry is accepted
+	Expiry   time.Duration  // triplets not seen since are forgotten
+	Networks []*net.IPNet   // never greylisted
+	Store    *greylistStore // kept across reloads
+}
+
+const (
+	METRIC_GREYLISTED = "greylisted"
+
+	GREYLIST_SAVE_INTERVAL = 10 * time.Second
+)
+
+var (
+	GREYLISTING_DELAY  = 5 * time.Minute
+	GREYLISTING_EXPIRY = 35 * 24 * time.Hour
+
+	// declare as var to be able to replace it in testing
+	GREYLIST_FILE = "/var/lib/mailway/greylist.json"
+)
+
+type greylistEntry struct {
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+	Passed bool      `json:"passed"`
+}
+
+// Triplets persisted in a JSON file, loaded on first use. The file is written
+// at most every GREYLIST_SAVE_INTERVAL when a triplet was added or passed,
+// and on close. The last seen time of the others is saved along.
+type greylistStore struct {
+	sync.Mutex
+	file     string
+	triplets map[string]*greylistEntry
+	expiry   time.Duration // of the last check
+	changed  bool          // since the last write
+
+	saveLock sync.Mutex
+	saved    time.Time
+}
+
+// Client network, IPv4 /24 or IPv6 /64, sender and recipient
+func greylistKey(remoteIP string, from string, to string) string {
+	network := remoteIP
+	if ip := net.ParseIP(remoteIP); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			network = ip4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			network = ip.Mask(net.CIDRMask(64, 128)).String()
+		}
+	}
+	return network + " " + strings.ToLower(from) + " " + strings.ToLower(to)
+}
+
+// Record an attempt, returns true if the triplet is allowed
+func (g *greylistStore) check(key string, now time.Time, delay time.Duration, expiry time.Duration) (bool, error) {
+	allowed, changed, err := g.record(key, now, delay, expiry)
+	if err != nil || !changed {
+		return allowed, err
+	}
+	g.saveLock.Lock()
+	defer g.saveLock.Unlock()
+	if time.Since(g.saved) < GREYLIST_SAVE_INTERVAL {
+		return allowed, nil
+	}
+	return allowed, g.save()
+}
+
+func (g *greylistStore) record(key string, now time.Time, delay time.Duration, expiry time.Duration) (bool, bool, error) {
+	g.Lock()
+	defer g.Unlock()
+	if g.triplets == nil {
+		if err := g.load(); err != nil {
+			return false, false, err
+		}
+	}
+	g.expiry = expiry
+
+	entry, ok := g.triplets[key]
+	if !ok || now.Sub(entry.Last) > expiry {
+		g.triplets[key] = &greylistEntry{First: now, Last: now}
+		g.changed = true
+		return false, true, nil
+	}
+	entry.Last = now
+	if entry.Passed {
+		return true, false, nil
+	}
+	if now.Sub(entry.First) < delay {
+		return false, false, nil
+	}
+	entry.Passed = true
+	g.changed = true
+	return true, true, nil
+}
+
+func (g *greylistStore) load() error {
+	triplets := make(map[string]*greylistEntry)
+	content, err := ioutil.ReadFile(g.file)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read greylist")
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &triplets); err != nil {
+			return errors.Wrap(err, "failed to parse greylist")
+		}
+	}
+	g.triplets = triplets
+	g.saved = time.Now()
+	return nil
+}
+
+func (g *greylistStore) Close() error {
+	g.saveLock.Lock()
+	defer g.saveLock.Unlock()
+	return g.save()
+}
+
+// Write the unexpired triplets if they changed, replacing the file
+// atomically
+func (g *greylistStore) save() error {
+	g.saved = time.Now()
+	g.Lock()
+	if !g.changed {
+		g.Unlock()
+		return nil
+	}
+	for key, entry := range g.triplets {
+		if g.saved.Sub(entry.Last) > g.expiry {
+			delete(g.triplets, key)
+		}
+	}
+	content, err := json.Marshal(g.triplets)
+	g.changed = false
+	g.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "could not encode greylist")
+	}
+
+	if err := g.write(content); err != nil {
+		// written again on the next save
+		g.Lock()
+		g.changed = true
+		g.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (g *greylistStore) write(content []byte) error {
+	if err := os.MkdirAll(path.Dir(g.file), 0755); err != nil {
+		return errors.Wrap(err, "could not create greylist directory")
+	}
+	tmp := g.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return errors.Wrap(err, "could not write greylist")
+	}
+	return errors.Wrap(os.Rename(tmp, g.file), "could not write greylist")
+}
+
+// The store is kept across reloads as long as its file doesn't change
+var greylists struct {
+	sync.Mutex
+	store *greylistStore
+}
+
+func openGreylist(settings *Settings) *greylistStore {
+	file := GREYLIST_FILE
+	if v := settings.GreylistingFile; v != "" {
+		file = v
+	}
+
+	greylists.Lock()
+	defer greylists.Unlock()
+	if greylists.store != nil && greylists.store.file == file {
+		return greylists.store
+	}
+	if greylists.store != nil {
+		if err := greylists.store.Close(); err != nil {
+			log.Errorf("could not save the greylist: %s", err)
+		}
+	}
+	greylists.store = &greylistStore{file: file}
+	return greylists.store
+}
+
+// Authenticated clients, allow-listed or trusted networks and domains that
+// opted out aren't greylisted. Errors of the store let the mail through.
+func checkGreylist(s *session, from string, to string, domain *Domain) error {
+	settings := s.snapshot.Greylisting
+	if !settings.Enabled || s.authenticated || domain.NoGreylisting {
+		return nil
+	}
+	ip := net.ParseIP(s.remoteIP)
+	if isTrustedIP(ip, settings.Networks) || isTrustedIP(ip, s.snapshot.TrustedNetworks) {
+		return nil
+	}
+
+	ok, err := settings.Store.check(greylistKey(s.remoteIP, from, to), time.Now(), settings.Delay, settings.Expiry)
+	if err != nil {
+		log.Errorf("greylisting: %s", err)
+		return nil
+	}
+	if !ok {
+		log.Infof("greylisted %s from %s to %s", s.remoteIP, from, to)
+		metrics.Add(METRIC_GREYLISTED, 1)
+		return greylistError
+	}
+	return nil
+}
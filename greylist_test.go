@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withGreylist(t *testing.T) *greylistStore {
+	dir, err := ioutil.TempDir("", "greylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &greylistStore{file: path.Join(dir, "greylist.json")}
+}
+
+func TestGreylistKey(t *testing.T) {
+	assert.Equal(t, "192.0.2.0 a@b.ee c@test.local", greylistKey("192.0.2.10", "A@b.ee", "c@test.local"))
+	assert.Equal(t, greylistKey("192.0.2.10", "a@b.ee", "c@test.local"), greylistKey("192.0.2.200", "a@b.ee", "c@test.local"))
+	assert.Equal(t, "2001:db8:0:1:: a@b.ee c@test.local", greylistKey("2001:db8:0:1::25", "a@b.ee", "c@test.local"))
+}
+
+func TestGreylistStore(t *testing.T) {
+	store := withGreylist(t)
+	now := time.Now()
+	delay, expiry := 5*time.Minute, time.Hour
+
+	ok, err := store.check("key", now, delay, expiry)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = store.check("key", now.Add(time.Minute), delay, expiry)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = store.check("key", now.Add(6*time.Minute), delay, expiry)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// written in batches and on close
+	_, err = os.Stat(store.file)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, store.Close())
+
+	// persisted
+	store = &greylistStore{file: store.file}
+	ok, err = store.check("key", now.Add(7*time.Minute), delay, expiry)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// expired
+	ok, err = store.check("key", now.Add(2*time.Hour), delay, expiry)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	ioutil.WriteFile(store.file, []byte("broken"), 0600)
+	store = &greylistStore{file: store.file}
+	_, err = store.check("key", now, delay, expiry)
+	assert.NotNil(t, err)
+}
+
+func TestGreylisting(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("192.0.2.0/24")
+
+	snapshot := &Snapshot{Greylisting: Greylisting{
+		Enabled:  true,
+		Delay:    time.Hour,
+		Expiry:   time.Hour,
+		Networks: []*net.IPNet{allowed},
+		Store:    withGreylist(t),
+	}}
+	optOut := &Domain{Name: "optout.local", Status: DOMAIN_ACTIVE, NoGreylisting: true}
+	assert.Nil(t, checkGreylist(&session{snapshot: snapshot, remoteIP: "192.0.2.1"}, "a@b.ee", "c@test.local", &Domain{}))
+	assert.Nil(t, checkGreylist(&session{snapshot: snapshot, remoteIP: "198.51.100.1", authenticated: true}, "a@b.ee", "c@test.local", &Domain{}))
+	assert.Nil(t, checkGreylist(&session{snapshot: snapshot, remoteIP: "198.51.100.1"}, "a@b.ee", "c@optout.local", optOut))
+
+	addr := startTestServer(t, &Server{
+		Snapshot: func() *Snapshot { return snapshot },
+		HandlerRcpt: func(s *session, from string, to string) error {
+			if err := checkGreylist(s, from, to, &Domain{Name: "test.local"}); err != nil {
+				return err
+			}
+			return testRcptHandler(s, from, to)
+		},
+	})
+	greylisted := metricValue(METRIC_GREYLISTED)
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assert.Nil(t, c.Mail("a@b.ee"))
+	err = c.Rcpt("c@test.local")
+	if assert.IsType(t, &textproto.Error{}, err) {
+		assert.Equal(t, 451, err.(*textproto.Error).Code)
+		assert.Equal(t, "4.7.1 Greylisted, please try again later", err.(*textproto.Error).Msg)
+	}
+	assert.Equal(t, greylisted+1, metricValue(METRIC_GREYLISTED))
+}
+
+func TestOpenGreylist(t *testing.T) {
+	t.Cleanup(func() { greylists.store = nil })
+	dir := path.Dir(withGreylist(t).file)
+
+	store := openGreylist(&Settings{})
+	assert.Equal(t, GREYLIST_FILE, store.file)
+	assert.True(t, store == openGreylist(&Settings{}))
+
+	// saved when the file changes
+	settings := &Settings{GreylistingFile: path.Join(dir, "a.json")}
+	store = openGreylist(settings)
+	_, err := store.check("key", time.Now(), time.Minute, time.Hour)
+	assert.Nil(t, err)
+	other := openGreylist(&Settings{GreylistingFile: path.Join(dir, "b.json")})
+	assert.Equal(t, path.Join(dir, "b.json"), other.file)
+	_, err = os.Stat(path.Join(dir, "a.json"))
+	assert.Nil(t, err)
+}
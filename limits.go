@@ -0,0 +1,105 @@
+package main
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits of the server, zero means unlimited
+type Limits struct {
+	MaxConnections      int           // Concurrent connections
+	MaxConnectionsPerIP int           // Concurrent connections of a client IP address
+	MaxCommands         int           // Commands per session
+	MaxMessages         int           // Messages per session
+	TarpitAfter         int           // Invalid commands before the responses are delayed
+	TarpitDelay         time.Duration // Delay of the responses to invalid commands
+}
+
+// Exposed with expvar under "smtpd"
+var metrics = expvar.NewMap("smtpd")
+
+const (
+	METRIC_CONNECTIONS                 = "connections"
+	METRIC_CONNECTIONS_ACTIVE          = "connections_active"
+	METRIC_REJECTED_MAX_CONNECTIONS    = "rejected_max_connections"
+	METRIC_REJECTED_MAX_CONNECTIONS_IP = "rejected_max_connections_per_ip"
+	METRIC_REJECTED_MAX_COMMANDS       = "rejected_max_commands"
+	METRIC_REJECTED_MAX_MESSAGES       = "rejected_max_messages"
+	METRIC_TARPITTED                   = "tarpitted"
+)
+
+func metricValue(name string) int64 {
+	if v, ok := metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Connections currently open, in total and by client IP address
+type connTracker struct {
+	sync.Mutex
+	total int
+	byIP  map[string]int
+}
+
+// Register a new connection, before its client is known
+func (c *connTracker) open(limits Limits) bool {
+	c.Lock()
+	defer c.Unlock()
+	if limits.MaxConnections > 0 && c.total >= limits.MaxConnections {
+		metrics.Add(METRIC_REJECTED_MAX_CONNECTIONS, 1)
+		return false
+	}
+	c.total++
+	metrics.Add(METRIC_CONNECTIONS, 1)
+	metrics.Add(METRIC_CONNECTIONS_ACTIVE, 1)
+	return true
+}
+
+func (c *connTracker) close() {
+	c.Lock()
+	defer c.Unlock()
+	c.total--
+	metrics.Add(METRIC_CONNECTIONS_ACTIVE, -1)
+}
+
+// Register the client IP address of a connection, the caller must call
+// closeIP once done if it's accepted.
+func (c *connTracker) openIP(ip string, limits Limits) bool {
+	c.Lock()
+	defer c.Unlock()
+	if limits.MaxConnectionsPerIP > 0 && c.byIP[ip] >= limits.MaxConnectionsPerIP {
+		metrics.Add(METRIC_REJECTED_MAX_CONNECTIONS_IP, 1)
+		return false
+	}
+	if c.byIP == nil {
+		c.byIP = make(map[string]int)
+	}
+	c.byIP[ip]++
+	return true
+}
+
+func (c *connTracker) closeIP(ip string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.byIP[ip] <= 1 {
+		delete(c.byIP, ip)
+	} else {
+		c.byIP[ip]--
+	}
+}
+
+// Syntax errors and bad sequences of commands count as invalid commands,
+// rejected recipients or messages don't.
+func isInvalidCommandReply(line string) bool {
+	if len(line) < 3 {
+		return false
+	}
+	code, err := strconv.Atoi(line[:3])
+	if err != nil {
+		return false
+	}
+	return (code >= 500 && code <= 504) || code == 555
+}
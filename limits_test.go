@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxConnections(t *testing.T) {
+	rejected := metricValue(METRIC_REJECTED_MAX_CONNECTIONS)
+	addr := startTestServer(t, &Server{Limits: Limits{MaxConnections: 1}})
+
+	c := dialTestServer(t, addr)
+	var greeting string
+	dialTestServer(t, addr, withGreeting(421, &greeting))
+	assert.Contains(t, greeting, "Too many connections")
+	assert.Equal(t, rejected+1, metricValue(METRIC_REJECTED_MAX_CONNECTIONS))
+
+	// the slot is released once the first connection is closed
+	cmd(t, c, 221, "QUIT")
+	c.Close()
+	time.Sleep(50 * time.Millisecond)
+	dialTestServer(t, addr)
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	rejected := metricValue(METRIC_REJECTED_MAX_CONNECTIONS_IP)
+	addr := startTestServer(t, &Server{Limits: Limits{MaxConnectionsPerIP: 2}})
+
+	dialTestServer(t, addr)
+	dialTestServer(t, addr)
+	var greeting string
+	dialTestServer(t, addr, withGreeting(421, &greeting))
+	assert.Contains(t, greeting, "Too many connections from your address")
+	assert.Equal(t, rejected+1, metricValue(METRIC_REJECTED_MAX_CONNECTIONS_IP))
+}
+
+func TestMaxCommands(t *testing.T) {
+	addr := startTestServer(t, &Server{Limits: Limits{MaxCommands: 2}})
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "NOOP")
+	cmd(t, c, 250, "NOOP")
+	cmd(t, c, 421, "NOOP")
+	_, err := c.ReadLine()
+	assert.NotNil(t, err)
+}
+
+func TestMaxMessages(t *testing.T) {
+	withBufferLocation(t)
+	rejected := metricValue(METRIC_REJECTED_MAX_MESSAGES)
+	addr := startTestServer(t, &Server{
+		Limits:      Limits{MaxMessages: 1},
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			return nil
+		},
+	})
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\nHello\r\n")
+	_, _, err := c.ReadResponse(250)
+	assert.Nil(t, err)
+
+	cmd(t, c, 452, "MAIL FROM:<a@b.ee>")
+	assert.Equal(t, rejected+1, metricValue(METRIC_REJECTED_MAX_MESSAGES))
+}
+
+func TestTarpit(t *testing.T) {
+	tarpitted := metricValue(METRIC_TARPITTED)
+	addr := startTestServer(t, &Server{Limits: Limits{TarpitAfter: 2, TarpitDelay: 100 * time.Millisecond}})
+	c := dialTestServer(t, addr)
+
+	start := time.Now()
+	cmd(t, c, 500, "FOO")
+	cmd(t, c, 501, "MAIL")
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+
+	start = time.Now()
+	cmd(t, c, 500, "FOO")
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	// valid commands aren't delayed
+	start = time.Now()
+	cmd(t, c, 250, "NOOP")
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	assert.Equal(t, tarpitted+1, metricValue(METRIC_TARPITTED))
+}
+
+func TestIsInvalidCommandReply(t *testing.T) {
+	assert.True(t, isInvalidCommandReply("500 5.5.2 Syntax error, command unrecognized"))
+	assert.True(t, isInvalidCommandReply("503 5.5.1 Bad sequence of commands"))
+	assert.False(t, isInvalidCommandReply("550 5.1.0 Requested action not taken: mailbox unavailable"))
+	assert.False(t, isInvalidCommandReply("250 2.0.0 Ok"))
+	assert.False(t, isInvalidCommandReply(""))
+}
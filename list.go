@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	LIST_REQUEST_SUFFIX = "-request"
+	LIST_BOUNCE_TAG     = "bounces"
+
+	LIST_COMMAND_SUBSCRIBE   = "subscribe"
+	LIST_COMMAND_UNSUBSCRIBE = "unsubscribe"
+	LIST_COMMAND_CONFIRM     = "confirm"
+)
+
+var (
+	// declare as var to be able to replace it in testing
+	LIST_LOCATION = path.Join(config.ROOT_LOCATION, "list.d")
+
+	// Number of copies sent to mailout per second by all the list expansions
+	LIST_SEND_RATE = 10
+
+	// A subscription request not confirmed in time is forgotten
+	LIST_CONFIRM_EXPIRY = 48 * time.Hour
+
+	// Requests waiting for the confirmation of an address, the next ones
+	// are ignored and don't send a confirmation
+	LIST_PENDING_LIMIT = 3
+
+	// Failure notices after which a member is removed
+	LIST_BOUNCE_LIMIT = 3
+
+	// declare as var to be able to replace it in testing
+	sendListMessage = sendMailoutData
+
+	listStoreMutex sync.Mutex
+	listSendPacer  = &sendPacer{}
+
+	errTooManyPending = errors.New("too many requests waiting for confirmation")
+)
+
+// Spaces the copies sent by the concurrent list expansions
+type sendPacer struct {
+	sync.Mutex
+	next time.Time
+}
+
+// Wait for the next slot at rate per second
+func (p *sendPacer) wait(rate int) {
+	p.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	at := p.next
+	p.next = p.next.Add(time.Second / time.Duration(rate))
+	p.Unlock()
+	time.Sleep(at.Sub(now))
+}
+
+type ListMembers struct {
+	Members []string `yaml:"members"`
+	// requests waiting for the confirmation of the address
+	Pending []ListPending `yaml:"pending,omitempty"`
+	// failure notices received for the members
+	Bounces map[string]int `yaml:"bounces,omitempty"`
+}
+
+type ListPending struct {
+	Token   string `yaml:"token"`
+	Command string `yaml:"command"`
+	Address string `yaml:"address"`
+	Expires int64  `yaml:"expires"` // Unix time
+}
+
+func getListFile(list string) string {
+	return path.Join(LIST_LOCATION, strings.ToLower(list)+".yaml")
+}
+
+func getListMembers(list string) (ListMembers, error) {
+	members := ListMembers{}
+
+	content, err := ioutil.ReadFile(getListFile(list))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return members, nil
+		}
+		return members, errors.Wrap(err, "could not read list members")
+	}
+
+	if err := yaml.Unmarshal(content, &members); err != nil {
+		return members, errors.Wrap(err, "failed to parse")
+	}
+	return members, nil
+}
+
+func writeListMembers(list string, members ListMembers) error {
+	content, err := yaml.Marshal(&members)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal list members")
+	}
+
+	if err := os.MkdirAll(LIST_LOCATION, 0755); err != nil {
+		return errors.Wrap(err, "could not create list location")
+	}
+	if err := ioutil.WriteFile(getListFile(list), content, 0644); err != nil {
+		return errors.Wrap(err, "could not write list members")
+	}
+	return nil
+}
+
+func (m *ListMembers) add(addr string) {
+	addr = strings.ToLower(addr)
+	for _, member := range m.Members {
+		if member == addr {
+			return
+		}
+	}
+	m.Members = append(m.Members, addr)
+}
+
+func (m *ListMembers) remove(addr string) {
+	addr = strings.ToLower(addr)
+	out := []string{}
+	for _, member := range m.Members {
+		if member != addr {
+			out = append(out, member)
+		}
+	}
+	m.Members = out
+	delete(m.Bounces, addr)
+}
+
+func subscribeList(list string, addr string) error {
+	listStoreMutex.Lock()
+	defer listStoreMutex.Unlock()
+
+	members, err := getListMembers(list)
+	if err != nil {
+		return err
+	}
+	members.add(addr)
+	return writeListMembers(list, members)
+}
+
+func unsubscribeList(list string, addr string) error {
+	listStoreMutex.Lock()
+	defer listStoreMutex.Unlock()
+
+	members, err := getListMembers(list)
+	if err != nil {
+		return err
+	}
+	members.remove(addr)
+	return writeListMembers(list, members)
+}
+
+// Record a request and return the token confirming it, the expired requests
+// are removed
+func addListPending(list string, command string, addr string, now time.Time) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "could not generate token")
+	}
+	token := hex.EncodeToString(buf)
+
+	listStoreMutex.Lock()
+	defer listStoreMutex.Unlock()
+
+	members, err := getListMembers(list)
+	if err != nil {
+		return "", err
+	}
+	addr = strings.ToLower(addr)
+	pending := []ListPending{}
+	count := 0
+	for _, request := range members.Pending {
+		if request.Expires < now.Unix() {
+			continue
+		}
+		if request.Address == addr {
+			count++
+		}
+		pending = append(pending, request)
+	}
+	if count >= LIST_PENDING_LIMIT {
+		return "", errTooManyPending
+	}
+	members.Pending = append(pending, ListPending{
+		Token:   token,
+		Command: command,
+		Address: addr,
+		Expires: now.Add(LIST_CONFIRM_EXPIRY).Unix(),
+	})
+	return token, writeListMembers(list, members)
+}
+
+// Apply the request of a token, the expired requests are removed
+func confirmListPending(list string, token string, now time.Time) error {
+	listStoreMutex.Lock()
+	defer listStoreMutex.Unlock()
+
+	members, err := getListMembers(list)
+	if err != nil {
+		return err
+	}
+	var found *ListPending
+	pending := []ListPending{}
+	for i, request := range members.Pending {
+		switch {
+		case request.Expires < now.Unix():
+		case request.Token == token:
+			found = &members.Pending[i]
+		default:
+			pending = append(pending, request)
+		}
+	}
+	members.Pending = pending
+	if found == nil {
+		log.Warnf("list %s: unknown or expired confirmation token", list)
+		return writeListMembers(list, members)
+	}
+
+	switch found.Command {
+	case LIST_COMMAND_SUBSCRIBE:
+		log.Infof("list %s: subscribe %s", list, found.Address)
+		members.add(found.Address)
+	case LIST_COMMAND_UNSUBSCRIBE:
+		log.Infof("list %s: unsubscribe %s", list, found.Address)
+		members.remove(found.Address)
+	}
+	return writeListMembers(list, members)
+}
+
+// Ask the address to confirm the request by replying with the token
+func makeListConfirmation(list string, command string, addr string, token string) string {
+	request := makeListRequestAddress(list)
+	headers := []string{
+		fmt.Sprintf("From: <%s>", request),
+		fmt.Sprintf("To: <%s>", addr),
+		fmt.Sprintf("Subject: %s %s", LIST_COMMAND_CONFIRM, token),
+		fmt.Sprintf("Date: %s", time.Now().Format(time.RFC1123Z)),
+		"Auto-Submitted: auto-replied",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	body := []string{
+		fmt.Sprintf("We received a request to %s %s to the list %s.", command, addr, list),
+		"",
+		"To confirm it, reply to this message keeping its subject. If you",
+		fmt.Sprintf("didn't ask for it, ignore this message, the request expires in %s.", LIST_CONFIRM_EXPIRY),
+	}
+	return strings.Join(headers, CRLF) + CRLF + CRLF + strings.Join(body, CRLF) + CRLF
+}
+
+func requestListConfirmation(instance *config.Config, list string, command string, addr string) error {
+	token, err := addListPending(list, command, addr, time.Now())
+	if err == errTooManyPending {
+		log.Warnf("list %s: %s %s ignored: %s", list, command, addr, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("list %s: %s %s waiting for confirmation", list, command, addr)
+	// sent from the null sender, the confirmation is automatic
+	envelope := EmailEnvelope{}
+	data := strings.NewReader(makeListConfirmation(list, command, addr, token))
+	return errors.Wrap(sendListMessage(instance, envelope, addr, data), "could not send confirmation")
+}
+
+func splitAddress(addr string) (string, string) {
+	if i := strings.LastIndex(addr, "@"); i != -1 {
+		return addr[:i], addr[i+1:]
+	}
+	return addr, ""
+}
+
+// Envelope sender encoding the member address (VERP), ie:
+// list+bounces-alice=example.org@domain
+func makeListBounceAddress(list string, member string) string {
+	listLocal, listDomain := splitAddress(list)
+	memberLocal, memberDomain := splitAddress(member)
+	return fmt.Sprintf("%s+%s-%s=%s@%s",
+		listLocal, LIST_BOUNCE_TAG, memberLocal, memberDomain, listDomain)
+}
+
+// List and member of a bounce address, empty if addr isn't one
+func parseListBounceAddress(addr string) (string, string) {
+	local, domain := splitAddress(addr)
+	i := strings.Index(local, "+"+LIST_BOUNCE_TAG+"-")
+	if i <= 0 || domain == "" {
+		return "", ""
+	}
+	member := local[i+len(LIST_BOUNCE_TAG)+2:]
+	j := strings.LastIndex(member, "=")
+	if j <= 0 || j == len(member)-1 {
+		return "", ""
+	}
+	return local[:i] + "@" + domain, member[:j] + "@" + member[j+1:]
+}
+
+func makeListRequestAddress(list string) string {
+	local, domain := splitAddress(list)
+	return local + LIST_REQUEST_SUFFIX + "@" + domain
+}
+
+func makeListHeaders(list string) string {
+	local, domain := splitAddress(list)
+	headers := []string{
+		fmt.Sprintf("List-Id: <%s.%s>", local, domain),
+		fmt.Sprintf("List-Unsubscribe: <mailto:%s?subject=%s>",
+			makeListRequestAddress(list), LIST_COMMAND_UNSUBSCRIBE),
+		fmt.Sprintf("List-Post: <mailto:%s>", list),
+	}
+	return strings.Join(headers, CRLF) + CRLF
+}
+
+// Commands are sent to the list request address (list-request@domain) with
+// the command in the subject.
+func isListRequest(list string, email Email) bool {
+	for _, to := range email.Envelope.To {
+		if strings.EqualFold(to, makeListRequestAddress(list)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Token of a confirmation, the reply keeps the subject, ie "Re: confirm
+// <token>"
+func parseListConfirmation(subject string) (string, bool) {
+	fields := strings.Fields(subject)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == LIST_COMMAND_CONFIRM {
+			return fields[i+1], true
+		}
+	}
+	return "", false
+}
+
+// The envelope sender can't be trusted, subscribing or unsubscribing needs
+// the confirmation of the address
+func handleListCommand(list string, email Email) error {
+	sender := email.Envelope.From
+	if sender == "" {
+		return errors.New("list command without sender")
+	}
+
+	command := strings.ToLower(strings.TrimSpace(email.Data.Header.Get("Subject")))
+	switch command {
+	case LIST_COMMAND_SUBSCRIBE, LIST_COMMAND_UNSUBSCRIBE:
+		return requestListConfirmation(email.instance(), list, command, sender)
+	}
+	if token, ok := parseListConfirmation(command); ok {
+		return confirmListPending(list, token, time.Now())
+	}
+	log.Warnf("list %s: unknown command %s", list, command)
+	return nil
+}
+
+// Count a failure notice of a member, who is removed once the limit is
+// reached
+func recordListBounce(list string, member string) error {
+	listStoreMutex.Lock()
+	defer listStoreMutex.Unlock()
+
+	members, err := getListMembers(list)
+	if err != nil {
+		return err
+	}
+	member = strings.ToLower(member)
+	if members.Bounces == nil {
+		members.Bounces = make(map[string]int)
+	}
+	members.Bounces[member]++
+	log.Infof("list %s: %s bounced %d time(s)", list, member, members.Bounces[member])
+	if members.Bounces[member] >= LIST_BOUNCE_LIMIT {
+		log.Infof("list %s: remove %s after %d bounces", list, member, members.Bounces[member])
+		members.remove(member)
+	}
+	return writeListMembers(list, members)
+}
+
+// A delivery status notification (RFC 3464) sent from the null sender and
+// reporting a failure. Auto-replies and delay notices don't count.
+func isFailureNotice(from string, data io.Reader) bool {
+	if from != "" {
+		return false
+	}
+	msg, err := mail.ReadMessage(data)
+	if err != nil {
+		return false
+	}
+	mediatype, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediatype != "multipart/report" || !strings.EqualFold(params["report-type"], "delivery-status") {
+		return false
+	}
+	scanner := bufio.NewScanner(msg.Body)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), "Action") &&
+			strings.EqualFold(strings.TrimSpace(parts[1]), DSN_ACTION_FAILED) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle the mail to the bounce addresses of the lists, returns false if one
+// of the recipients isn't one. The other mail to them is discarded.
+func handleListBounces(from string, rcpts []string, data *io.SectionReader) (bool, error) {
+	type bounce struct{ list, member string }
+	bounces := make([]bounce, len(rcpts))
+	for i, rcpt := range rcpts {
+		list, member := parseListBounceAddress(rcpt)
+		if list == "" {
+			return false, nil
+		}
+		if _, err := os.Stat(getListFile(list)); err != nil {
+			return false, nil
+		}
+		bounces[i] = bounce{list, member}
+	}
+
+	if !isFailureNotice(from, io.NewSectionReader(data, 0, data.Size())) {
+		log.Infof("discard mail to list bounce address %s", strings.Join(rcpts, ", "))
+		return true, nil
+	}
+	for _, b := range bounces {
+		if err := recordListBounce(b.list, b.member); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+func expandList(list string, email Email, actions *dedupActions) error {
+	members, err := getListMembers(list)
+	if err != nil {
+		return errors.Wrap(err, "could not get list members")
+	}
+	log.Infof("list %s: expand to %d member(s)", list, len(members.Members))
+
+	headers := makeListHeaders(list)
+
+	// a member reached by a previous attempt of the message is skipped
+	var failed []string
+	var last error
+	for _, member := range members.Members {
+		target := "list " + list + " " + member
+		if actions.done(target) {
+			continue
+		}
+		listSendPacer.wait(LIST_SEND_RATE)
+
+		envelope := email.Envelope
+		envelope.From = makeListBounceAddress(list, member)
+		data := io.MultiReader(strings.NewReader(headers), email.Reader())
+		if err := sendListMessage(email.instance(), envelope, member, data); err != nil {
+			log.Errorf("list %s: error sending to %s: %s", list, member, err)
+			failed = append(failed, member)
+			last = err
+			continue
+		}
+		actions.record(target)
+	}
+	if len(failed) > 0 {
+		return errors.Wrapf(last, "could not send to %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
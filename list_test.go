@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mailway-app/config"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func withListLocation(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := LIST_LOCATION
+	LIST_LOCATION = dir
+	return func() {
+		LIST_LOCATION = prev
+		os.RemoveAll(dir)
+	}
+}
+
+func TestListSubscribeUnsubscribe(t *testing.T) {
+	defer withListLocation(t)()
+
+	members, err := getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Empty(t, members.Members)
+
+	assert.Nil(t, subscribeList("team@test.com", "A@b.ee"))
+	assert.Nil(t, subscribeList("team@test.com", "a@b.ee"))
+	assert.Nil(t, subscribeList("team@test.com", "c@d.ee"))
+
+	members, err = getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Equal(t, members.Members, []string{"a@b.ee", "c@d.ee"})
+
+	assert.Nil(t, unsubscribeList("team@test.com", "a@b.ee"))
+	members, err = getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Equal(t, members.Members, []string{"c@d.ee"})
+}
+
+func withListMessages(t *testing.T) chan string {
+	sent := make(chan string, 10)
+	prev := sendListMessage
+	sendListMessage = func(instance *config.Config, envelope EmailEnvelope, to string, data io.Reader) error {
+		content, err := ioutil.ReadAll(data)
+		assert.Nil(t, err)
+		sent <- to + "\n" + string(content)
+		return nil
+	}
+	t.Cleanup(func() { sendListMessage = prev })
+	return sent
+}
+
+func confirmationToken(t *testing.T, message string) string {
+	msg, err := mail.ReadMessage(strings.NewReader(message[strings.Index(message, "\n")+1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, ok := parseListConfirmation(msg.Header.Get("Subject"))
+	assert.True(t, ok)
+	return token
+}
+
+func TestListCommand(t *testing.T) {
+	defer withListLocation(t)()
+	sent := withListMessages(t)
+
+	email := makeEmailWithEnvelope(`From: sven@b.ee
+To: team-request@test.com
+Subject: Subscribe
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+	`, "team-request@test.com", "sven@b.ee")
+
+	assert.True(t, isListRequest("team@test.com", email))
+	assert.Nil(t, handleListCommand("team@test.com", email))
+
+	// not subscribed until confirmed
+	members, err := getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Empty(t, members.Members)
+	message := <-sent
+	assert.True(t, strings.HasPrefix(message, "sven@b.ee\n"))
+	token := confirmationToken(t, message)
+
+	// a wrong token doesn't confirm
+	email = makeEmailWithEnvelope(`From: mallory@b.ee
+To: team-request@test.com
+Subject: Re: confirm 0123456789abcdef
+
+	`, "team-request@test.com", "mallory@b.ee")
+	assert.Nil(t, handleListCommand("team@test.com", email))
+	members, err = getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Empty(t, members.Members)
+
+	email = makeEmailWithEnvelope(`From: sven@b.ee
+To: team-request@test.com
+Subject: Re: confirm `+token+`
+
+	`, "team-request@test.com", "sven@b.ee")
+	assert.Nil(t, handleListCommand("team@test.com", email))
+	members, err = getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Equal(t, members.Members, []string{"sven@b.ee"})
+	assert.Empty(t, members.Pending)
+
+	// a token is used once
+	assert.Nil(t, handleListCommand("team@test.com", email))
+
+	email = makeEmailWithEnvelope(`From: sven@b.ee
+To: team@test.com
+Subject: unsubscribe
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+	`, "team@test.com", "sven@b.ee")
+	assert.False(t, isListRequest("team@test.com", email))
+}
+
+func TestListPendingExpiry(t *testing.T) {
+	defer withListLocation(t)()
+	now := time.Now()
+
+	assert.Nil(t, subscribeList("team@test.com", "sven@b.ee"))
+	token, err := addListPending("team@test.com", LIST_COMMAND_UNSUBSCRIBE, "sven@b.ee", now)
+	assert.Nil(t, err)
+	assert.Nil(t, confirmListPending("team@test.com", token, now.Add(LIST_CONFIRM_EXPIRY+time.Minute)))
+
+	members, err := getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Equal(t, members.Members, []string{"sven@b.ee"})
+	assert.Empty(t, members.Pending)
+
+	token, err = addListPending("team@test.com", LIST_COMMAND_UNSUBSCRIBE, "sven@b.ee", now)
+	assert.Nil(t, err)
+	assert.Nil(t, confirmListPending("team@test.com", token, now))
+	members, err = getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Empty(t, members.Members)
+}
+
+func TestListPendingLimit(t *testing.T) {
+	defer withListLocation(t)()
+	now := time.Now()
+
+	for i := 0; i < LIST_PENDING_LIMIT; i++ {
+		_, err := addListPending("team@test.com", LIST_COMMAND_SUBSCRIBE, "sven@b.ee", now)
+		assert.Nil(t, err)
+	}
+	_, err := addListPending("team@test.com", LIST_COMMAND_SUBSCRIBE, "SVEN@b.ee", now)
+	assert.Equal(t, errTooManyPending, err)
+	_, err = addListPending("team@test.com", LIST_COMMAND_SUBSCRIBE, "alice@b.ee", now)
+	assert.Nil(t, err)
+
+	// the expired requests are removed
+	_, err = addListPending("team@test.com", LIST_COMMAND_SUBSCRIBE, "sven@b.ee", now.Add(LIST_CONFIRM_EXPIRY+time.Minute))
+	assert.Nil(t, err)
+	members, err := getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Len(t, members.Pending, 1)
+}
+
+func TestListBounceAddress(t *testing.T) {
+	assert.Equal(t, makeListBounceAddress("team@test.com", "alice@example.org"),
+		"team+bounces-alice=example.org@test.com")
+
+	list, member := parseListBounceAddress("team+bounces-alice=example.org@test.com")
+	assert.Equal(t, "team@test.com", list)
+	assert.Equal(t, "alice@example.org", member)
+	for _, addr := range []string{"team@test.com", "team+tag@test.com", "team+bounces-alice@test.com", "team+bounces-alice=example.org"} {
+		list, _ = parseListBounceAddress(addr)
+		assert.Equal(t, "", list, addr)
+	}
+}
+
+const testFailureNotice = `From: Mail Delivery System <MAILER-DAEMON@example.org>
+To: <team+bounces-alice=example.org@test.com>
+Subject: Delivery Status Notification (failed)
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status; boundary="b"
+
+--b
+Content-Type: text/plain
+
+Delivery to alice@example.org: failed
+--b
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; example.org
+
+Final-Recipient: rfc822; alice@example.org
+Action: failed
+Status: 5.1.1
+--b--
+`
+
+func TestListBounces(t *testing.T) {
+	defer withListLocation(t)()
+	assert.Nil(t, subscribeList("team@test.com", "alice@example.org"))
+	assert.Nil(t, subscribeList("team@test.com", "bob@example.org"))
+	rcpts := []string{"team+bounces-alice=example.org@test.com"}
+	data := func(raw string) *io.SectionReader {
+		return io.NewSectionReader(strings.NewReader(raw), 0, int64(len(raw)))
+	}
+
+	// not a list
+	handled, err := handleListBounces("", []string{"other+bounces-alice=example.org@test.com"}, data(testFailureNotice))
+	assert.Nil(t, err)
+	assert.False(t, handled)
+
+	// an auto-reply doesn't count
+	handled, err = handleListBounces("", rcpts, data("Subject: Out of office\n\nBack soon\n"))
+	assert.Nil(t, err)
+	assert.True(t, handled)
+	assert.False(t, isFailureNotice("alice@example.org", data(testFailureNotice)))
+	assert.False(t, isFailureNotice("", data(strings.Replace(testFailureNotice, "Action: failed", "Action: delayed", 1))))
+
+	for i := 0; i < LIST_BOUNCE_LIMIT; i++ {
+		members, err := getListMembers("team@test.com")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"alice@example.org", "bob@example.org"}, members.Members)
+		handled, err = handleListBounces("", rcpts, data(testFailureNotice))
+		assert.Nil(t, err)
+		assert.True(t, handled)
+	}
+	members, err := getListMembers("team@test.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bob@example.org"}, members.Members)
+	assert.Empty(t, members.Bounces)
+}
+
+func TestListHeaders(t *testing.T) {
+	assert.Equal(t, makeListHeaders("team@test.com"),
+		"List-Id: <team.test.com>\r\n"+
+			"List-Unsubscribe: <mailto:team-request@test.com?subject=unsubscribe>\r\n"+
+			"List-Post: <mailto:team@test.com>\r\n")
+}
+
+func TestListSendPacer(t *testing.T) {
+	pacer := &sendPacer{}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				pacer.wait(100)
+			}
+		}()
+	}
+	wg.Wait()
+	// 6 copies at 100 per second, whatever the number of expansions
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+// A member the previous attempt reached doesn't get the message again
+func TestExpandListRetry(t *testing.T) {
+	defer withListLocation(t)()
+	prevRate := LIST_SEND_RATE
+	LIST_SEND_RATE = 1000
+	t.Cleanup(func() { LIST_SEND_RATE = prevRate })
+	for _, member := range []string{"a@b.ee", "c@d.ee"} {
+		assert.Nil(t, subscribeList("team@test.com", member))
+	}
+	sent := withListMessages(t)
+	unavailable := true
+	prev := sendListMessage
+	sendListMessage = func(instance *config.Config, envelope EmailEnvelope, to string, data io.Reader) error {
+		if to == "c@d.ee" && unavailable {
+			return errors.New("mailout unavailable")
+		}
+		return prev(instance, envelope, to, data)
+	}
+
+	body := "From: sven@b.ee\nTo: team@test.com\nMessage-ID: <1@b.ee>\nSubject: test\n\nHello\n"
+	email := makeEmailWithEnvelope(body, "team@test.com", "sven@b.ee")
+	group := rcptGroup{domain: "test.com", rcpts: []string{"team@test.com"}}
+	s := &session{id: uuid.New(), snapshot: &Snapshot{DedupTTL: time.Hour, Dedup: withDedup(t)}}
+	actions := newDedupActions(s, fingerprint(t, body), group)
+
+	err := expandList("team@test.com", email, actions)
+	assert.EqualError(t, err, "could not send to c@d.ee: mailout unavailable")
+	assert.True(t, strings.HasPrefix(<-sent, "a@b.ee\n"))
+
+	unavailable = false
+	assert.Nil(t, expandList("team@test.com", email, actions))
+	assert.True(t, strings.HasPrefix(<-sent, "c@d.ee\n"))
+	assert.Len(t, sent, 0)
+}
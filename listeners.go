@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type TLSMode string
+
+const (
+	TLS_STARTTLS TLSMode = "starttls"
+	TLS_IMPLICIT TLSMode = "implicit"
+	TLS_NONE     TLSMode = "none"
+)
+
+// Settings of an address the server listens on, all the listeners share the
+// handlers of the server
+type Listener struct {
+	Name          string
+	Network       string      // tcp, tcp4, tcp6 or unix
+	Addr          string      // host:port, or the path of the unix socket
+	Mode          os.FileMode // Permissions of the unix socket
+	TLS           TLSMode     // STARTTLS when empty. Ignored if TLS is not configured.
+	TLSRequired   bool        // See Server.TLSRequired
+	AuthRequired  bool        // See Server.AuthRequired
+	LMTP          bool        // See Server.LMTP
+	ClientAuth    bool        // Authenticate the clients presenting a certificate signed by the ClientCAs of the TLS configuration
+	Submission    bool        // Relay the mail of the authenticated users (RFC 6409), AuthRequired must be set
+	ProxyProtocol bool        // See Server.ProxyProtocol
+}
+
+func (l *Listener) String() string {
+	if l.Name != "" {
+		return l.Name + " " + l.Network + ":" + l.Addr
+	}
+	return l.Network + ":" + l.Addr
+}
+
+func (l *Listener) Validate() error {
+	switch l.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return errors.Errorf("listener %s: invalid network", l)
+	}
+	if l.Addr == "" {
+		return errors.Errorf("listener %s: address is required", l)
+	}
+	switch l.TLS {
+	case "", TLS_STARTTLS, TLS_IMPLICIT:
+	case TLS_NONE:
+		if l.TLSRequired {
+			return errors.Errorf("listener %s: TLS can't be required without TLS", l)
+		}
+	default:
+		return errors.Errorf("listener %s: invalid TLS mode %s", l, l.TLS)
+	}
+	if l.Submission && !l.AuthRequired {
+		return errors.Errorf("listener %s: submission requires authentication", l)
+	}
+	if l.ClientAuth && l.TLS == TLS_NONE {
+		return errors.Errorf("listener %s: client certificates need TLS", l)
+	}
+	if l.ProxyProtocol && l.Network == "unix" {
+		return errors.Errorf("listener %s: PROXY protocol isn't supported on unix sockets", l)
+	}
+	return nil
+}
+
+// The listener described by the fields of the server, used when Listeners
+// is empty
+func (srv *Server) defaultListener() Listener {
+	l := Listener{
+		Network:       "tcp",
+		Addr:          srv.Addr,
+		TLSRequired:   srv.TLSRequired,
+		AuthRequired:  srv.AuthRequired,
+		LMTP:          srv.LMTP,
+		ProxyProtocol: srv.ProxyProtocol,
+	}
+	if srv.TLSListener {
+		l.TLS = TLS_IMPLICIT
+	}
+	return l
+}
+
+func (srv *Server) listen(l *Listener, config *config.Config) (net.Listener, error) {
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+
+	if l.Network == "unix" {
+		// remove the socket left by a previous run
+		if info, err := os.Stat(l.Addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(l.Addr); err != nil {
+				return nil, errors.Wrapf(err, "listener %s: could not remove previous socket", l)
+			}
+		}
+	}
+
+	ln, err := net.Listen(l.Network, l.Addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listener %s", l)
+	}
+
+	if l.Network == "unix" && l.Mode != 0 {
+		if err := os.Chmod(l.Addr, l.Mode); err != nil {
+			ln.Close()
+			return nil, errors.Wrapf(err, "listener %s: could not change socket mode", l)
+		}
+	}
+
+	if l.Network == "unix" {
+		ln = &unixListener{Listener: ln}
+	}
+	// The PROXY protocol header comes before the TLS handshake
+	if l.ProxyProtocol {
+		ln = &ProxyListener{
+			Listener: ln,
+			Trusted:  func() []*net.IPNet { return srv.snapshot(config).TrustedNetworks },
+			Timeout:  PROXY_TIMEOUT,
+		}
+	}
+	// Listen for TLS connections only
+	if srv.TLSConfig != nil && l.TLS == TLS_IMPLICIT {
+		ln = tls.NewListener(ln, srv.tlsConfig(l))
+	}
+	return ln, nil
+}
+
+// The clients of a unix socket have no address, the remote address of their
+// connections is the user of the peer when the system tells it
+type unixListener struct {
+	net.Listener
+}
+
+func (ln *unixListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &unixConn{Conn: conn}
+	if uc, ok := conn.(*net.UnixConn); ok {
+		if c.peer, err = unixPeerUser(uc); err != nil {
+			log.Debugf("could not get the peer of a unix socket client: %s", err)
+		}
+	}
+	return c, nil
+}
+
+type unixConn struct {
+	net.Conn
+	peer string
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: c.peer, Net: "unix"}
+}
+
+// The identity of a unix socket client in place of its IP address, by the
+// user of the peer or else by the socket. It's never trusted as a loopback
+// address and has its own connection and rate limits.
+func (s *session) unixPeer() string {
+	if peer := s.conn.RemoteAddr().String(); peer != "" {
+		return "unix:" + peer
+	}
+	return "unix:" + s.listener.Addr
+}
+
+// The TLS configuration of a listener, the listeners with ClientAuth request
+// a client certificate
+func (srv *Server) tlsConfig(l *Listener) *tls.Config {
+	if !l.ClientAuth {
+		return srv.TLSConfig
+	}
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			config := srv.TLSConfig
+			if config.GetConfigForClient != nil {
+				c, err := config.GetConfigForClient(hello)
+				if err != nil {
+					return nil, err
+				}
+				if c != nil {
+					config = c
+				}
+			}
+			if config.ClientCAs == nil {
+				return nil, errors.New("no client CA configured")
+			}
+			config = config.Clone()
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+			return config, nil
+		},
+	}
+}
+
+// A verified client certificate authenticates the client
+func (s *session) authenticateClientCert() {
+	conn, ok := s.conn.(*tls.Conn)
+	if !ok || !s.listener.ClientAuth {
+		return
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+	identity := certIdentity(state.VerifiedChains[0][0])
+	if identity == "" {
+		log.Warnf("client certificate without identity from %s", s.remoteIP)
+		return
+	}
+	log.Infof("client %s authenticated as %s by certificate", s.remoteIP, identity)
+	s.authenticated = true
+	s.login = identity
+}
+
+// The identity of a client certificate: the first email address or DNS name
+// of the subject alternative names, or the common name of the subject
+func certIdentity(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
+
+// AUTH is only offered on the listeners requiring authentication, the
+// others relay nothing for an authenticated user
+func (s *session) authEnabled() bool {
+	return s.srv.AuthHandler != nil && s.listener.AuthRequired
+}
+
+// Authentication is required and the client isn't authenticated, by a
+// password or a client certificate
+func (s *session) authRequired() bool {
+	if !s.listener.AuthRequired || s.authenticated {
+		return false
+	}
+	return s.srv.AuthHandler != nil || s.listener.ClientAuth
+}
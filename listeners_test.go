@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func freeTCPAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestMultipleListeners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listeners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "smtp.sock")
+	// left by a previous run
+	if ln, err := net.Listen("unix", socket); err == nil {
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		ln.Close()
+	}
+
+	tcpAddr := freeTCPAddr(t)
+	var mu sync.Mutex
+	clients := make(map[string]bool)
+	srv := &Server{
+		HandlerConnect: func(s *session) error {
+			mu.Lock()
+			defer mu.Unlock()
+			clients[s.remoteIP] = s.xclient
+			return nil
+		},
+		TLSConfig: &tls.Config{},
+		Listeners: []Listener{
+			{Network: "tcp", Addr: tcpAddr},
+			{Network: "unix", Addr: socket, Mode: 0660, TLS: TLS_NONE},
+		},
+	}
+	startTestServer(t, srv)
+
+	info, err := os.Stat(socket)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+
+	c := dialTestServer(t, tcpAddr)
+	msg := cmd(t, c, 250, "EHLO client.local")
+	assert.Contains(t, msg, "STARTTLS")
+
+	c = dialTestServer(t, socket, withNetwork("unix"))
+	msg = cmd(t, c, 250, "EHLO client.local")
+	assert.NotContains(t, msg, "STARTTLS")
+	cmd(t, c, 502, "STARTTLS")
+	cmd(t, c, 250, "MAIL FROM:<a@a.com>")
+
+	// the unix socket clients aren't loopback clients
+	unixPeer := "unix:" + socket
+	if runtime.GOOS == "linux" {
+		unixPeer = fmt.Sprintf("unix:uid=%d", os.Getuid())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	xclient, ok := clients[unixPeer]
+	assert.True(t, ok, clients)
+	assert.False(t, xclient)
+	assert.Contains(t, clients, "127.0.0.1")
+}
+
+func TestListenerValidate(t *testing.T) {
+	valid := []Listener{
+		{Network: "tcp", Addr: "127.0.0.1:25"},
+		{Network: "tcp6", Addr: "[::1]:25", TLS: TLS_IMPLICIT},
+		{Network: "unix", Addr: "/run/fwdr.sock", TLS: TLS_NONE},
+	}
+	for _, l := range valid {
+		assert.Nil(t, l.Validate(), l.String())
+	}
+
+	invalid := []Listener{
+		{Network: "udp", Addr: "127.0.0.1:25"},
+		{Network: "tcp"},
+		{Network: "tcp", Addr: "127.0.0.1:25", TLS: "ssl"},
+		{Network: "tcp", Addr: "127.0.0.1:25", TLS: TLS_NONE, TLSRequired: true},
+		{Network: "unix", Addr: "/run/fwdr.sock", ProxyProtocol: true},
+	}
+	for _, l := range invalid {
+		assert.NotNil(t, l.Validate(), l.String())
+	}
+}
+
+func TestLoadListeners(t *testing.T) {
+	withConfig(t, `
+instance_mode: local
+forwarding_listeners:
+  - address: "[::1]:2525"
+    network: tcp6
+    proxy_protocol: true
+  - name: local
+    network: unix
+    address: /run/fwdr.sock
+    mode: "0660"
+    tls: none
+`)
+	snapshot, err := loadSnapshot()
+	assert.Nil(t, err)
+	listeners, err := snapshot.Settings.GetListeners("127.0.0.1:2525")
+	assert.Nil(t, err)
+	assert.Equal(t, []Listener{
+		{Network: "tcp6", Addr: "[::1]:2525", ProxyProtocol: true},
+		{Name: "local", Network: "unix", Addr: "/run/fwdr.sock", Mode: 0660, TLS: TLS_NONE},
+	}, listeners)
+
+	writeConfig(t, "instance_mode: local\nforwarding_proxy_protocol: true\n")
+	snapshot, err = loadSnapshot()
+	assert.Nil(t, err)
+	listeners, err = snapshot.Settings.GetListeners("127.0.0.1:2525")
+	assert.Nil(t, err)
+	assert.Equal(t, []Listener{{Network: "tcp", Addr: "127.0.0.1:2525", ProxyProtocol: true}}, listeners)
+
+	writeConfig(t, "instance_mode: local\nforwarding_listeners: [{network: unix, address: /run/fwdr.sock, mode: \"0999\"}]\n")
+	_, err = loadSnapshot()
+	assert.NotNil(t, err)
+}
@@ -4,12 +4,14 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/mailway-app/config"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
 	"gopkg.in/yaml.v2"
 )
 
@@ -24,21 +26,54 @@ func fileExists(filename string) bool {
 	return !info.IsDir()
 }
 
+// The config file can be named after the ASCII (punycode) or the Unicode form
+// of the domain, the ASCII form is used by default.
 func getDomainConfigFile(domain string) string {
-	return path.Join(config.ROOT_LOCATION, "domain.d", domain+".yaml")
+	ascii, err := normalizeDomain(domain)
+	if err != nil {
+		ascii = strings.ToLower(domain)
+	}
+	file := path.Join(config.ROOT_LOCATION, "domain.d", ascii+".yaml")
+	if fileExists(file) {
+		return file
+	}
+	if unicode, err := idna.Lookup.ToUnicode(ascii); err == nil && unicode != ascii {
+		if f := path.Join(config.ROOT_LOCATION, "domain.d", unicode+".yaml"); fileExists(f) {
+			return f
+		}
+	}
+	return file
 }
 
 func getLocalDomainConfig(instance *config.Config, domain string) (*Domain, error) {
-	status := DOMAIN_UNCOMPLETE
-	if fileExists(getDomainConfigFile(domain)) {
-		status = DOMAIN_ACTIVE
-	} else {
+	d := &Domain{
+		Name:   domain,
+		Status: DOMAIN_UNCOMPLETE,
+	}
+	file := getDomainConfigFile(domain)
+	if !fileExists(file) {
 		log.Warnf("No configuration for domain %s not found", domain)
+		return d, nil
 	}
-	return &Domain{
-		Name:   domain,
-		Status: status,
-	}, nil
+	d.Status = DOMAIN_ACTIVE
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read domain config")
+	}
+	var options struct {
+		NoGreylisting bool        `yaml:"no_greylisting"`
+		RateLimits    []RateLimit `yaml:"rate_limits"`
+	}
+	if err := yaml.Unmarshal(content, &options); err != nil {
+		return nil, errors.Wrap(err, "failed to parse")
+	}
+	if err := validateDomainRateLimits(options.RateLimits); err != nil {
+		return nil, err
+	}
+	d.NoGreylisting = options.NoGreylisting
+	d.RateLimits = options.RateLimits
+	return d, nil
 }
 
 func getLocalDomainRules(instance *config.Config, domain string) (DomainRules, error) {
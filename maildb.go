@@ -17,6 +17,12 @@ const (
 	MAILDB_BASE_URI = "http://127.0.0.1:8081/db"
 )
 
+// The maildb record of a recipient, created on RCPT
+type mailRecord struct {
+	id     uuid.UUID
+	domain *Domain
+}
+
 func mailDBNew(s *session, domain string, uuid uuid.UUID) error {
 	log.Debugf("mailDB: create new email %s", uuid)
 	url := fmt.Sprintf("%s/domain/%s/new/%s", MAILDB_BASE_URI, domain, uuid.String())
@@ -44,9 +50,9 @@ func mailDBNew(s *session, domain string, uuid uuid.UUID) error {
 	return nil
 }
 
-func mailDBUpdateMailStatus(s *session, status int) error {
-	log.Debugf("mailDB: update status %s %d", s.id, status)
-	url := fmt.Sprintf("%s/domain/%s/update/%s", MAILDB_BASE_URI, s.domain.Name, s.id.String())
+func mailDBUpdateMailStatus(s *session, mail mailRecord, status int) error {
+	log.Debugf("mailDB: update status %s %d", mail.id, status)
+	url := fmt.Sprintf("%s/domain/%s/update/%s", MAILDB_BASE_URI, mail.domain.Name, mail.id.String())
 	body := fmt.Sprintf("{\"status\":%d}", status)
 	req, err := retryablehttp.NewRequest(http.MethodPut, url, strings.NewReader(body))
 	if err != nil {
@@ -72,9 +78,9 @@ func mailDBUpdateMailStatus(s *session, status int) error {
 	return nil
 }
 
-func mailDBSet(s *session, field string, rawvalue string) error {
-	log.Debugf("mailDB: update %s %s %s", field, s.id, rawvalue)
-	url := fmt.Sprintf("%s/domain/%s/update/%s", MAILDB_BASE_URI, s.domain.Name, s.id.String())
+func mailDBSet(s *session, mail mailRecord, field string, rawvalue string) error {
+	log.Debugf("mailDB: update %s %s %s", field, mail.id, rawvalue)
+	url := fmt.Sprintf("%s/domain/%s/update/%s", MAILDB_BASE_URI, mail.domain.Name, mail.id.String())
 
 	valueBytes, err := json.Marshal(rawvalue)
 	if err != nil {
@@ -105,3 +111,22 @@ func mailDBSet(s *session, field string, rawvalue string) error {
 	}
 	return nil
 }
+
+// Update the records of all the recipients of a group
+func mailDBUpdateGroupStatus(s *session, group rcptGroup, status int) error {
+	for _, mail := range group.mails {
+		if err := mailDBUpdateMailStatus(s, mail, status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mailDBSetGroup(s *session, group rcptGroup, field string, rawvalue string) error {
+	for _, mail := range group.mails {
+		if err := mailDBSet(s, mail, field, rawvalue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
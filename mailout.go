@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/smtp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	CHUNK_SIZE = 64 * 1024
+)
+
+// net/smtp doesn't allow passing ESMTP parameters on MAIL or RCPT, the
+// envelope is sent with raw commands instead. Returns whether the server
+// supports DSN and took over the DSN parameters.
+func sendSMTP(addr string, envelope EmailEnvelope, data io.Reader) (bool, error) {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return false, err
+	}
+	dsn, _ := c.Extension("DSN")
+	return dsn, sendEnvelope(c, envelope, data, dsn)
+}
+
+func sendEnvelope(c *smtp.Client, envelope EmailEnvelope, data io.Reader, dsn bool) error {
+	mailParams := []string{}
+	if envelope.SMTPUTF8 {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return errors.New("server doesn't support SMTPUTF8")
+		}
+		mailParams = append(mailParams, "SMTPUTF8")
+	}
+
+	binary := false
+	switch envelope.Body {
+	case BODY_8BITMIME:
+		if ok, _ := c.Extension("8BITMIME"); ok {
+			mailParams = append(mailParams, "BODY=8BITMIME")
+		}
+	case BODY_BINARYMIME:
+		okChunking, _ := c.Extension("CHUNKING")
+		okBinary, _ := c.Extension("BINARYMIME")
+		if !okChunking || !okBinary {
+			return errors.New("server doesn't support BINARYMIME")
+		}
+		mailParams = append(mailParams, "BODY=BINARYMIME")
+		binary = true
+	}
+
+	if dsn {
+		if envelope.DSN.Ret != "" {
+			mailParams = append(mailParams, "RET="+envelope.DSN.Ret)
+		}
+		if envelope.DSN.EnvID != "" {
+			mailParams = append(mailParams, "ENVID="+envelope.DSN.EnvID)
+		}
+	}
+
+	if err := smtpCmd(c, 250, "MAIL FROM:<%s>%s", envelope.From, formatParams(mailParams)); err != nil {
+		return err
+	}
+	for _, to := range envelope.To {
+		rcptParams := []string{}
+		if dsn {
+			rcptDSN := envelope.DSN.Rcpt(to)
+			if len(rcptDSN.Notify) > 0 {
+				rcptParams = append(rcptParams, "NOTIFY="+strings.Join(rcptDSN.Notify, ","))
+			}
+			if rcptDSN.ORcpt != "" {
+				rcptParams = append(rcptParams, "ORCPT="+rcptDSN.ORcpt)
+			}
+		}
+		if err := smtpCmd(c, 250, "RCPT TO:<%s>%s", to, formatParams(rcptParams)); err != nil {
+			return err
+		}
+	}
+
+	if binary {
+		if err := sendChunks(c, data); err != nil {
+			return err
+		}
+		return c.Quit()
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Send the email with BDAT (RFC 3030), required for BINARYMIME
+func sendChunks(c *smtp.Client, data io.Reader) error {
+	buf := make([]byte, CHUNK_SIZE)
+	for {
+		n, err := io.ReadFull(data, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// last chunk, possibly empty
+			return smtpChunk(c, buf[:n], true)
+		}
+		if err != nil {
+			return err
+		}
+		if err := smtpChunk(c, buf[:n], false); err != nil {
+			return err
+		}
+	}
+}
+
+func smtpChunk(c *smtp.Client, chunk []byte, last bool) error {
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	id := c.Text.Next()
+	c.Text.StartRequest(id)
+	_, err := c.Text.W.WriteString(cmd + CRLF)
+	if err == nil {
+		_, err = c.Text.W.Write(chunk)
+	}
+	if err == nil {
+		err = c.Text.W.Flush()
+	}
+	c.Text.EndRequest(id)
+	if err != nil {
+		return err
+	}
+
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
+func smtpCmd(c *smtp.Client, expectCode int, format string, args ...interface{}) error {
+	id, err := c.Text.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	_, _, err = c.Text.ReadResponse(expectCode)
+	return err
+}
+
+func formatParams(params []string) string {
+	if len(params) == 0 {
+		return ""
+	}
+	return " " + strings.Join(params, " ")
+}
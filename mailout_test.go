@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendSMTP(t *testing.T) {
+	received := make(chan string, 1)
+	addr := startTestServer(t, &Server{}, withCapture(received))
+
+	envelope := EmailEnvelope{From: "a@b.ee", To: []string{"c@test.local"}, Body: BODY_8BITMIME}
+	_, err := sendSMTP(addr, envelope, strings.NewReader("Subject: test\r\n\r\nHéllo\r\n"))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(<-received, "Subject: test\n\nHéllo\n"))
+}
+
+func TestSendSMTPBinaryMIME(t *testing.T) {
+	received := make(chan string, 1)
+	addr := startTestServer(t, &Server{}, withCapture(received))
+
+	body := "Subject: test\r\n\r\n" + strings.Repeat("\x00\r\n.\r\n", CHUNK_SIZE/3)
+	envelope := EmailEnvelope{From: "a@b.ee", To: []string{"c@test.local"}, Body: BODY_BINARYMIME}
+	_, err := sendSMTP(addr, envelope, strings.NewReader(body))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(<-received, body))
+}
+
+func TestSendSMTPUTF8(t *testing.T) {
+	received := make(chan string, 1)
+	addr := startTestServer(t, &Server{}, withCapture(received))
+
+	envelope := EmailEnvelope{From: "jörg@bücher.de", To: []string{"c@test.local"}, SMTPUTF8: true}
+	_, err := sendSMTP(addr, envelope, strings.NewReader("Subject: test\r\n\r\nHello\r\n"))
+	assert.Nil(t, err)
+	assert.Contains(t, <-received, "Mw-Int-Mail-From: jörg@bücher.de")
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// The user of the process at the other end of a unix socket
+func unixPeerUser(conn *net.UnixConn) (string, error) {
+	return "", errors.New("peer credentials aren't supported")
+}
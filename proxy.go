@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HAProxy PROXY protocol, see
+// https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+const (
+	PROXY_V1_MAX_LENGTH = 107
+	PROXY_TIMEOUT       = 10 * time.Second
+
+	proxyV2Local = 0x0
+	proxyV2Proxy = 0x1
+
+	proxyV2TCP4 = 0x11
+	proxyV2TCP6 = 0x21
+
+	proxyV2TypeSSL        = 0x20
+	proxyV2SubtypeVersion = 0x21
+	proxyV2ClientSSL      = 0x01
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyListener wraps a listener and reads the PROXY protocol header of
+// the connections coming from a trusted peer. Other connections are passed
+// through as is.
+type ProxyListener struct {
+	net.Listener
+	Trusted func() []*net.IPNet
+	Timeout time.Duration
+}
+
+func NewProxyListener(ln net.Listener, trusted []*net.IPNet) *ProxyListener {
+	return &ProxyListener{
+		Listener: ln,
+		Trusted:  func() []*net.IPNet { return trusted },
+		Timeout:  PROXY_TIMEOUT,
+	}
+}
+
+func (ln *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !isTrustedAddr(conn.RemoteAddr(), ln.Trusted()) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, br: bufio.NewReader(conn), timeout: ln.Timeout}, nil
+}
+
+// The header is read on first use, to avoid blocking Accept
+type proxyConn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	tls        bool
+	tlsVersion string
+}
+
+// Handshake reads the PROXY protocol header
+func (c *proxyConn) Handshake() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.err = c.readHeader()
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if err := c.Handshake(); err == nil && c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// TLS returns whether the client connected to the proxy with TLS and the
+// version it used, if the proxy sent it.
+func (c *proxyConn) TLS() (bool, string) {
+	if err := c.Handshake(); err != nil {
+		return false, ""
+	}
+	return c.tls, c.tlsVersion
+}
+
+func (c *proxyConn) readHeader() error {
+	peek, err := c.br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return errors.Wrap(err, "could not read PROXY header")
+	}
+	if bytes.Equal(peek, proxyV2Signature) {
+		return c.readHeaderV2()
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return c.readHeaderV1()
+	}
+	return errors.New("missing PROXY header")
+}
+
+// PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\r\n
+func (c *proxyConn) readHeaderV1() error {
+	line := make([]byte, 0, PROXY_V1_MAX_LENGTH)
+	for {
+		b, err := c.br.ReadByte()
+		if err != nil {
+			return errors.Wrap(err, "could not read PROXY header")
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == PROXY_V1_MAX_LENGTH {
+			return errors.New("PROXY header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte(CRLF)) {
+		return errors.New("invalid PROXY header line ending")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// the proxy doesn't know the client, keep the address of the proxy
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errors.Errorf("invalid PROXY header: %s", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return errors.Errorf("invalid PROXY source address: %s", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return errors.Errorf("invalid PROXY source port: %s", fields[4])
+	}
+	c.remoteAddr = &net.TCPAddr{IP: ip, Port: int(port)}
+	return nil
+}
+
+func (c *proxyConn) readHeaderV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.br, header); err != nil {
+		return errors.Wrap(err, "could not read PROXY header")
+	}
+	if header[12]>>4 != 2 {
+		return errors.Errorf("unsupported PROXY version %d", header[12]>>4)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.br, data); err != nil {
+		return errors.Wrap(err, "could not read PROXY header")
+	}
+
+	switch header[12] & 0xf {
+	case proxyV2Local:
+		// health check from the proxy itself
+		return nil
+	case proxyV2Proxy:
+	default:
+		return errors.Errorf("unsupported PROXY command %d", header[12]&0xf)
+	}
+
+	var tlvs []byte
+	switch header[13] {
+	case proxyV2TCP4:
+		if len(data) < 12 {
+			return errors.New("PROXY header too short")
+		}
+		c.remoteAddr = &net.TCPAddr{
+			IP:   net.IP(data[0:4]),
+			Port: int(binary.BigEndian.Uint16(data[8:10])),
+		}
+		tlvs = data[12:]
+	case proxyV2TCP6:
+		if len(data) < 36 {
+			return errors.New("PROXY header too short")
+		}
+		c.remoteAddr = &net.TCPAddr{
+			IP:   net.IP(data[0:16]),
+			Port: int(binary.BigEndian.Uint16(data[32:34])),
+		}
+		tlvs = data[36:]
+	default:
+		// unspecified or unix socket, keep the address of the proxy
+		return nil
+	}
+
+	return parseProxyTLVs(tlvs, func(typ byte, value []byte) error {
+		if typ != proxyV2TypeSSL {
+			return nil
+		}
+		// client flags (1 byte), verify result (4 bytes), then sub-TLVs
+		if len(value) < 5 {
+			return errors.New("invalid PROXY SSL TLV")
+		}
+		c.tls = value[0]&proxyV2ClientSSL != 0
+		return parseProxyTLVs(value[5:], func(typ byte, value []byte) error {
+			if typ == proxyV2SubtypeVersion {
+				c.tlsVersion = string(value)
+			}
+			return nil
+		})
+	})
+}
+
+func parseProxyTLVs(data []byte, fn func(typ byte, value []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return errors.New("invalid PROXY TLV")
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return errors.New("invalid PROXY TLV length")
+		}
+		if err := fn(data[0], data[3:3+length]); err != nil {
+			return err
+		}
+		data = data[3+length:]
+	}
+	return nil
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %s", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedIP(ip net.IP, trusted []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTrustedAddr(addr net.Addr, trusted []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	return isTrustedIP(net.ParseIP(host), trusted)
+}
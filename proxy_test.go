@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type proxyClientInfo struct {
+	remoteIP string
+	tls      bool
+}
+
+// withProxy accepts the PROXY protocol header from the trusted networks
+func withProxy(trusted ...string) testServerOption {
+	return func(t *testing.T, ts *testServer) {
+		networks, err := parseNetworks(trusted)
+		assert.Nil(t, err)
+		ts.srv.TrustedNetworks = networks
+		ts.wrap = func(ln net.Listener) net.Listener {
+			return NewProxyListener(ln, networks)
+		}
+	}
+}
+
+// recordProxyClient sends the client of each recipient to info
+func recordProxyClient(info chan proxyClientInfo) func(s *session, from string, to string) error {
+	return func(s *session, from string, to string) error {
+		info <- proxyClientInfo{remoteIP: s.remoteIP, tls: s.tls}
+		return nil
+	}
+}
+
+func makeProxyV2Header(ip net.IP, tls bool) []byte {
+	addrs := make([]byte, 12)
+	copy(addrs[0:4], ip.To4())
+	copy(addrs[4:8], net.IPv4(192, 0, 2, 2).To4())
+	binary.BigEndian.PutUint16(addrs[8:10], 56324)
+	binary.BigEndian.PutUint16(addrs[10:12], 25)
+
+	if tls {
+		version := []byte("TLSv1.3")
+		ssl := []byte{proxyV2ClientSSL, 0, 0, 0, 0, proxyV2SubtypeVersion, 0, byte(len(version))}
+		ssl = append(ssl, version...)
+		addrs = append(addrs, proxyV2TypeSSL, 0, byte(len(ssl)))
+		addrs = append(addrs, ssl...)
+	}
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|proxyV2Proxy, proxyV2TCP4, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestProxyV1(t *testing.T) {
+	info := make(chan proxyClientInfo, 1)
+	addr := startTestServer(t, &Server{HandlerRcpt: recordProxyClient(info)}, withProxy("127.0.0.0/8"))
+	c := dialTestServer(t, addr, withPreamble([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\r\n")))
+
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	assert.Equal(t, proxyClientInfo{remoteIP: "192.0.2.1"}, <-info)
+}
+
+func TestProxyV2(t *testing.T) {
+	info := make(chan proxyClientInfo, 1)
+	addr := startTestServer(t, &Server{HandlerRcpt: recordProxyClient(info)}, withProxy("127.0.0.0/8"))
+	c := dialTestServer(t, addr, withPreamble(makeProxyV2Header(net.IPv4(192, 0, 2, 1), true)))
+
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	assert.Equal(t, proxyClientInfo{remoteIP: "192.0.2.1", tls: true}, <-info)
+}
+
+func TestProxyUntrustedPeer(t *testing.T) {
+	info := make(chan proxyClientInfo, 1)
+	addr := startTestServer(t, &Server{HandlerRcpt: recordProxyClient(info)}, withProxy("10.0.0.0/8"))
+	c := dialTestServer(t, addr)
+
+	// the header is handled like any other command
+	cmd(t, c, 500, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 25")
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	assert.Equal(t, "127.0.0.1", (<-info).remoteIP)
+}
+
+func TestProxyInvalidHeader(t *testing.T) {
+	for _, header := range []string{
+		"EHLO client.local\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.2 56324 25\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324 25\n",
+		"PROXY TCP4 " + strings.Repeat("1", PROXY_V1_MAX_LENGTH) + "\r\n",
+	} {
+		c := &proxyConn{br: bufio.NewReader(strings.NewReader(header))}
+		assert.NotNil(t, c.readHeader(), header)
+	}
+}
+
+func TestProxyUnknown(t *testing.T) {
+	c := &proxyConn{br: bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\nEHLO"))}
+	assert.Nil(t, c.readHeader())
+	assert.Nil(t, c.remoteAddr)
+
+	rest, err := c.br.ReadString('O')
+	assert.Nil(t, err)
+	assert.Equal(t, "EHLO", rest)
+}
+
+func TestXCLIENTRequiresTrustedPeer(t *testing.T) {
+	addr := startTestServer(t, &Server{})
+	c := dialTestServer(t, addr)
+	assert.NotContains(t, cmd(t, c, 250, "EHLO client.local"), "XCLIENT")
+	cmd(t, c, 550, "XCLIENT ADDR=192.0.2.1")
+
+	networks, err := parseNetworks([]string{"127.0.0.0/8"})
+	assert.Nil(t, err)
+	addr = startTestServer(t, &Server{TrustedNetworks: networks})
+	c = dialTestServer(t, addr)
+	// the authorization is based on the peer, not on the XCLIENT address
+	cmd(t, c, 220, "XCLIENT ADDR=192.0.2.1")
+	cmd(t, c, 220, "XCLIENT ADDR=192.0.2.2")
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	RATE_BACKEND_MEMORY = "memory"
+	RATE_BACKEND_DISK   = "disk"
+	RATE_BACKEND_REDIS  = "redis"
+
+	RATE_SAVE_INTERVAL     = 10 * time.Second
+	RATE_SWEEP_INTERVAL    = time.Minute
+	RATE_REDIS_KEY_PREFIX  = "mailway:ratelimit:"
+	RATE_REDIS_MAX_RETRIES = 10
+)
+
+// declare as var to be able to replace it in testing
+var RATE_LIMIT_FILE = "/var/lib/mailway/ratelimits.json"
+
+// Storage of the rate limit state: the theoretical arrival time of each key,
+// as Unix nanoseconds. A key expires once its time is past.
+type RateBackend interface {
+	// 0 if the key is unknown or expired
+	Get(key string) (int64, error)
+	// Replace the time of a key by update(time), atomically across the
+	// instances sharing the backend
+	Update(key string, update func(tat int64) int64) error
+	Close() error
+}
+
+// The state of a single instance, lost on restart. The expired keys are
+// removed every RATE_SWEEP_INTERVAL.
+type memoryRateBackend struct {
+	sync.Mutex
+	tats  map[string]int64
+	swept time.Time
+}
+
+func newMemoryRateBackend() *memoryRateBackend {
+	return &memoryRateBackend{tats: make(map[string]int64)}
+}
+
+func (m *memoryRateBackend) Get(key string) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	if tat := m.tats[key]; tat >= time.Now().UnixNano() {
+		return tat, nil
+	}
+	return 0, nil
+}
+
+func (m *memoryRateBackend) Update(key string, update func(tat int64) int64) error {
+	m.Lock()
+	defer m.Unlock()
+	if now := time.Now(); now.Sub(m.swept) >= RATE_SWEEP_INTERVAL {
+		m.swept = now
+		for k, tat := range m.tats {
+			if tat < now.UnixNano() {
+				delete(m.tats, k)
+			}
+		}
+	}
+	m.tats[key] = update(m.tats[key])
+	return nil
+}
+
+func (m *memoryRateBackend) Close() error {
+	return nil
+}
+
+// The state of a single instance persisted in a JSON file, written at most
+// every RATE_SAVE_INTERVAL and on close. The updates since the last write
+// are lost if the process is killed.
+type diskRateBackend struct {
+	*memoryRateBackend
+	file     string
+	saveLock sync.Mutex
+	saved    time.Time
+}
+
+func newDiskRateBackend(file string) (*diskRateBackend, error) {
+	d := &diskRateBackend{memoryRateBackend: newMemoryRateBackend(), file: file}
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "could not read rate limits")
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &d.tats); err != nil {
+			return nil, errors.Wrap(err, "failed to parse rate limits")
+		}
+	}
+	d.saved = time.Now()
+	return d, nil
+}
+
+func (d *diskRateBackend) Update(key string, update func(tat int64) int64) error {
+	if err := d.memoryRateBackend.Update(key, update); err != nil {
+		return err
+	}
+	d.saveLock.Lock()
+	defer d.saveLock.Unlock()
+	if time.Since(d.saved) < RATE_SAVE_INTERVAL {
+		return nil
+	}
+	return d.save()
+}
+
+func (d *diskRateBackend) Close() error {
+	d.saveLock.Lock()
+	defer d.saveLock.Unlock()
+	return d.save()
+}
+
+// Write the state, replacing the file atomically
+func (d *diskRateBackend) save() error {
+	d.saved = time.Now()
+	d.memoryRateBackend.Lock()
+	content, err := json.Marshal(d.tats)
+	d.memoryRateBackend.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "could not encode rate limits")
+	}
+	if err := os.MkdirAll(path.Dir(d.file), 0755); err != nil {
+		return errors.Wrap(err, "could not create rate limits directory")
+	}
+	tmp := d.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return errors.Wrap(err, "could not write rate limits")
+	}
+	return errors.Wrap(os.Rename(tmp, d.file), "could not write rate limits")
+}
+
+// The state shared by the instances in Redis, or a server speaking its
+// protocol. The keys expire in Redis at their time.
+type redisRateBackend struct {
+	client *redisClient
+}
+
+func newRedisRateBackend(rawurl string) (*redisRateBackend, error) {
+	client, err := newRedisClient(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &redisRateBackend{client: client}, nil
+}
+
+func parseRedisTime(reply interface{}) (int64, error) {
+	if reply == nil {
+		return 0, nil
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return 0, errors.Errorf("unexpected Redis reply %v", reply)
+	}
+	tat, err := strconv.ParseInt(value, 10, 64)
+	return tat, errors.Wrap(err, "invalid rate limit in Redis")
+}
+
+func (r *redisRateBackend) Get(key string) (int64, error) {
+	reply, err := r.client.do("GET", RATE_REDIS_KEY_PREFIX+key)
+	if err != nil {
+		return 0, err
+	}
+	return parseRedisTime(reply)
+}
+
+// Optimistic transaction: the update is retried after a random delay if
+// another instance changed the key meanwhile
+func (r *redisRateBackend) Update(key string, update func(tat int64) int64) error {
+	conn, err := r.client.get()
+	if err != nil {
+		return err
+	}
+	var aborted bool
+	for i := 1; i <= RATE_REDIS_MAX_RETRIES; i++ {
+		aborted, err = r.update(conn, RATE_REDIS_KEY_PREFIX+key, update)
+		if err != nil || !aborted {
+			break
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(i) * int64(time.Millisecond))))
+	}
+	r.client.put(conn, err)
+	if err == nil && aborted {
+		return errors.Errorf("rate limit %s changed concurrently %d times", key, RATE_REDIS_MAX_RETRIES)
+	}
+	return err
+}
+
+func (r *redisRateBackend) update(conn *redisConn, key string, update func(tat int64) int64) (bool, error) {
+	if _, err := conn.do("WATCH", key); err != nil {
+		return false, err
+	}
+	reply, err := conn.do("GET", key)
+	if err != nil {
+		return false, err
+	}
+	tat, err := parseRedisTime(reply)
+	if err != nil {
+		return false, err
+	}
+	tat = update(tat)
+	ttl := (tat-time.Now().UnixNano())/int64(time.Millisecond) + 1
+	if ttl <= 0 {
+		_, err := conn.do("UNWATCH")
+		return false, err
+	}
+
+	if _, err := conn.do("MULTI"); err != nil {
+		return false, err
+	}
+	if _, err := conn.do("SET", key, strconv.FormatInt(tat, 10), "PX", strconv.FormatInt(ttl, 10)); err != nil {
+		return false, err
+	}
+	reply, err = conn.do("EXEC")
+	if err != nil {
+		return false, err
+	}
+	return reply == nil, nil
+}
+
+func (r *redisRateBackend) Close() error {
+	return r.client.Close()
+}
+
+// The backend is kept across reloads as long as its settings don't change
+var rateBackends struct {
+	sync.Mutex
+	settings string
+	backend  RateBackend
+}
+
+func openRateBackend(settings *Settings) (RateBackend, error) {
+	file := RATE_LIMIT_FILE
+	if v := settings.RateLimitFile; v != "" {
+		file = v
+	}
+	key := settings.RateLimitBackend + " " + file + " " + settings.RateLimitRedis
+
+	rateBackends.Lock()
+	defer rateBackends.Unlock()
+	if rateBackends.backend != nil && rateBackends.settings == key {
+		return rateBackends.backend, nil
+	}
+
+	var backend RateBackend
+	var err error
+	switch settings.RateLimitBackend {
+	case "", RATE_BACKEND_MEMORY:
+		backend = newMemoryRateBackend()
+	case RATE_BACKEND_DISK:
+		backend, err = newDiskRateBackend(file)
+	case RATE_BACKEND_REDIS:
+		backend, err = newRedisRateBackend(settings.RateLimitRedis)
+	default:
+		err = errors.Errorf("invalid rate limit backend '%s'", settings.RateLimitBackend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rateBackends.backend != nil {
+		if err := rateBackends.backend.Close(); err != nil {
+			log.Errorf("could not close the rate limit backend: %s", err)
+		}
+	}
+	rateBackends.settings = key
+	rateBackends.backend = backend
+	return backend, nil
+}
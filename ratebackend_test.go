@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withRateLimitDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ratelimits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// A stand-in for Redis knowing the commands of the rate limit backend
+type fakeRedis struct {
+	sync.Mutex
+	password string
+	values   map[string]string
+	expires  map[string]time.Time
+	versions map[string]int
+}
+
+func startFakeRedis(t *testing.T, password string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	redis := &fakeRedis{
+		password: password,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		versions: make(map[string]int),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go redis.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authenticated := f.password == ""
+	watched := make(map[string]int)
+	var queued [][]string
+	inMulti := false
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		var reply string
+		switch {
+		case cmd == "AUTH":
+			authenticated = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required\r\n"
+		case inMulti && cmd != "EXEC" && cmd != "DISCARD":
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		case cmd == "WATCH":
+			f.Lock()
+			for _, key := range args[1:] {
+				watched[key] = f.versions[key]
+			}
+			f.Unlock()
+			reply = "+OK\r\n"
+		case cmd == "UNWATCH":
+			watched = make(map[string]int)
+			reply = "+OK\r\n"
+		case cmd == "MULTI":
+			inMulti = true
+			reply = "+OK\r\n"
+		case cmd == "DISCARD":
+			inMulti, queued, watched = false, nil, make(map[string]int)
+			reply = "+OK\r\n"
+		case cmd == "EXEC":
+			f.Lock()
+			reply = fmt.Sprintf("*%d\r\n", len(queued))
+			for key, version := range watched {
+				if f.versions[key] != version {
+					reply = "*-1\r\n"
+					queued = nil
+				}
+			}
+			for _, args := range queued {
+				reply += f.run(args)
+			}
+			f.Unlock()
+			inMulti, queued, watched = false, nil, make(map[string]int)
+		default:
+			f.Lock()
+			reply = f.run(args)
+			f.Unlock()
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) run(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		value, ok := f.values[args[1]]
+		if expires, ok := f.expires[args[1]]; ok && time.Now().After(expires) {
+			return "$-1\r\n"
+		}
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		key := args[1]
+		f.values[key] = args[2]
+		f.versions[key]++
+		delete(f.expires, key)
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			f.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisClient(t *testing.T) {
+	addr := startFakeRedis(t, "secret")
+
+	client, err := newRedisClient("redis://:secret@" + addr + "/2")
+	assert.Nil(t, err)
+	reply, err := client.do("PING")
+	assert.Nil(t, err)
+	assert.Equal(t, "PONG", reply)
+	_, err = client.do("HELLO")
+	assert.Equal(t, redisError("ERR unknown command"), err)
+	assert.Nil(t, client.Close())
+
+	client, err = newRedisClient("redis://:wrong@" + addr)
+	assert.Nil(t, err)
+	_, err = client.do("PING")
+	assert.Equal(t, redisError("WRONGPASS invalid password"), err)
+
+	client, err = newRedisClient("redis://localhost")
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:6379", client.addr)
+	for _, url := range []string{"localhost:6379", "http://localhost", "redis://localhost/db"} {
+		_, err = newRedisClient(url)
+		assert.NotNil(t, err, url)
+	}
+}
+
+func TestRedisRateBackend(t *testing.T) {
+	addr := startFakeRedis(t, "")
+	backend, err := newRedisRateBackend("redis://" + addr)
+	assert.Nil(t, err)
+	defer backend.Close()
+	limit := RateLimit{Key: RATE_KEY_CLIENT_IP, Count: 2, Window: time.Minute}
+	now := time.Now()
+
+	tat, err := backend.Get("unknown")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), tat)
+
+	assert.Nil(t, limit.add(backend, "192.0.2.1", 2, now))
+	tat, err = backend.Get(limit.storeKey("192.0.2.1"))
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(time.Minute).UnixNano(), tat)
+	assert.False(t, allowed(t, backend, limit, "192.0.2.1", now))
+	assert.True(t, allowed(t, backend, limit, "192.0.2.1", now.Add(30*time.Second)))
+}
+
+// Instances sharing a Redis count every message once
+func TestRedisRateBackendConverges(t *testing.T) {
+	addr := startFakeRedis(t, "")
+	limit := RateLimit{Key: RATE_KEY_DOMAIN, Count: 1000, Window: time.Hour}
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		backend, err := newRedisRateBackend("redis://" + addr)
+		assert.Nil(t, err)
+		defer backend.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.Nil(t, limit.add(backend, "example.com", 1, now))
+			}
+		}()
+	}
+	wg.Wait()
+
+	backend, _ := newRedisRateBackend("redis://" + addr)
+	tat, err := backend.Get(limit.storeKey("example.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(40*limit.interval()).UnixNano(), tat)
+
+	// unreachable
+	backend, _ = newRedisRateBackend("redis://127.0.0.1:1")
+	assert.NotNil(t, limit.add(backend, "example.com", 1, now))
+}
+
+func TestMemoryRateBackendSweep(t *testing.T) {
+	backend := newMemoryRateBackend()
+	past := time.Now().Add(-time.Second).UnixNano()
+	assert.Nil(t, backend.Update("expired", func(int64) int64 { return past }))
+	tat, err := backend.Get("expired")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), tat)
+
+	// removed by the next sweep only
+	assert.Nil(t, backend.Update("other", func(int64) int64 { return time.Now().Add(time.Hour).UnixNano() }))
+	assert.Len(t, backend.tats, 2)
+	backend.swept = backend.swept.Add(-RATE_SWEEP_INTERVAL)
+	assert.Nil(t, backend.Update("other", func(tat int64) int64 { return tat }))
+	assert.Len(t, backend.tats, 1)
+}
+
+func TestDiskRateBackend(t *testing.T) {
+	file := path.Join(withRateLimitDir(t), "lib", "ratelimits.json")
+	limit := RateLimit{Key: RATE_KEY_SENDER, Count: 1, Window: time.Hour}
+	now := time.Now()
+
+	backend, err := newDiskRateBackend(file)
+	assert.Nil(t, err)
+	assert.Nil(t, limit.add(backend, "a@b.ee", 1, now))
+	assert.Nil(t, backend.Update("expired", func(int64) int64 { return now.Add(-time.Second).UnixNano() }))
+	assert.Nil(t, backend.Close())
+
+	// after a restart
+	backend, err = newDiskRateBackend(file)
+	assert.Nil(t, err)
+	assert.False(t, allowed(t, backend, limit, "a@b.ee", now))
+	assert.Nil(t, limit.add(backend, "c@d.ee", 1, now))
+	_, ok := backend.tats["expired"]
+	assert.False(t, ok)
+}
+
+func TestOpenRateBackend(t *testing.T) {
+	t.Cleanup(func() { rateBackends.backend = nil })
+	redis := startFakeRedis(t, "")
+
+	memory, err := openRateBackend(&Settings{})
+	assert.Nil(t, err)
+	assert.IsType(t, &memoryRateBackend{}, memory)
+	backend, err := openRateBackend(&Settings{RateLimitBackend: RATE_BACKEND_MEMORY})
+	assert.Nil(t, err)
+	assert.True(t, memory != backend)
+	memory = backend
+
+	// kept on reload
+	backend, err = openRateBackend(&Settings{RateLimitBackend: RATE_BACKEND_MEMORY})
+	assert.Nil(t, err)
+	assert.True(t, memory == backend)
+
+	backend, err = openRateBackend(&Settings{RateLimitBackend: RATE_BACKEND_DISK, RateLimitFile: path.Join(withRateLimitDir(t), "ratelimits.json")})
+	assert.Nil(t, err)
+	assert.IsType(t, &diskRateBackend{}, backend)
+	backend, err = openRateBackend(&Settings{RateLimitBackend: RATE_BACKEND_REDIS, RateLimitRedis: "redis://" + redis})
+	assert.Nil(t, err)
+	assert.IsType(t, &redisRateBackend{}, backend)
+
+	for _, settings := range []Settings{
+		{RateLimitBackend: "etcd"},
+		{RateLimitBackend: RATE_BACKEND_REDIS},
+		{RateLimitBackend: RATE_BACKEND_REDIS, RateLimitRedis: "127.0.0.1:6379"},
+	} {
+		assert.NotNil(t, settings.Validate())
+		_, err := openRateBackend(&settings)
+		assert.NotNil(t, err)
+	}
+}
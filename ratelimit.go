@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// What a rate limit counts the messages of
+type RateLimitKey string
+
+const (
+	// the hosted domain, the domain of the recipient or, on the submission
+	// listeners, of the sender
+	RATE_KEY_DOMAIN        RateLimitKey = "domain"
+	RATE_KEY_SENDER        RateLimitKey = "sender"
+	RATE_KEY_SENDER_DOMAIN RateLimitKey = "sender_domain"
+	RATE_KEY_CLIENT_IP     RateLimitKey = "client_ip"
+	RATE_KEY_RECIPIENT     RateLimitKey = "recipient"
+
+	METRIC_RATE_LIMITED = "rate_limited_"
+)
+
+// Count messages per Window, the allowance is regenerated continuously (a
+// sliding window) up to Burst messages at once, Count by default. The
+// messages are counted once delivered, the limits are checked as soon as
+// their key is known: the client and the sender on MAIL, the domain and the
+// recipient on RCPT.
+type RateLimit struct {
+	Key    RateLimitKey  `yaml:"key"`
+	Count  int           `yaml:"count"`
+	Window time.Duration `yaml:"window"`
+	Burst  int           `yaml:"burst"`
+}
+
+// The API sends the window as a duration, for example "1h"
+func (l *RateLimit) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Key    RateLimitKey `json:"key"`
+		Count  int          `json:"count"`
+		Window string       `json:"window"`
+		Burst  int          `json:"burst"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	window, err := time.ParseDuration(raw.Window)
+	if err != nil {
+		return errors.Wrapf(err, "invalid rate limit window %s", raw.Window)
+	}
+	*l = RateLimit{Key: raw.Key, Count: raw.Count, Window: window, Burst: raw.Burst}
+	return l.Validate()
+}
+
+func (l *RateLimit) Validate() error {
+	switch l.Key {
+	case RATE_KEY_DOMAIN, RATE_KEY_SENDER, RATE_KEY_SENDER_DOMAIN, RATE_KEY_CLIENT_IP, RATE_KEY_RECIPIENT:
+	default:
+		return errors.Errorf("invalid rate limit key '%s'", l.Key)
+	}
+	if l.Count <= 0 || l.Window <= 0 || l.Burst < 0 {
+		return errors.Errorf("invalid rate limit %s: count and window must be positive", l.Key)
+	}
+	return nil
+}
+
+// The limits of a domain are checked on RCPT, for its recipients. The keys
+// of the sender and the client are only known to the instance settings.
+func validateDomainRateLimits(limits []RateLimit) error {
+	for _, limit := range limits {
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+		switch limit.Key {
+		case RATE_KEY_DOMAIN, RATE_KEY_RECIPIENT:
+		default:
+			return errors.Errorf("rate limit key '%s' can't be set for a domain", limit.Key)
+		}
+	}
+	return nil
+}
+
+func (l *RateLimit) String() string {
+	return fmt.Sprintf("%s %d/%s", l.Key, l.Count, l.Window)
+}
+
+// Generic cell rate algorithm, the state of a key is its theoretical arrival
+// time: when it would be back under the limit if messages kept coming at
+// the rate of Count per Window.
+func (l *RateLimit) interval() time.Duration {
+	return l.Window / time.Duration(l.Count)
+}
+
+func (l *RateLimit) tolerance() time.Duration {
+	burst := l.Burst
+	if burst == 0 {
+		burst = l.Count
+	}
+	return l.interval() * time.Duration(burst)
+}
+
+func (l *RateLimit) storeKey(value string) string {
+	return fmt.Sprintf("%s:%s:%s", l.Key, l.Window, strings.ToLower(value))
+}
+
+// Returns true if a message is allowed now
+func (l *RateLimit) allow(backend RateBackend, value string, now time.Time) (bool, error) {
+	tat, err := backend.Get(l.storeKey(value))
+	if err != nil {
+		return false, err
+	}
+	if tat < now.UnixNano() {
+		tat = now.UnixNano()
+	}
+	return tat+int64(l.interval()-l.tolerance()) <= now.UnixNano(), nil
+}
+
+// Count n messages, even above the limit
+func (l *RateLimit) add(backend RateBackend, value string, n int, now time.Time) error {
+	return backend.Update(l.storeKey(value), func(tat int64) int64 {
+		if tat < now.UnixNano() {
+			tat = now.UnixNano()
+		}
+		return tat + int64(l.interval())*int64(n)
+	})
+}
+
+// The limits of a domain replace the default limits of the same key
+func rateLimitsFor(limits []RateLimit, domain *Domain) []RateLimit {
+	if domain == nil || len(domain.RateLimits) == 0 {
+		return limits
+	}
+	overridden := make(map[RateLimitKey]bool)
+	for _, limit := range domain.RateLimits {
+		overridden[limit.Key] = true
+	}
+	out := append([]RateLimit{}, domain.RateLimits...)
+	for _, limit := range limits {
+		if !overridden[limit.Key] {
+			out = append(out, limit)
+		}
+	}
+	return out
+}
+
+// Returns rateError if one of the limits with a key in values is reached.
+// Errors of the backend let the mail through.
+func checkRateLimits(backend RateBackend, limits []RateLimit, values map[RateLimitKey]string) error {
+	now := time.Now()
+	for _, limit := range limits {
+		value, ok := values[limit.Key]
+		if !ok || value == "" {
+			continue
+		}
+		allowed, err := limit.allow(backend, value, now)
+		if err != nil {
+			log.Errorf("rate limits: %s", err)
+			continue
+		}
+		if !allowed {
+			log.Warnf("rate limit %s reached by %s", &limit, value)
+			metrics.Add(METRIC_RATE_LIMITED+string(limit.Key), 1)
+			return rateError
+		}
+	}
+	return nil
+}
+
+func countRateLimits(backend RateBackend, limits []RateLimit, values map[RateLimitKey]string, n int) {
+	now := time.Now()
+	for _, limit := range limits {
+		value, ok := values[limit.Key]
+		if !ok || value == "" {
+			continue
+		}
+		if err := limit.add(backend, value, n, now); err != nil {
+			log.Errorf("rate limits: %s", err)
+		}
+	}
+}
+
+// The keys known on MAIL
+func senderRateKeys(s *session, from string) map[RateLimitKey]string {
+	keys := map[RateLimitKey]string{
+		RATE_KEY_CLIENT_IP: s.remoteIP,
+		RATE_KEY_SENDER:    from,
+	}
+	if e, err := parseAddress(from); err == nil {
+		keys[RATE_KEY_SENDER_DOMAIN] = e.domain
+	}
+	return keys
+}
+
+func checkSenderRateLimits(s *session, from string) error {
+	return checkRateLimits(s.snapshot.RateBackend, s.snapshot.RateLimits, senderRateKeys(s, from))
+}
+
+func checkRecipientRateLimits(s *session, domain *Domain, to string) error {
+	return checkRateLimits(s.snapshot.RateBackend, rateLimitsFor(s.snapshot.RateLimits, domain), map[RateLimitKey]string{
+		RATE_KEY_DOMAIN:    domain.Name,
+		RATE_KEY_RECIPIENT: to,
+	})
+}
+
+// Count a message delivered to the recipients of a domain
+func countDelivered(s *session, domain *Domain, rcpts []string) {
+	limits := rateLimitsFor(s.snapshot.RateLimits, domain)
+	countRateLimits(s.snapshot.RateBackend, limits, map[RateLimitKey]string{RATE_KEY_DOMAIN: domain.Name}, 1)
+	for _, rcpt := range rcpts {
+		countRateLimits(s.snapshot.RateBackend, limits, map[RateLimitKey]string{RATE_KEY_RECIPIENT: rcpt}, 1)
+	}
+}
+
+// Count a message delivered to at least one recipient
+func countSent(s *session, from string) {
+	countRateLimits(s.snapshot.RateBackend, s.snapshot.RateLimits, senderRateKeys(s, from), 1)
+}
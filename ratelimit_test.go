@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func allowed(t *testing.T, backend RateBackend, limit RateLimit, value string, now time.Time) bool {
+	ok, err := limit.allow(backend, value, now)
+	assert.Nil(t, err)
+	return ok
+}
+
+func TestRateLimitWindow(t *testing.T) {
+	backend := newMemoryRateBackend()
+	limit := RateLimit{Key: RATE_KEY_CLIENT_IP, Count: 3, Window: 3 * time.Second}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, allowed(t, backend, limit, "192.0.2.1", now))
+		assert.Nil(t, limit.add(backend, "192.0.2.1", 1, now))
+	}
+	assert.False(t, allowed(t, backend, limit, "192.0.2.1", now))
+	assert.True(t, allowed(t, backend, limit, "192.0.2.2", now))
+
+	// the allowance comes back progressively
+	assert.False(t, allowed(t, backend, limit, "192.0.2.1", now.Add(500*time.Millisecond)))
+	assert.True(t, allowed(t, backend, limit, "192.0.2.1", now.Add(time.Second)))
+	assert.Nil(t, limit.add(backend, "192.0.2.1", 1, now.Add(time.Second)))
+	assert.False(t, allowed(t, backend, limit, "192.0.2.1", now.Add(time.Second)))
+	assert.True(t, allowed(t, backend, limit, "192.0.2.1", now.Add(5*time.Second)))
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	backend := newMemoryRateBackend()
+	limit := RateLimit{Key: RATE_KEY_SENDER, Count: 10, Window: 10 * time.Second, Burst: 2}
+	now := time.Now()
+
+	assert.Nil(t, limit.add(backend, "a@b.ee", 2, now))
+	assert.False(t, allowed(t, backend, limit, "A@b.ee", now))
+	assert.True(t, allowed(t, backend, limit, "a@b.ee", now.Add(time.Second)))
+
+	// a limit with another window is counted apart
+	other := RateLimit{Key: RATE_KEY_SENDER, Count: 10, Window: time.Hour, Burst: 2}
+	assert.True(t, allowed(t, backend, other, "a@b.ee", now))
+}
+
+func TestRateLimitsFor(t *testing.T) {
+	limits := []RateLimit{
+		{Key: RATE_KEY_DOMAIN, Count: 100, Window: time.Hour},
+		{Key: RATE_KEY_RECIPIENT, Count: 10, Window: time.Minute},
+	}
+	assert.Equal(t, limits, rateLimitsFor(limits, &Domain{Name: "example.com"}))
+
+	domain := &Domain{Name: "example.com", RateLimits: []RateLimit{{Key: RATE_KEY_DOMAIN, Count: 1000, Window: time.Hour}}}
+	assert.Equal(t, []RateLimit{
+		{Key: RATE_KEY_DOMAIN, Count: 1000, Window: time.Hour},
+		{Key: RATE_KEY_RECIPIENT, Count: 10, Window: time.Minute},
+	}, rateLimitsFor(limits, domain))
+}
+
+func TestRateLimitSettings(t *testing.T) {
+	var settings Settings
+	assert.Nil(t, yaml.Unmarshal([]byte(`
+forwarding_rate_limits:
+  - key: client_ip
+    count: 20
+    window: 1m
+    burst: 5
+`), &settings))
+	assert.Nil(t, settings.Validate())
+	assert.Equal(t, []RateLimit{{Key: RATE_KEY_CLIENT_IP, Count: 20, Window: time.Minute, Burst: 5}}, settings.RateLimits)
+
+	for _, limit := range []RateLimit{
+		{Key: "helo", Count: 1, Window: time.Minute},
+		{Key: RATE_KEY_SENDER, Window: time.Minute},
+		{Key: RATE_KEY_SENDER, Count: 1},
+	} {
+		settings = Settings{RateLimits: []RateLimit{limit}}
+		assert.NotNil(t, settings.Validate())
+	}
+
+	var domain Domain
+	assert.Nil(t, json.Unmarshal([]byte(`{"name":"example.com","rate_limits":[{"key":"recipient","count":5,"window":"1h"}]}`), &domain))
+	assert.Equal(t, []RateLimit{{Key: RATE_KEY_RECIPIENT, Count: 5, Window: time.Hour}}, domain.RateLimits)
+	assert.NotNil(t, json.Unmarshal([]byte(`{"rate_limits":[{"key":"recipient","count":5,"window":"1 hour"}]}`), &domain))
+
+	// the domains only limit their recipients
+	assert.Nil(t, validateDomainRateLimits(domain.RateLimits))
+	for _, key := range []RateLimitKey{RATE_KEY_SENDER, RATE_KEY_SENDER_DOMAIN, RATE_KEY_CLIENT_IP} {
+		assert.NotNil(t, validateDomainRateLimits([]RateLimit{{Key: key, Count: 5, Window: time.Hour}}), key)
+	}
+}
+
+func TestRateLimitOnMail(t *testing.T) {
+	withBufferLocation(t)
+	snapshot := &Snapshot{
+		RateLimits:  []RateLimit{{Key: RATE_KEY_CLIENT_IP, Count: 1, Window: time.Hour}},
+		RateBackend: newMemoryRateBackend(),
+	}
+	addr := startTestServer(t, &Server{
+		Snapshot:    func() *Snapshot { return snapshot },
+		HandlerMail: mailFromHandler,
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			countSent(s, from)
+			return nil
+		},
+	})
+	limited := metricValue(METRIC_RATE_LIMITED + string(RATE_KEY_CLIENT_IP))
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// not counted until delivered
+	assert.Nil(t, c.Mail("a@b.ee"))
+	assert.Nil(t, c.Reset())
+	assert.Nil(t, c.Mail("a@b.ee"))
+	assert.Nil(t, c.Rcpt("c@test.local"))
+	w, err := c.Data()
+	assert.Nil(t, err)
+	w.Write([]byte("Subject: test\r\n\r\nHello\r\n"))
+	assert.Nil(t, w.Close())
+
+	err = c.Mail("a@b.ee")
+	if assert.IsType(t, &textproto.Error{}, err) {
+		assert.Equal(t, 450, err.(*textproto.Error).Code)
+		assert.Equal(t, "4.4.2 Temporarily rate limited; suspicious behavior", err.(*textproto.Error).Msg)
+	}
+	assert.Equal(t, limited+1, metricValue(METRIC_RATE_LIMITED+string(RATE_KEY_CLIENT_IP)))
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	REDIS_TIMEOUT   = 5 * time.Second
+	REDIS_POOL_SIZE = 8
+)
+
+// An error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Minimal client of the Redis protocol (RESP), enough for the rate limits.
+// The connections are dialed on demand and kept in a small pool.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redis://[:password@]host[:port][/db]
+func newRedisClient(rawurl string) (*redisClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid Redis URL %s", rawurl)
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, errors.Errorf("invalid Redis URL %s", rawurl)
+	}
+	client := &redisClient{addr: u.Host, idle: make(chan *redisConn, REDIS_POOL_SIZE)}
+	if u.Port() == "" {
+		client.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		client.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil || client.db < 0 {
+			return nil, errors.Errorf("invalid Redis database in %s", rawurl)
+		}
+	}
+	return client, nil
+}
+
+func (c *redisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	netConn, err := net.DialTimeout("tcp", c.addr, REDIS_TIMEOUT)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to Redis")
+	}
+	conn := &redisConn{conn: netConn, r: bufio.NewReader(netConn)}
+	if c.password != "" {
+		if _, err := conn.do("AUTH", c.password); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Put a connection back in the pool, it's closed after an error as its
+// state is unknown
+func (c *redisClient) put(conn *redisConn, err error) {
+	if err != nil {
+		conn.conn.Close()
+		return
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// Run a single command
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	c.put(conn, err)
+	return reply, err
+}
+
+// Close the idle connections
+func (c *redisClient) Close() error {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Send a command and read its reply: a string, an int64, nil or a slice of
+// replies. Error replies are returned as redisError.
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT)); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, errors.Wrap(err, "could not send Redis command")
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read Redis reply")
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("invalid Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		return n, errors.Wrap(err, "invalid Redis integer")
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid Redis bulk string")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, errors.Wrap(err, "could not read Redis reply")
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid Redis array")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			reply, err := c.readReply()
+			if _, ok := err.(redisError); err != nil && !ok {
+				return nil, err
+			}
+			replies[i] = reply
+			if err != nil {
+				replies[i] = err
+			}
+		}
+		return replies, nil
+	}
+	return nil, errors.Errorf("invalid Redis reply %q", line)
+}
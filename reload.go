@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Effective settings, replaced as a whole on reload. A session keeps the
+// snapshot taken when it started. The listener settings (addresses, PROXY
+// protocol, metrics address, enabling TLS) need a restart.
+type Snapshot struct {
+	Config   *config.Config
+	Settings *Settings
+
+	LoopDetectionCount  int
+	RateLimitCount      int
+	SubaddressSeparator string
+	TrustedNetworks     []*net.IPNet
+	Limits              Limits
+	TLSConfig           *tls.Config // nil if TLS isn't configured
+	Greylisting         Greylisting
+	DNSBL               DNSBL
+	ClientChecks        ClientChecks
+	RateLimits          []RateLimit
+	RateBackend         RateBackend   // kept across reloads
+	DedupTTL            time.Duration // 0 if the deduplication is disabled
+	Dedup               *dedupStore   // kept across reloads
+}
+
+var currentSnapshot atomic.Value
+
+func getSnapshot() *Snapshot {
+	snapshot, _ := currentSnapshot.Load().(*Snapshot)
+	return snapshot
+}
+
+func setSnapshot(snapshot *Snapshot) {
+	currentSnapshot.Store(snapshot)
+}
+
+// Apply the defaults and validate the configuration
+func newSnapshot(cfg *config.Config, settings *Settings) (*Snapshot, error) {
+	if !cfg.IsInstanceLocal() && cfg.ServerJWT == "" {
+		return nil, errors.New("server JWT is needed")
+	}
+	if err := settings.Validate(); err != nil {
+		return nil, err
+	}
+	// the getters of config exit on an unknown value
+	switch cfg.LogLevel {
+	case "", "INFO", "DEBUG", "WARN":
+	default:
+		return nil, errors.Errorf("unknown log level '%s'", cfg.LogLevel)
+	}
+	switch cfg.LogFormat {
+	case "", "text", "json":
+	default:
+		return nil, errors.Errorf("unknown log format '%s'", cfg.LogFormat)
+	}
+
+	snapshot := &Snapshot{
+		Config:              cfg,
+		Settings:            settings,
+		LoopDetectionCount:  LOOP_DETECTION_COUNT,
+		RateLimitCount:      RATE_LIMIT_COUNT,
+		SubaddressSeparator: SUBADDRESS_SEPARATOR,
+		Limits:              settings.Limits(),
+	}
+	if v := cfg.ForwardingLoopDetectionCount; v > 0 {
+		snapshot.LoopDetectionCount = v
+	}
+	if v := cfg.ForwardingRateLimitingCount; v > 0 {
+		snapshot.RateLimitCount = v
+	}
+	if v := settings.SubaddressSeparator; v != "" {
+		snapshot.SubaddressSeparator = v
+	}
+	trusted := TRUSTED_NETWORKS
+	if v := settings.TrustedNetworks; len(v) > 0 {
+		trusted = v
+	}
+	var err error
+	if snapshot.TrustedNetworks, err = parseNetworks(trusted); err != nil {
+		return nil, err
+	}
+	if snapshot.TLSConfig, err = newTLSConfig(settings); err != nil {
+		return nil, err
+	}
+
+	snapshot.Greylisting = Greylisting{
+		Enabled: settings.Greylisting,
+		Delay:   GREYLISTING_DELAY,
+		Expiry:  GREYLISTING_EXPIRY,
+	}
+	if v := settings.GreylistingDelay; v > 0 {
+		snapshot.Greylisting.Delay = v
+	}
+	if v := settings.GreylistingExpiry; v > 0 {
+		snapshot.Greylisting.Expiry = v
+	}
+	if snapshot.Greylisting.Networks, err = parseNetworks(settings.GreylistingNetworks); err != nil {
+		return nil, err
+	}
+
+	resolver := newResolver(settings.Resolver)
+	snapshot.DNSBL = DNSBL{
+		Threshold: DNSBL_THRESHOLD,
+		Reject:    settings.DNSBLReject,
+		CacheTTL:  DNSBL_CACHE_TTL,
+		Resolver:  resolver,
+	}
+	if v := settings.DNSBLResolver; v != "" {
+		snapshot.DNSBL.Resolver = newResolver(v)
+	}
+	for _, zone := range settings.DNSBLZones {
+		if zone.Weight == 0 {
+			zone.Weight = 1
+		}
+		snapshot.DNSBL.Zones = append(snapshot.DNSBL.Zones, zone)
+	}
+	if v := settings.DNSBLThreshold; v > 0 {
+		snapshot.DNSBL.Threshold = v
+	}
+	if v := settings.DNSBLCacheTTL; v > 0 {
+		snapshot.DNSBL.CacheTTL = v
+	}
+
+	// the configured rate limits replace the hourly limit of the domains
+	snapshot.RateLimits = settings.RateLimits
+	if len(snapshot.RateLimits) == 0 {
+		snapshot.RateLimits = []RateLimit{{Key: RATE_KEY_DOMAIN, Count: snapshot.RateLimitCount, Window: time.Hour}}
+	}
+
+	snapshot.ClientChecks = ClientChecks{
+		GreetDelay:           settings.GreetDelay,
+		RejectEarlyTalkers:   settings.RejectEarlyTalkers,
+		RejectInvalidHELO:    settings.RejectInvalidHELO,
+		FCrDNS:               settings.FCrDNS || settings.RejectUnknownClients,
+		RejectUnknownClients: settings.RejectUnknownClients,
+		Resolver:             resolver,
+	}
+
+	if !settings.NoDedup {
+		snapshot.DedupTTL = DEDUP_TTL
+		if v := settings.DedupTTL; v > 0 {
+			snapshot.DedupTTL = v
+		}
+	}
+
+	// opened last, a reload failing before doesn't replace the backend
+	if snapshot.RateBackend, err = openRateBackend(settings); err != nil {
+		return nil, err
+	}
+	snapshot.Greylisting.Store = openGreylist(settings)
+	snapshot.Dedup = openDedup(settings)
+	return snapshot, nil
+}
+
+// Read the configuration. config.Init isn't used because it starts a watcher
+// modifying config.CurrConfig in place, the sessions use the configuration
+// of their snapshot.
+func loadSnapshot() (*Snapshot, error) {
+	data, err := readConfigFiles()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read config")
+	}
+
+	var cfg config.Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config")
+	}
+	var settings Settings
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, errors.Wrap(err, "failed to parse settings")
+	}
+	return newSnapshot(&cfg, &settings)
+}
+
+// Reload the configuration, the current one is kept if the new one is
+// invalid
+func reloadSnapshot() {
+	snapshot, err := loadSnapshot()
+	if err != nil {
+		log.Errorf("configuration reload failed, keeping the current configuration: %s", err)
+		return
+	}
+	log.SetLevel(snapshot.Config.GetLogLevel())
+	log.SetFormatter(snapshot.Config.GetLogFormat())
+	setSnapshot(snapshot)
+	log.Infof("configuration reloaded: loop detection %d, rate limit %d, spam filter %t, subaddress separator '%s', %d trusted network(s)",
+		snapshot.LoopDetectionCount, snapshot.RateLimitCount, snapshot.Config.SpamFilter,
+		snapshot.SubaddressSeparator, len(snapshot.TrustedNetworks))
+}
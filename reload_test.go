@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func withConfig(t *testing.T, content string) {
+	dir, err := ioutil.TempDir("", "conf.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := CONFIG_LOCATION
+	CONFIG_LOCATION = dir
+	t.Cleanup(func() {
+		CONFIG_LOCATION = prev
+		os.RemoveAll(dir)
+	})
+	writeConfig(t, content)
+}
+
+func writeConfig(t *testing.T, content string) {
+	file := path.Join(CONFIG_LOCATION, "forwarding.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func withSnapshot(t *testing.T, snapshot *Snapshot) {
+	prev := getSnapshot()
+	setSnapshot(snapshot)
+	t.Cleanup(func() { setSnapshot(prev) })
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	withConfig(t, `
+instance_mode: local
+spam_filter: true
+forwarding_loop_detection_count: 10
+forwarding_subaddress_separator: "-"
+forwarding_max_commands: 50
+forwarding_tarpit_delay: 2s
+`)
+	snapshot, err := loadSnapshot()
+	assert.Nil(t, err)
+	assert.True(t, snapshot.Config.SpamFilter)
+	assert.Equal(t, 10, snapshot.LoopDetectionCount)
+	assert.Equal(t, RATE_LIMIT_COUNT, snapshot.RateLimitCount)
+	assert.Equal(t, "-", snapshot.SubaddressSeparator)
+	assert.Equal(t, 50, snapshot.Limits.MaxCommands)
+	assert.Equal(t, "2s", snapshot.Limits.TarpitDelay.String())
+	assert.Len(t, snapshot.TrustedNetworks, 2)
+	assert.Equal(t, DEDUP_TTL, snapshot.DedupTTL)
+}
+
+func TestLoadSnapshotInvalid(t *testing.T) {
+	withConfig(t, "instance_mode: remote\n")
+	_, err := loadSnapshot()
+	assert.NotNil(t, err)
+
+	writeConfig(t, "instance_mode: local\nforwarding_trusted_networks: [\"10.0.0.0\"]\n")
+	_, err = loadSnapshot()
+	assert.NotNil(t, err)
+
+	writeConfig(t, "instance_mode: local\nlog_format: xml\n")
+	_, err = loadSnapshot()
+	assert.NotNil(t, err)
+}
+
+func TestReloadKeepsSnapshotOnError(t *testing.T) {
+	withConfig(t, "instance_mode: local\nforwarding_rate_limiting_count: 5\n")
+	withSnapshot(t, nil)
+
+	reloadSnapshot()
+	assert.Equal(t, 5, getSnapshot().RateLimitCount)
+
+	writeConfig(t, "instance_mode: local\nforwarding_subaddress_separator: \"#\"\n")
+	reloadSnapshot()
+	assert.Equal(t, 5, getSnapshot().RateLimitCount)
+	assert.Equal(t, "+", getSnapshot().SubaddressSeparator)
+
+	// the process doesn't exit on an unknown log level
+	writeConfig(t, "instance_mode: local\nlog_level: DEBG\n")
+	reloadSnapshot()
+	assert.Equal(t, 5, getSnapshot().RateLimitCount)
+}
+
+func TestReloadNewSessionsOnly(t *testing.T) {
+	withConfig(t, "instance_mode: local\n")
+	withSnapshot(t, nil)
+	reloadSnapshot()
+
+	addr := startTestServer(t, &Server{Snapshot: getSnapshot})
+	before := dialTestServer(t, addr)
+	cmd(t, before, 250, "NOOP")
+
+	writeConfig(t, "instance_mode: local\nforwarding_max_commands: 1\n")
+	reloadSnapshot()
+
+	after := dialTestServer(t, addr)
+	cmd(t, after, 250, "NOOP")
+	cmd(t, after, 421, "NOOP")
+
+	// the existing session keeps its snapshot
+	cmd(t, before, 250, "NOOP")
+	cmd(t, before, 250, "NOOP")
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"net/mail"
 	"strconv"
 	"strings"
 	"time"
@@ -20,14 +19,49 @@ const (
 	MATCH_LITERAL    MatchType = "literal"
 	MATCH_REGEX      MatchType = "regex"
 	MATCH_TIME_AFTER MatchType = "timeAfter"
+	MATCH_GREATER    MatchType = "greaterThan"
+	MATCH_LESS       MatchType = "lessThan"
 
 	FIELD_TO      MatchField = "to"
 	FIELD_FROM    MatchField = "from"
 	FIELD_SUBJECT MatchField = "subject"
+	// Decoded display name of the header From, "from" only has the address
+	FIELD_FROM_NAME MatchField = "from.name"
+	// Identity of the authenticated client, empty if it isn't
+	FIELD_AUTH MatchField = "auth"
+	// DNSBL zones listing the client, see forwarding_dnsbl_zones
+	FIELD_DNSBL MatchField = "dnsbl"
+	// HELO name of the client and its status, ok, invalid, not-fqdn, bare-ip,
+	// localhost, ours or mismatch
+	FIELD_HELO        MatchField = "helo"
+	FIELD_HELO_STATUS MatchField = "helo.status"
+	// Forward-confirmed reverse DNS of the client, empty if it's unknown
+	FIELD_FCRDNS MatchField = "fcrdns"
+	// "true" if the client talked before the greeting
+	FIELD_EARLY_TALKER MatchField = "early-talker"
+
+	// Subaddress parts of the recipient, ie user+tag@domain
+	FIELD_TO_LOCAL  MatchField = "to.local"
+	FIELD_TO_TAG    MatchField = "to.tag"
+	FIELD_TO_DOMAIN MatchField = "to.domain"
+
+	// Content fields, the MIME tree is only parsed when one of them is used
+	FIELD_BODY                    MatchField = "body"
+	FIELD_ATTACHMENT_FILENAME     MatchField = "attachment.filename"
+	FIELD_ATTACHMENT_CONTENT_TYPE MatchField = "attachment.content-type"
+	FIELD_ATTACHMENT_COUNT        MatchField = "attachment.count"
+	FIELD_SIZE                    MatchField = "size"
 
 	ACTION_DROP    ActionType = "drop"
 	ACTION_FORWARD ActionType = "forward"
 	ACTION_WEBHOOK ActionType = "webhook"
+	ACTION_LIST    ActionType = "list"
+
+	ACTION_OPTION_STRIP_TAG = "strip-tag"
+)
+
+var (
+	SUBADDRESS_SEPARATOR = "+"
 )
 
 type Match struct {
@@ -37,10 +71,23 @@ type Match struct {
 }
 
 // For Webhook the Action value is: [endpoint, secret token]
+// For List the Action value is: [list address]
+// For Forward a value of the form @domain keeps the recipient's local part
 type Action struct {
-	Type  ActionType `json:"type" yaml:"type"`
-	Value []string   `json:"value" yaml:"value"`
+	Type    ActionType `json:"type" yaml:"type"`
+	Value   []string   `json:"value" yaml:"value"`
+	Options []string   `json:"options" yaml:"options"`
 }
+
+func (a Action) HasOption(option string) bool {
+	for _, o := range a.Options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
 type RuleId string
 type Rule struct {
 	Id     RuleId   `json:"id" yaml:"id"`
@@ -68,37 +115,92 @@ type ActionWebhook struct {
 	SecretToken string
 }
 
+type ActionList struct {
+	Email Email
+	List  string
+}
+
 type ActionChans struct {
 	send    chan ActionSend
 	drop    chan ActionDrop
 	webhook chan ActionWebhook
+	list    chan ActionList
 
 	error chan error
+	// closed when the consumer stops reading the actions
+	done chan struct{}
 }
 
+// Returned by ApplyRules when the consumer stopped before the end of the
+// actions
+var errActionsAborted = errors.New("actions aborted")
+
 func MakeActionChans() ActionChans {
 	return ActionChans{
 		send:    make(chan ActionSend),
 		drop:    make(chan ActionDrop),
 		webhook: make(chan ActionWebhook),
+		list:    make(chan ActionList),
 		error:   make(chan error),
+		done:    make(chan struct{}),
 	}
 }
 
+// Stop reading the actions, ApplyRules returns instead of blocking on the
+// next one
+func (chans *ActionChans) Abort() {
+	close(chans.done)
+}
+
+// Send an action to the consumer, unless it stopped
+func (chans *ActionChans) emit(action interface{}) error {
+	switch a := action.(type) {
+	case ActionDrop:
+		select {
+		case chans.drop <- a:
+			return nil
+		case <-chans.done:
+		}
+	case ActionSend:
+		select {
+		case chans.send <- a:
+			return nil
+		case <-chans.done:
+		}
+	case ActionWebhook:
+		select {
+		case chans.webhook <- a:
+			return nil
+		case <-chans.done:
+		}
+	case ActionList:
+		select {
+		case chans.list <- a:
+			return nil
+		case <-chans.done:
+		}
+	}
+	return errActionsAborted
+}
+
 func (chans *ActionChans) Close() {
 	close(chans.send)
 	close(chans.drop)
 	close(chans.webhook)
+	close(chans.list)
 	close(chans.error)
 }
 
 func (chans *ActionChans) Error(e error) {
-	chans.error <- e
+	select {
+	case chans.error <- e:
+	case <-chans.done:
+	}
 	chans.Close()
 }
 
 func parseAddresses(v string) ([]string, error) {
-	e, err := mail.ParseAddressList(v)
+	e, err := addressParser.ParseList(v)
 	if err != nil {
 		return []string{}, errors.Wrapf(err, "failed to parse %s", v)
 	}
@@ -110,8 +212,74 @@ func parseAddresses(v string) ([]string, error) {
 	return out, nil
 }
 
+type Subaddress struct {
+	Local  string
+	Tag    string
+	Domain string
+}
+
+func parseSubaddress(addr string, separator string) Subaddress {
+	local, domain := splitAddress(addr)
+	tag := ""
+	if i := strings.Index(local, separator); i > 0 {
+		tag = local[i+len(separator):]
+		local = local[:i]
+	}
+	return Subaddress{Local: local, Tag: tag, Domain: domain}
+}
+
+func (email Email) subaddressSeparator() string {
+	if email.settings != nil {
+		return email.settings.SubaddressSeparator
+	}
+	return SUBADDRESS_SEPARATOR
+}
+
+func stripTag(addr string, separator string) string {
+	sub := parseSubaddress(addr, separator)
+	if sub.Domain == "" {
+		return sub.Local
+	}
+	return sub.Local + "@" + sub.Domain
+}
+
+// Resolve the forward destinations, destinations of the form @domain use the
+// local part of the recipient, without its tag with the strip-tag option. The
+// other destinations are used as configured.
+func getForwardDestinations(action Action, email Email) []string {
+	out := make([]string, len(action.Value))
+	for i, to := range action.Value {
+		if strings.HasPrefix(to, "@") && len(email.Envelope.To) > 0 {
+			local, _ := splitAddress(email.Envelope.To[0])
+			if action.HasOption(ACTION_OPTION_STRIP_TAG) {
+				local = stripTag(local, email.subaddressSeparator())
+			}
+			to = local + to
+		}
+		out[i] = to
+	}
+	return out
+}
+
 func getFieldRaw(field MatchField, email Email) ([]string, error) {
 	switch field {
+	case FIELD_TO_LOCAL, FIELD_TO_TAG, FIELD_TO_DOMAIN:
+		// the envelope recipients the message is delivered to, like
+		// strip-tag, the header To doesn't list the Bcc and list recipients
+		out := make([]string, len(email.Envelope.To))
+		for i, addr := range email.Envelope.To {
+			sub := parseSubaddress(addr, email.subaddressSeparator())
+			switch field {
+			case FIELD_TO_LOCAL:
+				out[i] = sub.Local
+			case FIELD_TO_TAG:
+				out[i] = sub.Tag
+			case FIELD_TO_DOMAIN:
+				out[i] = sub.Domain
+			}
+		}
+		return out, nil
+
 	case FIELD_TO:
 		if to := email.Data.Header.Get("To"); to != "" {
 			e, err := parseAddresses(to)
@@ -146,11 +314,72 @@ func getFieldRaw(field MatchField, email Email) ([]string, error) {
 		}
 		return e, nil
 
+	case FIELD_FROM_NAME:
+		from := email.Data.Header.Get("From")
+		if from == "" {
+			return []string{}, nil
+		}
+		e, err := addressParser.ParseList(from)
+		if err != nil {
+			log.Warnf("failed to parse header `from` %s", from)
+			return []string{}, nil
+		}
+		out := make([]string, len(e))
+		for i, addr := range e {
+			out[i] = addr.Name
+		}
+		return out, nil
+
 	case FIELD_SUBJECT:
-		subject := email.Data.Header.Get("Subject")
+		subject := decodeHeader(email.Data.Header.Get("Subject"))
 		e := []string{subject}
 		return e, nil
 
+	case FIELD_AUTH:
+		return []string{email.Envelope.Login}, nil
+
+	case FIELD_DNSBL:
+		return email.Envelope.DNSBL, nil
+
+	case FIELD_HELO:
+		return []string{email.Envelope.HELO}, nil
+
+	case FIELD_HELO_STATUS:
+		return []string{string(email.Envelope.HELOStatus)}, nil
+
+	case FIELD_FCRDNS:
+		return []string{email.Envelope.FCrDNS}, nil
+
+	case FIELD_EARLY_TALKER:
+		return []string{strconv.FormatBool(email.Envelope.EarlyTalker)}, nil
+
+	case FIELD_BODY, FIELD_ATTACHMENT_FILENAME, FIELD_ATTACHMENT_CONTENT_TYPE,
+		FIELD_ATTACHMENT_COUNT, FIELD_SIZE:
+		content, err := email.Content()
+		if err != nil {
+			return []string{}, errors.Wrap(err, "failed to get content")
+		}
+		switch field {
+		case FIELD_BODY:
+			return []string{content.Text}, nil
+		case FIELD_ATTACHMENT_FILENAME:
+			out := make([]string, len(content.Attachments))
+			for i, attachment := range content.Attachments {
+				out[i] = attachment.Filename
+			}
+			return out, nil
+		case FIELD_ATTACHMENT_CONTENT_TYPE:
+			out := make([]string, len(content.Attachments))
+			for i, attachment := range content.Attachments {
+				out[i] = attachment.ContentType
+			}
+			return out, nil
+		case FIELD_ATTACHMENT_COUNT:
+			return []string{strconv.Itoa(len(content.Attachments))}, nil
+		case FIELD_SIZE:
+			return []string{strconv.Itoa(content.Size)}, nil
+		}
+
 	}
 	return []string{}, errors.Errorf("field %s not supported\n", field)
 }
@@ -161,11 +390,42 @@ func getField(field MatchField, email Email) ([]string, error) {
 		return nil, err
 	}
 	for i, value := range values {
-		values[i] = strings.ToLower(value)
+		values[i] = normalize(value)
 	}
 	return values, nil
 }
 
+// Fields with multiple values (ie the attachments), a predicate matches if
+// any of them matches and doesn't match without value. The other fields keep
+// their original semantics: only the first value is compared and a field
+// without value matches.
+var multiValuedFields = map[MatchField]bool{
+	FIELD_DNSBL:                   true,
+	FIELD_TO_LOCAL:                true,
+	FIELD_TO_TAG:                  true,
+	FIELD_TO_DOMAIN:               true,
+	FIELD_ATTACHMENT_FILENAME:     true,
+	FIELD_ATTACHMENT_CONTENT_TYPE: true,
+}
+
+func anyMatch(field MatchField, vs []string, expected string, f func(string) bool) bool {
+	if !multiValuedFields[field] {
+		if len(vs) == 0 {
+			return true
+		}
+		vs = vs[:1]
+	}
+	for _, v := range vs {
+		if f(v) {
+			log.Debugf("%s ~= %s", v, expected)
+			// once matched, exit the loop now
+			return true
+		}
+		log.Debugf("%s != %s", v, expected)
+	}
+	return false
+}
+
 func HasMatch(predicates []Match, email Email) (bool, error) {
 	for _, predicate := range predicates {
 		switch predicate.Type {
@@ -188,30 +448,43 @@ func HasMatch(predicates []Match, email Email) (bool, error) {
 			if err != nil {
 				return false, errors.Wrap(err, "failed to match regex")
 			}
-			for _, v := range vs {
-				if !match.Match(v, predicate.Value) {
-					log.Debugf("%s != %s", v, predicate.Value)
-					return false, nil
-				} else {
-					log.Debugf("%s ~= %s", v, predicate.Value)
-					// once matched, exit the loop now
-					break
-				}
+			pattern := normalize(predicate.Value)
+			if !anyMatch(predicate.Field, vs, pattern, func(v string) bool {
+				return match.Match(v, pattern)
+			}) {
+				return false, nil
 			}
 		case MATCH_LITERAL:
 			vs, err := getField(predicate.Field, email)
 			if err != nil {
 				return false, errors.Wrap(err, "failed to match literal")
 			}
-			for _, v := range vs {
-				if v != predicate.Value {
-					log.Debugf("%s != %s", v, predicate.Value)
-					return false, nil
-				} else {
-					log.Debugf("%s == %s", v, predicate.Value)
-					// once matched, exit the loop now
-					break
+			expected := normalize(predicate.Value)
+			if !anyMatch(predicate.Field, vs, expected, func(v string) bool {
+				return v == expected
+			}) {
+				return false, nil
+			}
+		case MATCH_GREATER, MATCH_LESS:
+			limit, err := strconv.ParseInt(predicate.Value, 10, 64)
+			if err != nil {
+				return false, errors.Wrap(err, "could not parse int")
+			}
+			vs, err := getField(predicate.Field, email)
+			if err != nil {
+				return false, errors.Wrap(err, "failed to match number")
+			}
+			if !anyMatch(predicate.Field, vs, predicate.Value, func(v string) bool {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return false
 				}
+				if predicate.Type == MATCH_GREATER {
+					return n > limit
+				}
+				return n < limit
+			}) {
+				return false, nil
 			}
 
 		default:
@@ -233,20 +506,38 @@ func ApplyRules(rules []Rule, email Email, chans ActionChans) (*RuleId, error) {
 			for _, action := range rule.Action {
 				switch action.Type {
 				case ACTION_DROP:
-					chans.drop <- ActionDrop{DroppedRule: true}
+					if err := chans.emit(ActionDrop{DroppedRule: true}); err != nil {
+						return nil, err
+					}
 				case ACTION_WEBHOOK:
 					if len(action.Value) != 2 {
-						return nil, errors.Errorf(
+						e := errors.Errorf(
 							"invalid webhook configuration, expected 2 params got %d", len(action.Value))
+						chans.Error(e)
+						return nil, e
 					}
-					chans.webhook <- ActionWebhook{
+					if err := chans.emit(ActionWebhook{
 						Email:       email,
 						Endpoint:    action.Value[0],
 						SecretToken: action.Value[1],
+					}); err != nil {
+						return nil, err
 					}
 				case ACTION_FORWARD:
-					for _, to := range action.Value {
-						chans.send <- ActionSend{Email: email, To: to}
+					for _, to := range getForwardDestinations(action, email) {
+						if err := chans.emit(ActionSend{Email: email, To: to}); err != nil {
+							return nil, err
+						}
+					}
+				case ACTION_LIST:
+					if len(action.Value) != 1 {
+						e := errors.Errorf(
+							"invalid list configuration, expected 1 param got %d", len(action.Value))
+						chans.Error(e)
+						return nil, e
+					}
+					if err := chans.emit(ActionList{Email: email, List: action.Value[0]}); err != nil {
+						return nil, err
 					}
 				default:
 					e := errors.Errorf("action %s isn't supported\n", action)
@@ -258,6 +549,8 @@ func ApplyRules(rules []Rule, email Email, chans ActionChans) (*RuleId, error) {
 		}
 	}
 
-	chans.drop <- ActionDrop{DroppedRule: false}
+	if err := chans.emit(ActionDrop{DroppedRule: false}); err != nil {
+		return nil, err
+	}
 	return nil, nil
 }
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
+	"io"
 	"net/mail"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,29 +16,27 @@ func init() {
 	log.SetLevel(log.DebugLevel)
 }
 
+func makeRaw(body string) *io.SectionReader {
+	return io.NewSectionReader(strings.NewReader(body), 0, int64(len(body)))
+}
+
 func makeEmail(body string) Email {
-	msg, err := mail.ReadMessage(bytes.NewReader([]byte(body)))
+	msg, err := mail.ReadMessage(strings.NewReader(body))
 	if err != nil {
 		panic(err)
 	}
 
 	from := msg.Header.Get("From")
 	to := msg.Header.Get("To")
-	return Email{
-		Envelope: EmailEnvelope{from, []string{to}},
-		Data:     msg,
-	}
+	return NewEmail(EmailEnvelope{From: from, To: []string{to}}, msg, makeRaw(body))
 }
 
 func makeEmailWithEnvelope(body, to, from string) Email {
-	msg, err := mail.ReadMessage(bytes.NewReader([]byte(body)))
+	msg, err := mail.ReadMessage(strings.NewReader(body))
 	if err != nil {
 		panic(err)
 	}
-	return Email{
-		Envelope: EmailEnvelope{from, []string{to}},
-		Data:     msg,
-	}
+	return NewEmail(EmailEnvelope{From: from, To: []string{to}}, msg, makeRaw(body))
 }
 
 func TestDropByDefault(t *testing.T) {
@@ -140,6 +139,41 @@ Hello world!
 	assert.Equal(t, <-chans.send, ActionSend{To: "b", Email: email}, "Mail was not sent")
 }
 
+func TestApplyRulesAborted(t *testing.T) {
+	rules := []Rule{
+		{
+			Match: []Match{
+				{Type: MATCH_ALL},
+			},
+			Action: []Action{
+				{Type: ACTION_FORWARD, Value: []string{"a", "b"}},
+			},
+		},
+	}
+	chans := MakeActionChans()
+	email := makeEmail(`From: sven@b.ee
+To: sven@gmail.com
+Subject: test
+
+Hello world!
+	`)
+
+	errs := make(chan error)
+	go func() {
+		_, err := ApplyRules(rules, email, chans)
+		errs <- err
+	}()
+	assert.Equal(t, <-chans.send, ActionSend{To: "a", Email: email}, "Mail was not sent")
+	// the consumer stops after the first action
+	chans.Abort()
+	select {
+	case err := <-errs:
+		assert.Equal(t, errActionsAborted, err)
+	case <-time.After(time.Second):
+		t.Fatal("ApplyRules is still blocked")
+	}
+}
+
 func TestRespectRuleOrder(t *testing.T) {
 	rules := []Rule{
 		{
@@ -694,3 +728,293 @@ Hello world!
 	assert.Nil(t, err)
 	assert.Equal(t, v, false)
 }
+
+func TestRunListAction(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: team@test.com
+Subject: test
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`)
+
+	rules := []Rule{
+		{
+			Match: []Match{
+				{Type: MATCH_ALL},
+			},
+			Action: []Action{
+				{Type: ACTION_LIST, Value: []string{"team@test.com"}},
+			},
+		},
+	}
+	chans := MakeActionChans()
+
+	go func() {
+		_, err := ApplyRules(rules, email, chans)
+		assert.Equal(t, err, nil, "ApplyRules return an error")
+	}()
+	assert.Equal(t, <-chans.list, ActionList{Email: email, List: "team@test.com"}, "list was not expanded")
+}
+
+func TestInvalidListAction(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: team@test.com
+Subject: test
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`)
+
+	rules := []Rule{
+		{
+			Match: []Match{
+				{Type: MATCH_ALL},
+			},
+			Action: []Action{
+				{Type: ACTION_LIST, Value: []string{}},
+			},
+		},
+	}
+	chans := MakeActionChans()
+
+	go func() {
+		_, err := ApplyRules(rules, email, chans)
+		assert.NotNil(t, err)
+	}()
+	assert.NotNil(t, <-chans.error, "invalid list was accepted")
+}
+
+func TestMatchFieldToSubaddress(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: User+Shop@test.com
+Subject: test
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`)
+
+	matches := []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_TO_LOCAL, Value: "user"},
+		{Type: MATCH_LITERAL, Field: FIELD_TO_TAG, Value: "shop"},
+		{Type: MATCH_LITERAL, Field: FIELD_TO_DOMAIN, Value: "test.com"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+
+	matches = []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_TO_TAG, Value: "bank"},
+	}
+	v, err = HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, false)
+}
+
+func TestMatchFieldToSubaddressBcc(t *testing.T) {
+	email := makeEmailWithEnvelope(`From: sven@b.ee
+To: team@lists.example.com
+Subject: test
+
+Hello world!
+	`, "user+shop@test.com", "sven@b.ee")
+
+	// the envelope recipient, not the header
+	matches := []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_TO_LOCAL, Value: "user"},
+		{Type: MATCH_LITERAL, Field: FIELD_TO_TAG, Value: "shop"},
+		{Type: MATCH_LITERAL, Field: FIELD_TO_DOMAIN, Value: "test.com"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
+
+func TestMatchFieldToSubaddressSeparator(t *testing.T) {
+	SUBADDRESS_SEPARATOR = "-"
+	defer func() { SUBADDRESS_SEPARATOR = "+" }()
+
+	email := makeEmail(`From: sven@b.ee
+To: user-shop@test.com
+Subject: test
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`)
+
+	matches := []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_TO_LOCAL, Value: "user"},
+		{Type: MATCH_LITERAL, Field: FIELD_TO_TAG, Value: "shop"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
+
+func TestMatchFieldToNoSubaddress(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: user@test.com
+Subject: test
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`)
+
+	matches := []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_TO_LOCAL, Value: "user"},
+		{Type: MATCH_LITERAL, Field: FIELD_TO_TAG, Value: ""},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
+
+func TestForwardStripTag(t *testing.T) {
+	email := makeEmailWithEnvelope(`From: sven@b.ee
+To: user+shop@test.com
+Subject: test
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`, "user+shop@test.com", "sven@b.ee")
+
+	rules := []Rule{
+		{
+			Match: []Match{
+				{Type: MATCH_ALL},
+			},
+			Action: []Action{
+				{
+					Type:    ACTION_FORWARD,
+					Value:   []string{"@dest.com", "me+fwd@a.com"},
+					Options: []string{ACTION_OPTION_STRIP_TAG},
+				},
+			},
+		},
+	}
+	chans := MakeActionChans()
+
+	go func() {
+		_, err := ApplyRules(rules, email, chans)
+		assert.Equal(t, err, nil, "ApplyRules return an error")
+	}()
+	assert.Equal(t, <-chans.send, ActionSend{Email: email, To: "user@dest.com"}, "Mail was not forwarded")
+	// the configured destinations are kept
+	assert.Equal(t, <-chans.send, ActionSend{Email: email, To: "me+fwd@a.com"}, "Mail was not forwarded")
+}
+
+func TestForwardKeepTag(t *testing.T) {
+	email := makeEmailWithEnvelope(`From: sven@b.ee
+To: user+shop@test.com
+Subject: test
+Date: Sun, 8 Jan 2017 20:37:44 +0200
+
+Hello world!
+	`, "user+shop@test.com", "sven@b.ee")
+
+	rules := []Rule{
+		{
+			Match: []Match{
+				{Type: MATCH_ALL},
+			},
+			Action: []Action{
+				{Type: ACTION_FORWARD, Value: []string{"@dest.com"}},
+			},
+		},
+	}
+	chans := MakeActionChans()
+
+	go func() {
+		_, err := ApplyRules(rules, email, chans)
+		assert.Equal(t, err, nil, "ApplyRules return an error")
+	}()
+	assert.Equal(t, <-chans.send, ActionSend{Email: email, To: "user+shop@dest.com"}, "Mail was not forwarded")
+}
+
+func TestMatchFieldAuth(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: a@gmail.com
+Subject: test
+
+Hello world!
+	`)
+
+	matches := []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_AUTH, Value: "relay.example.com"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, false)
+
+	email.Envelope.Login = "relay.example.com"
+	v, err = HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
+
+func TestMatchFieldDNSBL(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: a@gmail.com
+Subject: test
+
+Hello world!
+	`)
+
+	matches := []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_DNSBL, Value: "zen.spamhaus.org"},
+	}
+	v, err := HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, false)
+
+	email.Envelope.DNSBL = []string{"bl.spamcop.net", "zen.spamhaus.org"}
+	v, err = HasMatch(matches, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
+
+func TestMatchFieldFirstValue(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: a@gmail.com, b@gmail.com
+Subject: test
+
+Hello world!
+	`)
+
+	// the original fields only compare their first value
+	v, err := HasMatch([]Match{{Type: MATCH_LITERAL, Field: FIELD_TO, Value: "a@gmail.com"}}, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+	v, err = HasMatch([]Match{{Type: MATCH_LITERAL, Field: FIELD_TO, Value: "b@gmail.com"}}, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, false)
+
+	// the multi-valued fields match any value
+	email.Envelope.To = []string{"a@gmail.com", "b@gmail.com"}
+	v, err = HasMatch([]Match{{Type: MATCH_LITERAL, Field: FIELD_TO_LOCAL, Value: "b"}}, email)
+	assert.Nil(t, err)
+	assert.Equal(t, v, true)
+}
+
+func TestMatchFieldClientChecks(t *testing.T) {
+	email := makeEmail(`From: sven@b.ee
+To: a@gmail.com
+Subject: test
+
+Hello world!
+	`)
+	email.Envelope.HELO = "workstation"
+	email.Envelope.HELOStatus = HELO_NOT_FQDN
+	email.Envelope.EarlyTalker = true
+
+	for _, match := range []Match{
+		{Type: MATCH_LITERAL, Field: FIELD_HELO, Value: "workstation"},
+		{Type: MATCH_LITERAL, Field: FIELD_HELO_STATUS, Value: "not-fqdn"},
+		{Type: MATCH_LITERAL, Field: FIELD_FCRDNS, Value: ""},
+		{Type: MATCH_LITERAL, Field: FIELD_EARLY_TALKER, Value: "true"},
+	} {
+		v, err := HasMatch([]Match{match}, email)
+		assert.Nil(t, err)
+		assert.Equal(t, v, true, match.Field)
+	}
+}
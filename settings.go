@@ -0,0 +1,254 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mailway-app/config"
+
+	"github.com/pkg/errors"
+)
+
+// declare as var to be able to replace it in testing
+var CONFIG_LOCATION = config.CONFIG_LOCATION
+
+// Forwarding specific settings, read from the same conf.d files as
+// config.Config. Unknown keys are ignored by both.
+type Settings struct {
+	SubaddressSeparator string   `yaml:"forwarding_subaddress_separator"`
+	ProxyProtocol       bool     `yaml:"forwarding_proxy_protocol"`
+	TrustedNetworks     []string `yaml:"forwarding_trusted_networks"`
+
+	MaxConnections      int           `yaml:"forwarding_max_connections"`
+	MaxConnectionsPerIP int           `yaml:"forwarding_max_connections_per_ip"`
+	MaxCommands         int           `yaml:"forwarding_max_commands"`
+	MaxMessages         int           `yaml:"forwarding_max_messages"`
+	TarpitAfter         int           `yaml:"forwarding_tarpit_after"`
+	TarpitDelay         time.Duration `yaml:"forwarding_tarpit_delay"`
+	MetricsAddr         string        `yaml:"forwarding_metrics_addr"`
+
+	TLSCert          string   `yaml:"forwarding_tls_cert"`
+	TLSKey           string   `yaml:"forwarding_tls_key"`
+	TLSKeyPassphrase string   `yaml:"forwarding_tls_key_passphrase"`
+	TLSCertDir       string   `yaml:"forwarding_tls_cert_dir"`
+	TLSMinVersion    string   `yaml:"forwarding_tls_min_version"`
+	TLSCiphers       []string `yaml:"forwarding_tls_ciphers"`
+	TLSClientCA      string   `yaml:"forwarding_tls_client_ca"`
+
+	Listeners      []ListenerSettings `yaml:"forwarding_listeners"`
+	SubmissionAddr string             `yaml:"forwarding_submission_addr"` // for example ":587"
+
+	Greylisting         bool          `yaml:"forwarding_greylisting"`
+	GreylistingDelay    time.Duration `yaml:"forwarding_greylisting_delay"`
+	GreylistingExpiry   time.Duration `yaml:"forwarding_greylisting_expiry"`
+	GreylistingNetworks []string      `yaml:"forwarding_greylisting_networks"` // never greylisted
+	GreylistingFile     string        `yaml:"forwarding_greylisting_file"`
+
+	DNSBLZones     []DNSBLZoneSettings `yaml:"forwarding_dnsbl_zones"`
+	DNSBLThreshold int                 `yaml:"forwarding_dnsbl_threshold"`
+	DNSBLReject    bool                `yaml:"forwarding_dnsbl_reject"` // clients reaching the threshold
+	DNSBLCacheTTL  time.Duration       `yaml:"forwarding_dnsbl_cache_ttl"`
+	DNSBLResolver  string              `yaml:"forwarding_dnsbl_resolver"` // for example "127.0.0.1:53"
+
+	Resolver             string        `yaml:"forwarding_resolver"` // for example "127.0.0.1:53"
+	GreetDelay           time.Duration `yaml:"forwarding_greet_delay"`
+	RejectEarlyTalkers   bool          `yaml:"forwarding_reject_early_talkers"`
+	RejectInvalidHELO    bool          `yaml:"forwarding_reject_invalid_helo"`
+	FCrDNS               bool          `yaml:"forwarding_fcrdns"`
+	RejectUnknownClients bool          `yaml:"forwarding_reject_unknown_clients"` // without forward-confirmed reverse DNS
+
+	RateLimits       []RateLimit `yaml:"forwarding_rate_limits"`
+	RateLimitBackend string      `yaml:"forwarding_rate_limit_backend"` // memory, disk or redis
+	RateLimitFile    string      `yaml:"forwarding_rate_limit_file"`    // of the disk backend
+	RateLimitRedis   string      `yaml:"forwarding_rate_limit_redis"`   // for example "redis://:password@127.0.0.1:6379/0"
+
+	NoDedup   bool          `yaml:"forwarding_no_dedup"`
+	DedupTTL  time.Duration `yaml:"forwarding_dedup_ttl"` // processed messages are remembered
+	DedupFile string        `yaml:"forwarding_dedup_file"`
+}
+
+type DNSBLZoneSettings struct {
+	Zone   string `yaml:"zone"` // for example "zen.spamhaus.org"
+	Weight int    `yaml:"weight"`
+}
+
+type ListenerSettings struct {
+	Name          string `yaml:"name"`
+	Network       string `yaml:"network"`
+	Address       string `yaml:"address"`
+	Mode          string `yaml:"mode"` // octal, for example "0660"
+	TLS           string `yaml:"tls"`
+	TLSRequired   bool   `yaml:"tls_required"`
+	AuthRequired  bool   `yaml:"auth_required"`
+	LMTP          bool   `yaml:"lmtp"`
+	ClientAuth    bool   `yaml:"client_auth"`
+	Submission    bool   `yaml:"submission"`
+	ProxyProtocol bool   `yaml:"proxy_protocol"`
+}
+
+func (l *ListenerSettings) Listener() (Listener, error) {
+	listener := Listener{
+		Name:          l.Name,
+		Network:       l.Network,
+		Addr:          l.Address,
+		TLS:           TLSMode(l.TLS),
+		TLSRequired:   l.TLSRequired,
+		AuthRequired:  l.AuthRequired || l.Submission,
+		LMTP:          l.LMTP,
+		ClientAuth:    l.ClientAuth,
+		Submission:    l.Submission,
+		ProxyProtocol: l.ProxyProtocol,
+	}
+	if listener.Network == "" {
+		listener.Network = "tcp"
+	}
+	if l.Mode != "" {
+		mode, err := strconv.ParseUint(l.Mode, 8, 32)
+		if err != nil || mode > 0777 {
+			return listener, errors.Errorf("listener %s: invalid mode %s", &listener, l.Mode)
+		}
+		listener.Mode = os.FileMode(mode)
+	}
+	return listener, listener.Validate()
+}
+
+func readConfigFiles() ([]byte, error) {
+	data := []byte{}
+
+	files, err := ioutil.ReadDir(CONFIG_LOCATION)
+	if err != nil {
+		return data, err
+	}
+
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if ext == ".yml" || ext == ".yaml" {
+			content, err := ioutil.ReadFile(path.Join(CONFIG_LOCATION, file.Name()))
+			if err != nil {
+				return data, err
+			}
+			data = append(data, content...)
+		}
+	}
+	return data, nil
+}
+
+func (s *Settings) Validate() error {
+	switch s.SubaddressSeparator {
+	case "", "+", "-":
+	default:
+		return errors.Errorf("invalid subaddress separator: '%s'", s.SubaddressSeparator)
+	}
+	if _, err := parseNetworks(s.TrustedNetworks); err != nil {
+		return err
+	}
+	if (s.TLSCert == "") != (s.TLSKey == "") {
+		return errors.New("TLS certificate and key go together")
+	}
+	if s.TLSClientCA != "" && s.TLSCert == "" && s.TLSCertDir == "" {
+		return errors.New("TLS client CA needs a certificate")
+	}
+	if _, err := parseTLSVersion(s.TLSMinVersion); err != nil {
+		return err
+	}
+	if _, err := parseCipherSuites(s.TLSCiphers); err != nil {
+		return err
+	}
+	if _, err := s.GetListeners(""); err != nil {
+		return err
+	}
+	if s.MaxConnections < 0 || s.MaxConnectionsPerIP < 0 || s.MaxCommands < 0 ||
+		s.MaxMessages < 0 || s.TarpitAfter < 0 || s.TarpitDelay < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if s.GreylistingDelay < 0 || s.GreylistingExpiry < 0 {
+		return errors.New("greylisting delay and expiry can't be negative")
+	}
+	if _, err := parseNetworks(s.GreylistingNetworks); err != nil {
+		return err
+	}
+	for _, zone := range s.DNSBLZones {
+		if zone.Zone == "" || zone.Weight < 0 {
+			return errors.Errorf("invalid DNSBL zone '%s' with weight %d", zone.Zone, zone.Weight)
+		}
+	}
+	if s.DNSBLThreshold < 0 || s.DNSBLCacheTTL < 0 {
+		return errors.New("DNSBL threshold and cache TTL can't be negative")
+	}
+	for _, resolver := range []string{s.DNSBLResolver, s.Resolver} {
+		if resolver == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			return errors.Wrapf(err, "invalid resolver %s", resolver)
+		}
+	}
+	if s.GreetDelay < 0 {
+		return errors.New("greeting delay can't be negative")
+	}
+	for _, limit := range s.RateLimits {
+		if err := limit.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.DedupTTL < 0 {
+		return errors.New("deduplication TTL can't be negative")
+	}
+	switch s.RateLimitBackend {
+	case "", RATE_BACKEND_MEMORY, RATE_BACKEND_DISK:
+	case RATE_BACKEND_REDIS:
+		if _, err := newRedisClient(s.RateLimitRedis); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("invalid rate limit backend '%s'", s.RateLimitBackend)
+	}
+	return nil
+}
+
+func (s *Settings) Limits() Limits {
+	return Limits{
+		MaxConnections:      s.MaxConnections,
+		MaxConnectionsPerIP: s.MaxConnectionsPerIP,
+		MaxCommands:         s.MaxCommands,
+		MaxMessages:         s.MaxMessages,
+		TarpitAfter:         s.TarpitAfter,
+		TarpitDelay:         s.TarpitDelay,
+	}
+}
+
+// The configured listeners, or a single TCP listener on defaultAddr, and the
+// submission listener
+func (s *Settings) GetListeners(defaultAddr string) ([]Listener, error) {
+	listeners := make([]Listener, 0, len(s.Listeners)+1)
+	if len(s.Listeners) == 0 {
+		listeners = append(listeners, Listener{
+			Network:       "tcp",
+			Addr:          defaultAddr,
+			ProxyProtocol: s.ProxyProtocol,
+		})
+	}
+	for _, l := range s.Listeners {
+		listener, err := l.Listener()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if s.SubmissionAddr != "" {
+		listeners = append(listeners, Listener{
+			Name:         "submission",
+			Network:      "tcp",
+			Addr:         s.SubmissionAddr,
+			TLSRequired:  true,
+			AuthRequired: true,
+			Submission:   true,
+		})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const SHUTDOWN_POLL_INTERVAL = 100 * time.Millisecond
+
+// Returned by Serve once Shutdown has been called
+var ErrServerClosed = errors.New("smtpd: server closed")
+
+// Listeners and sessions of a server, needed for the shutdown
+type serverState struct {
+	sync.Mutex
+	shutdown  bool
+	listeners map[net.Listener]struct{}
+	// the connection as accepted, before any STARTTLS
+	sessions map[*session]net.Conn
+	idle     map[*session]bool
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.state.Lock()
+	defer srv.state.Unlock()
+	return srv.state.shutdown
+}
+
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.state.Lock()
+	defer srv.state.Unlock()
+	if !add {
+		delete(srv.state.listeners, ln)
+		return true
+	}
+	if srv.state.shutdown {
+		return false
+	}
+	if srv.state.listeners == nil {
+		srv.state.listeners = make(map[net.Listener]struct{})
+	}
+	srv.state.listeners[ln] = struct{}{}
+	return true
+}
+
+func (srv *Server) trackSession(s *session, add bool) {
+	srv.state.Lock()
+	defer srv.state.Unlock()
+	if !add {
+		delete(srv.state.sessions, s)
+		delete(srv.state.idle, s)
+		return
+	}
+	if srv.state.sessions == nil {
+		srv.state.sessions = make(map[*session]net.Conn)
+		srv.state.idle = make(map[*session]bool)
+	}
+	srv.state.sessions[s] = s.conn
+}
+
+// Mark the session as waiting for a command, idle sessions are closed on
+// shutdown. Returns false if the session should be closed now.
+func (srv *Server) setIdle(s *session, idle bool) bool {
+	srv.state.Lock()
+	defer srv.state.Unlock()
+	if idle && srv.state.shutdown {
+		return false
+	}
+	if _, ok := srv.state.sessions[s]; ok {
+		srv.state.idle[s] = idle
+	}
+	return true
+}
+
+// Interrupt the read of the idle sessions, they reply 421 and exit. Returns
+// the number of sessions left.
+func (srv *Server) closeIdleSessions() int {
+	srv.state.Lock()
+	defer srv.state.Unlock()
+	for s, conn := range srv.state.sessions {
+		if srv.state.idle[s] {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	return len(srv.state.sessions)
+}
+
+func (srv *Server) closeSessions() {
+	srv.state.Lock()
+	defer srv.state.Unlock()
+	for _, conn := range srv.state.sessions {
+		conn.Close()
+	}
+}
+
+// Shutdown stops accepting connections, closes the idle sessions and waits
+// for the mail transactions in progress and the background workers to
+// finish. Once the context is done, the remaining sessions are closed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.state.Lock()
+	srv.state.shutdown = true
+	for ln := range srv.state.listeners {
+		ln.Close()
+	}
+	srv.state.Unlock()
+
+	// sessions can become idle at any time, check them periodically
+	ticker := time.NewTicker(SHUTDOWN_POLL_INTERVAL)
+	defer ticker.Stop()
+	for srv.closeIdleSessions() > 0 {
+		select {
+		case <-ctx.Done():
+			srv.closeSessions()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	if srv.Workers == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.Workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
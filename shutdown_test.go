@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mailway-app/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownMidData(t *testing.T) {
+	withBufferLocation(t)
+
+	var workers sync.WaitGroup
+	var delivered int32
+	srv := &Server{
+		Workers:     &workers,
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			_, err := ioutil.ReadAll(data)
+			assert.Nil(t, err)
+			// background delivery, still running when the session ends
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				time.Sleep(200 * time.Millisecond)
+				atomic.StoreInt32(&delivered, 1)
+			}()
+			return nil
+		},
+	}
+	served := make(chan error, 1)
+	addr := startTestServer(t, srv, withServed(served))
+
+	idle := dialTestServer(t, addr)
+	cmd(t, idle, 250, "EHLO idle.local")
+
+	c := dialTestServer(t, addr)
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 354, "DATA")
+	w := c.DotWriter()
+	_, err := io.WriteString(w, "Subject: test\r\n\r\nHello")
+	assert.Nil(t, err)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	// idle sessions are closed and new connections refused
+	_, _, err = idle.ReadResponse(421)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrServerClosed, <-served)
+	_, err = net.Dial("tcp", addr)
+	assert.NotNil(t, err)
+
+	// the transaction in progress completes
+	_, err = io.WriteString(w, " world\r\n")
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+	_, _, err = c.ReadResponse(250)
+	assert.Nil(t, err)
+	_, _, err = c.ReadResponse(421)
+	assert.Nil(t, err)
+
+	assert.Nil(t, <-shutdown)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&delivered))
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	withBufferLocation(t)
+
+	srv := &Server{
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			return nil
+		},
+	}
+	addr := startTestServer(t, srv)
+
+	c := dialTestServer(t, addr)
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 354, "DATA")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+
+	// the session is closed without reply
+	_, err := c.ReadLine()
+	assert.NotNil(t, err)
+	for srv.closeIdleSessions() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	srv := &Server{}
+	assert.Nil(t, srv.Shutdown(context.Background()))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrServerClosed, srv.Serve(ln, &config.Config{}))
+}
@@ -1,25 +1,28 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
+	"expvar"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/mail"
-	"net/smtp"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mailway-app/config"
-	"github.com/mailway-app/golib/rate"
 
 	"github.com/google/uuid"
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
 )
 
 type DomainStatus int
@@ -32,8 +35,10 @@ const (
 )
 
 type Domain struct {
-	Name   string       `json:"name"`
-	Status DomainStatus `json:"status"`
+	Name          string       `json:"name"`
+	Status        DomainStatus `json:"status"`
+	NoGreylisting bool         `json:"no_greylisting"` // opted out of greylisting
+	RateLimits    []RateLimit  `json:"rate_limits"`    // of the domain and recipient keys, replace the default limits of the same key
 }
 
 const (
@@ -46,10 +51,23 @@ const (
 var (
 	LOOP_DETECTION_COUNT = 25
 	RATE_LIMIT_COUNT     = 100
+
+	// declare as var to be able to replace it in testing
+	BUFFER_LOCATION = config.RUNTIME_LOCATION
+
+	// peers allowed to send the PROXY protocol header and XCLIENT
+	TRUSTED_NETWORKS = []string{"127.0.0.0/8", "::1/128"}
+
+	// time given to the transactions in progress on SIGTERM
+	SHUTDOWN_TIMEOUT = time.Minute
 )
 
 func hasLoop(email *Email) bool {
-	return len(email.Data.Header["Received"]) > LOOP_DETECTION_COUNT
+	max := LOOP_DETECTION_COUNT
+	if email.settings != nil {
+		max = email.settings.LoopDetectionCount
+	}
+	return len(email.Data.Header["Received"]) > max
 }
 
 func runSpamassassin(file string) error {
@@ -76,8 +94,12 @@ var (
 	processingError = errors.New("451 4.3.0 Internal server errror")
 	configError     = errors.New("451 4.3.5 Internal server errror")
 	rateError       = errors.New("450 4.4.2 Temporarily rate limited; suspicious behavior")
+	rcptError       = errors.New("550 5.1.0 Requested action not taken: mailbox unavailable")
+	senderError     = errors.New("553 5.7.1 Sender address rejected: not owned by user")
+	greylistError   = errors.New("451 4.7.1 Greylisted, please try again later")
 
-	rateLimiter = rate.NewRaterLimiter()
+	// background deliveries still running after the SMTP transaction
+	deliveryWorkers sync.WaitGroup
 )
 
 var (
@@ -96,7 +118,11 @@ func parseAddress(v string) (*Address, error) {
 		return nil, err
 	}
 
-	domain := strings.Split(e.Address, "@")[1]
+	_, domain := splitAddress(e.Address)
+	domain, err = normalizeDomain(domain)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Address{
 		e,
@@ -104,6 +130,16 @@ func parseAddress(v string) (*Address, error) {
 	}, nil
 }
 
+// normalizeDomain returns the lowercased ASCII (punycode) form of a domain, so
+// that bücher.de and xn--bcher-kva.de are the same domain.
+func normalizeDomain(domain string) (string, error) {
+	ascii, err := idna.Lookup.ToASCII(strings.ToLower(domain))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid domain %s", domain)
+	}
+	return ascii, nil
+}
+
 func (s *session) makeMailHeader(rcptTo []string, mailFrom string) string {
 	headers := []string{
 		// Preserve SMTP Mail From and RCPT to
@@ -115,13 +151,20 @@ func (s *session) makeMailHeader(rcptTo []string, mailFrom string) string {
 		"Mw-Int-Date: " + fmt.Sprintf("%d", time.Now().Unix()),
 		"Mw-Int-Via: forwarding",
 	}
+	if s.dnsbl != nil && len(s.dnsbl.Listed) > 0 {
+		headers = append(headers, DNSBL_HEADER+": "+s.dnsbl.String())
+	}
 	return strings.Join(headers, CRLF)
 }
 
+func (s *session) bufferName() string {
+	return fmt.Sprintf("%s/%s.eml", BUFFER_LOCATION, s.id.String())
+}
+
 func (s *session) newBuffer() (*os.File, error) {
-	name := fmt.Sprintf("%s/%s.eml", config.RUNTIME_LOCATION, s.id.String())
+	name := s.bufferName()
 	log.Debugf("create file buffer %s", name)
-	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0755)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
 		log.Errorf("newBuffer: could not create temporary file: %s", err)
 		return nil, unknownError
@@ -130,18 +173,54 @@ func (s *session) newBuffer() (*os.File, error) {
 	return f, nil
 }
 
-func (s *session) readBuffer() ([]byte, error) {
-	name := fmt.Sprintf("%s/%s.eml", config.RUNTIME_LOCATION, s.id.String())
-	data, err := ioutil.ReadFile(name)
+// File buffer opened for reading
+type bufferReader struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r *bufferReader) Close() error {
+	return r.file.Close()
+}
+
+// Open the file buffer for reading, the previously opened buffer is closed.
+// The file stays open until closeBuffer.
+func (s *session) readBuffer() (*io.SectionReader, error) {
+	s.closeBuffer()
+	r, err := s.openBuffer()
 	if err != nil {
-		log.Errorf("readBuffer: could not read temporary file: %s", err)
+		return nil, err
+	}
+	s.buffer = r
+	return r.SectionReader, nil
+}
+
+// Open the file buffer with a file handle owned by the caller, ie to read the
+// buffer after the end of the SMTP transaction.
+func (s *session) openBuffer() (*bufferReader, error) {
+	f, err := os.Open(s.bufferName())
+	if err != nil {
+		log.Errorf("readBuffer: could not open temporary file: %s", err)
 		return nil, unknownError
 	}
-	return data, nil
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		log.Errorf("readBuffer: could not stat temporary file: %s", err)
+		return nil, unknownError
+	}
+	return &bufferReader{io.NewSectionReader(f, 0, info.Size()), f}, nil
+}
+
+func (s *session) closeBuffer() {
+	if s.buffer != nil {
+		s.buffer.Close()
+		s.buffer = nil
+	}
 }
 
 func deleteBuffer(s *session) {
-	name := fmt.Sprintf("%s/%s.eml", config.RUNTIME_LOCATION, s.id.String())
+	name := s.bufferName()
 	log.Debugf("delete file buffer %s", name)
 	if err := os.Remove(name); err != nil {
 		log.Errorf("deleteBuffer: could not delete temporary file: %s", err)
@@ -149,7 +228,7 @@ func deleteBuffer(s *session) {
 }
 
 func getDomainRules(instance *config.Config, domain string) (DomainRules, error) {
-	if config.CurrConfig.IsInstanceLocal() {
+	if instance.IsInstanceLocal() {
 		return getLocalDomainRules(instance, domain)
 	} else {
 		return getAPIDomainRules(instance, domain)
@@ -157,107 +236,318 @@ func getDomainRules(instance *config.Config, domain string) (DomainRules, error)
 }
 
 func getDomainConfig(instance *config.Config, domain string) (*Domain, error) {
-	if config.CurrConfig.IsInstanceLocal() {
+	if instance.IsInstanceLocal() {
 		return getLocalDomainConfig(instance, domain)
 	} else {
 		return getAPIDomainConfig(instance, domain)
 	}
 }
 
-func rcptHandler(session *session, from string, to string) bool {
+func rcptHandler(session *session, from string, to string) error {
+	if session.listener.Submission {
+		return submissionRcptHandler(session, from, to)
+	}
 	e, err := parseAddress(to)
 	if err != nil {
 		log.Errorf("rcptHandler: failed to parse to: %s", err)
-		return false
+		return rcptError
 	}
 	config, err := getDomainConfig(session.config, e.domain)
 	if err != nil {
 		log.Errorf("rcptHandler: failed to get domain config: %s", err)
-		return false
+		return rcptError
 	}
 	if config == nil {
 		log.Warnf("rcptHandler: domain %s not found", e.domain)
-		return false
+		return rcptError
+	}
+	if err := checkClient(session); err != nil {
+		return err
+	}
+	if err := checkRecipientRateLimits(session, config, to); err != nil {
+		return err
+	}
+	if err := checkGreylist(session, from, to, config); err != nil {
+		return err
 	}
 
 	session.domain = config
 	id, err := uuid.NewRandom()
 	if err != nil {
 		log.Errorf("rcptHandler: failed to generate uuid: %s", err)
-		return false
+		return rcptError
 	}
 	session.id = id
 	if err := mailDBNew(session, config.Name, id); err != nil {
 		log.Errorf("mailDBNew: %s", err)
-		return false
+		return rcptError
 	}
 
-	if err := mailDBSet(session, "to", to); err != nil {
+	mail := mailRecord{id: id, domain: config}
+	if err := mailDBSet(session, mail, "to", to); err != nil {
 		log.Errorf("mailDBSet to: %s", err)
-		return false
+		return rcptError
 	}
-	if err := mailDBSet(session, "from", from); err != nil {
+	if err := mailDBSet(session, mail, "from", from); err != nil {
 		log.Errorf("mailDBSet from: %s", err)
-		return false
+		return rcptError
 	}
 
-	return config.Status == DOMAIN_ACTIVE
+	if config.Status != DOMAIN_ACTIVE {
+		return rcptError
+	}
+	// the next recipients replace the id and domain of the session, the
+	// handler finds the ones of each recipient here
+	if session.rcptMails == nil {
+		session.rcptMails = make(map[string]mailRecord)
+	}
+	session.rcptMails[to] = mail
+	return nil
 }
 
 func logger(remoteIP, verb, line string) {
 	log.Infof("%s %s %s", remoteIP, verb, line)
 }
 
-func Run(addr string) error {
+func Run(listeners []Listener) error {
 	Debug = true
+	instance := getSnapshot().Config
 	srv := &Server{
-		Addr:        addr,
-		Handler:     mailHandler,
-		HandlerRcpt: rcptHandler,
-		Appname:     "fwdr",
-		Hostname:    config.CurrConfig.InstanceHostname,
-		Timeout:     5 * time.Minute,
-		LogRead:     logger,
-		LogWrite:    logger,
-		MaxSize:     10485760,
-	}
-
-	if _, err := os.Stat(config.RUNTIME_LOCATION); os.IsNotExist(err) {
-		if err := os.Mkdir(config.RUNTIME_LOCATION, 0700); err != nil {
+		Listeners:      listeners,
+		Handler:        mailHandler,
+		HandlerConnect: connectHandler,
+		HandlerHelo:    heloHandler,
+		HandlerMail:    mailFromHandler,
+		HandlerRcpt:    rcptHandler,
+		Appname:        "fwdr",
+		Hostname:       instance.InstanceHostname,
+		Timeout:        5 * time.Minute,
+		LogRead:        logger,
+		LogWrite:       logger,
+		MaxSize:        10485760,
+
+		Snapshot: getSnapshot,
+		Workers:  &deliveryWorkers,
+	}
+	for _, l := range listeners {
+		if l.Submission {
+			// the passwords are hashed, CRAM-MD5 can't be supported
+			srv.AuthHandler = authHandler(newCredentialStore(instance))
+			srv.AuthMechs = map[string]bool{"CRAM-MD5": false}
+			if getSnapshot().TLSConfig == nil {
+				log.Warnf("listener %s: submission without TLS, AUTH is disabled", &l)
+			}
+		}
+	}
+	if getSnapshot().TLSConfig != nil {
+		// the handshakes use the TLS settings of the current snapshot
+		srv.TLSConfig = &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				if tlsConfig := getSnapshot().TLSConfig; tlsConfig != nil {
+					return tlsConfig, nil
+				}
+				return nil, errors.New("TLS isn't configured")
+			},
+		}
+	}
+
+	if _, err := os.Stat(BUFFER_LOCATION); os.IsNotExist(err) {
+		if err := os.Mkdir(BUFFER_LOCATION, 0700); err != nil {
 			return errors.Wrap(err, "could not create runtime location")
 		}
 	}
 
-	log.Infof("Forwarding listening on %s for %s (in mode %s)", addr, config.CurrConfig.InstanceHostname, config.CurrConfig.InstanceMode)
-	return srv.ListenAndServe(config.CurrConfig)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+		sig := <-signals
+		for ; sig == syscall.SIGHUP; sig = <-signals {
+			log.Info("received SIGHUP, reloading configuration")
+			reloadSnapshot()
+		}
+		log.Infof("received %s, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("shutdown did not complete: %s", err)
+		}
+		if err := getSnapshot().RateBackend.Close(); err != nil {
+			log.Errorf("could not close the rate limit backend: %s", err)
+		}
+		if err := getSnapshot().Greylisting.Store.Close(); err != nil {
+			log.Errorf("could not save the greylist: %s", err)
+		}
+		if err := getSnapshot().Dedup.Close(); err != nil {
+			log.Errorf("could not save the deduplication store: %s", err)
+		}
+	}()
+
+	for _, l := range listeners {
+		log.Infof("Forwarding listening on %s for %s (in mode %s)", &l, instance.InstanceHostname, instance.InstanceMode)
+	}
+	if err := srv.ListenAndServe(instance); err != ErrServerClosed {
+		return err
+	}
+	<-done
+	return nil
 }
 
 type EmailEnvelope struct {
 	From string
 	To   []string
+	// RFC 6531, the envelope or headers contain UTF-8
+	SMTPUTF8 bool
+	// BODY parameter of MAIL, 7BIT, 8BITMIME or BINARYMIME
+	Body string
+	// RFC 3461 parameters of MAIL and RCPT
+	DSN DSN
+	// identity of the authenticated client, from AUTH, its certificate or
+	// XCLIENT LOGIN
+	Login string
+	// DNSBL zones listing the client
+	DNSBL []string
+	// client checks
+	HELO        string
+	HELOStatus  HELOStatus
+	FCrDNS      string // forward-confirmed reverse DNS, empty if unknown
+	EarlyTalker bool
 }
 type Email struct {
 	Envelope EmailEnvelope
 	Data     *mail.Message
-	// preserve the original email to avoid breaking any signatures
-	Bytes []byte
+	// preserve the original email to avoid breaking any signatures, read
+	// from the file buffer
+	Raw *io.SectionReader
+
+	content *lazyContent
+	// settings of the session that received the email
+	settings *Snapshot
+}
+
+// Reader of the original email, from the beginning
+func (email Email) Reader() io.Reader {
+	return io.NewSectionReader(email.Raw, 0, email.Raw.Size())
+}
+
+// Instance configuration of the session that received the email
+func (email Email) instance() *config.Config {
+	if email.settings != nil && email.settings.Config != nil {
+		return email.settings.Config
+	}
+	return &config.Config{}
+}
+
+// Recipients of a message in the same domain, they share the domain's rules
+type rcptGroup struct {
+	domain string
+	config *Domain // nil if the recipients have no maildb record
+	rcpts  []string
+	index  []int
+	mails  []mailRecord
+}
+
+func groupRecipients(s *session, to []string) ([]rcptGroup, []error) {
+	errs := make([]error, len(to))
+	groups := []rcptGroup{}
+	positions := make(map[string]int)
+	for i, rcpt := range to {
+		e, err := parseAddress(rcpt)
+		if err != nil {
+			log.Errorf("failed to parse recipient %s: %s", rcpt, err)
+			errs[i] = parseError
+			continue
+		}
+		pos, ok := positions[e.domain]
+		if !ok {
+			pos = len(groups)
+			positions[e.domain] = pos
+			groups = append(groups, rcptGroup{domain: e.domain})
+		}
+		groups[pos].rcpts = append(groups[pos].rcpts, rcpt)
+		groups[pos].index = append(groups[pos].index, i)
+		if mail, ok := s.rcptMails[rcpt]; ok {
+			groups[pos].config = mail.domain
+			groups[pos].mails = append(groups[pos].mails, mail)
+		}
+	}
+	return groups, errs
 }
 
-func mailHandler(s *session, from string, to []string, data []byte) error {
-	if rateLimiter.GetCount(s.domain.Name) > uint(RATE_LIMIT_COUNT) {
-		log.Errorf("domain %s rate limited", s.domain.Name)
-		return rateError
+// Returns the outcome of each recipient. The checks on the message apply to
+// all of them, the rules are applied for each domain.
+func mailHandler(s *session, from string, to []string, data *io.SectionReader) []error {
+	if s.listener.Submission {
+		return submissionHandler(s, from, to, data)
+	}
+	groups, errs := groupRecipients(s, to)
+	fail := func(group rcptGroup, err error) {
+		for _, i := range group.index {
+			errs[i] = err
+		}
+	}
+
+	if len(groups) == 0 {
+		return errs
+	}
+
+	data, err := checkMessage(s, groups, data)
+	if err != nil {
+		for _, group := range groups {
+			fail(group, err)
+		}
+		return errs
 	}
 
-	rateLimiter.Inc(s.domain.Name)
+	fp, err := fingerprintMessage(data)
+	if err != nil {
+		log.Errorf("could not fingerprint message: %s", err)
+	}
+
+	// the rate limits count the messages delivered, not the spam or the
+	// dropped ones. A retried message is acknowledged without running the
+	// actions again for the domains which completed them.
+	sent := false
+	for _, group := range groups {
+		if handled, err := handleListBounces(from, group.rcpts, data); handled {
+			if err != nil {
+				log.Errorf("could not handle list bounce: %s", err)
+				err = processingError
+			}
+			fail(group, err)
+			continue
+		}
+		if isDuplicate(s, fp, group) {
+			continue
+		}
+		delivered, err := applyDomainRules(s, from, fp, group, data)
+		fail(group, err)
+		if delivered {
+			domain := group.config
+			if domain == nil {
+				domain = &Domain{Name: group.domain}
+			}
+			countDelivered(s, domain, group.rcpts)
+			sent = true
+		}
+	}
+	if sent {
+		countSent(s, from)
+	}
+	return errs
+}
 
+// Checks of the message shared by all the recipients. Returns the data to
+// use, the spam filter adds its headers.
+func checkMessage(s *session, groups []rcptGroup, data *io.SectionReader) (*io.SectionReader, error) {
 	if s.config.SpamFilter {
 		log.Infof("run Spamassassin")
 
-		file := fmt.Sprintf("%s/%s.eml", config.RUNTIME_LOCATION, s.id.String())
-		if err := runSpamassassin(file); err != nil {
+		if err := runSpamassassin(s.bufferName()); err != nil {
 			log.Errorf("could not run spam filter: %s", err)
-			return processingError
+			return nil, processingError
 		}
 
 		// read buffer again after Spamassassin wrote the status
@@ -265,26 +555,28 @@ func mailHandler(s *session, from string, to []string, data []byte) error {
 		data, err = s.readBuffer()
 		if err != nil {
 			log.Errorf("could not read buffer after spam processing: %s", err)
-			return processingError
+			return nil, processingError
 		}
 	}
 
-	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	msg, err := mail.ReadMessage(io.NewSectionReader(data, 0, data.Size()))
 	if err != nil {
 		log.Errorf("could not read message: %s", err)
-		return parseError
+		return nil, parseError
 	}
 
-	if to := msg.Header.Get("to"); to != "" {
-		if err := mailDBSet(s, "to", to); err != nil {
-			log.Errorf("mailDBSet to failed: %s", err)
-			return processingError
+	for _, group := range groups {
+		if to := msg.Header.Get("to"); to != "" {
+			if err := mailDBSetGroup(s, group, "to", to); err != nil {
+				log.Errorf("mailDBSet to failed: %s", err)
+				return nil, processingError
+			}
 		}
-	}
-	if from := msg.Header.Get("from"); from != "" {
-		if err := mailDBSet(s, "from", from); err != nil {
-			log.Errorf("mailDBSet from failed: %s", err)
-			return processingError
+		if from := msg.Header.Get("from"); from != "" {
+			if err := mailDBSetGroup(s, group, "from", from); err != nil {
+				log.Errorf("mailDBSet from failed: %s", err)
+				return nil, processingError
+			}
 		}
 	}
 
@@ -298,99 +590,211 @@ func mailHandler(s *session, from string, to []string, data []byte) error {
 			score := parts[1]
 			log.Infof("spam result: %s %s", isSpam, score)
 			if isSpam == "Yes" {
-				if err := mailDBUpdateMailStatus(s, MAIL_STATUS_SPAM); err != nil {
-					log.Errorf("mailDBSet status failed: %s", err)
-					return processingError
+				for _, group := range groups {
+					if err := mailDBUpdateGroupStatus(s, group, MAIL_STATUS_SPAM); err != nil {
+						log.Errorf("mailDBSet status failed: %s", err)
+						return nil, processingError
+					}
 				}
 
-				return spamError
+				return nil, spamError
 			}
 		}
 	}
+	return data, nil
+}
 
-	email := Email{
-		Envelope: EmailEnvelope{from, to},
-		Data:     msg,
-		Bytes:    data,
-	}
+// Apply the rules of a domain to the message for its recipients. Returns
+// true if an action delivered it. Each action is recorded as soon as it
+// completes, a retried message only runs the ones which didn't.
+func applyDomainRules(s *session, from string, fp messageFingerprint, group rcptGroup, data *io.SectionReader) (delivered bool, err error) {
+	// each domain reads the message, the body can be consumed by the actions
+	msg, err := mail.ReadMessage(io.NewSectionReader(data, 0, data.Size()))
+	if err != nil {
+		log.Errorf("could not read message: %s", err)
+		return false, parseError
+	}
+	envelope := EmailEnvelope{
+		From:     from,
+		To:       group.rcpts,
+		SMTPUTF8: s.smtputf8,
+		Body:     s.body,
+		DSN:      s.dsn,
+		Login:    s.login,
+	}
+	if s.dnsbl != nil {
+		envelope.DNSBL = s.dnsbl.Listed
+	}
+	if s.fcrdns != nil {
+		envelope.FCrDNS = s.fcrdns.Host
+	}
+	envelope.HELO = s.remoteName
+	envelope.HELOStatus = checkHELOName(s.remoteName, s.remoteIP, s.srv.Hostname)
+	envelope.EarlyTalker = s.earlyTalker
+	email := NewEmail(envelope, msg, data)
+	email.settings = s.snapshot
+
+	// the message is processed once all its actions completed, the rules
+	// run again on retry while a list expansion didn't reach every member
+	actions := newDedupActions(s, fp, group)
+	expanding := false
+	defer func() {
+		if err == nil && !expanding {
+			actions.record("")
+		}
+	}()
 
 	if hasLoop(&email) {
 		log.Error("loop detected")
-		return loopError
+		return delivered, loopError
 	}
 
 	chans := MakeActionChans()
-	domainRules, err := getDomainRules(s.config, s.domain.Name)
+	domainRules, err := getDomainRules(s.config, group.domain)
 	if err != nil {
 		log.Errorf("could not get domain's rules: %s", err)
-		return configError
+		return delivered, configError
 	}
+	// returning early stops the rules goroutine
+	defer chans.Abort()
 
-	go func(domainRules DomainRules, email Email, chans ActionChans, s *session) {
+	go func(domainRules DomainRules, email Email, chans ActionChans, s *session, group rcptGroup) {
 		log.Debugf("running %d rule(s)", len(domainRules.Rules))
-		ruleId, _ := ApplyRules(domainRules.Rules, email, chans)
-		// No need to report the error because we also send it in the chans.error
-		// channel
+		ruleId, err := ApplyRules(domainRules.Rules, email, chans)
+		if err != nil {
+			// No need to report the error because we also send it in the
+			// chans.error channel, which is closed as well
+			return
+		}
 		if ruleId != nil {
-			if err := mailDBUpdateMailStatus(s, MAIL_STATUS_PROCESSED); err != nil {
+			if err := mailDBUpdateGroupStatus(s, group, MAIL_STATUS_PROCESSED); err != nil {
 				log.Errorf("mailDBUpdateMailStatus: %s", err)
 			}
 			log.Debugf("rule %s was applied", *ruleId)
-			if err := mailDBSet(s, "rule", string(*ruleId)); err != nil {
+			if err := mailDBSetGroup(s, group, "rule", string(*ruleId)); err != nil {
 				log.Errorf("mailDBSet rule: %s", err)
 			}
-			chans.Close()
 		}
-
-	}(domainRules, email, chans, s)
+		chans.Close()
+	}(domainRules, email, chans, s, group)
 
 	timeout := time.After(60 * time.Second)
 
-	loop := true
-	for loop {
+	// Keep consuming actions until the rules are done, a rule can emit more
+	// than one action
+	for {
 		select {
-		case drop := <-chans.drop:
+		case drop, ok := <-chans.drop:
+			if !ok {
+				return delivered, nil
+			}
+			// the other domains still use the buffer, it's deleted once
+			// the message is delivered
 			log.Infof("drop (by rule %t)", drop.DroppedRule)
-			loop = false
-			deleteBuffer(s)
-		case send := <-chans.send:
+		case send, ok := <-chans.send:
+			if !ok {
+				return delivered, nil
+			}
+			target := "send " + send.To
+			if actions.done(target) {
+				delivered = true
+				break
+			}
 			log.Infof("send to %s", send.To)
 			if err := sendMailout(send.Email, send.To); err != nil {
 				log.Errorf("error sending email out: %s", err)
-				return processingError
+				return delivered, processingError
+			}
+			actions.record(target)
+			delivered = true
+		case webhook, ok := <-chans.webhook:
+			if !ok {
+				return delivered, nil
+			}
+			target := "webhook " + webhook.Endpoint
+			if actions.done(target) {
+				delivered = true
+				break
 			}
-			loop = false
-		case webhook := <-chans.webhook:
 			log.Infof("call %s\n", webhook.Endpoint)
 			if err := sendWebhook(webhook.Email, webhook.Endpoint, webhook.SecretToken); err != nil {
 				log.Errorf("error sending webhook: %s", err)
-				return processingError
+				return delivered, processingError
+			}
+			actions.record(target)
+			delivered = true
+		case list, ok := <-chans.list:
+			if !ok {
+				return delivered, nil
+			}
+			delivered = true
+			if isListRequest(list.List, list.Email) {
+				target := "list " + list.List
+				if actions.done(target) {
+					break
+				}
+				if err := handleListCommand(list.List, list.Email); err != nil {
+					log.Errorf("error handling list command: %s", err)
+					return delivered, processingError
+				}
+				actions.record(target)
+				break
+			}
+			// Expanding a large list takes a while because of the send rate,
+			// run it in the background with its own handle on the file buffer
+			raw, err := s.openBuffer()
+			if err != nil {
+				log.Errorf("could not open buffer for list: %s", err)
+				return delivered, processingError
+			}
+			list.Email.Raw = raw.SectionReader
+			// the members are recorded as they get the message, the
+			// expansion reports its failures to the sender
+			expanding = true
+			deliveryWorkers.Add(1)
+			go func(list ActionList) {
+				defer deliveryWorkers.Done()
+				defer raw.Close()
+				// The list members get a new envelope, delivery notifications
+				// end at the list (RFC 3461 section 6.2.7.3)
+				rcpt := list.Email.Envelope.To[0]
+				if err := expandList(list.List, list.Email, actions); err != nil {
+					log.Errorf("error expanding list: %s", err)
+					sendNotice(list.Email, rcpt, DSN_NOTIFY_FAILURE, DSN_ACTION_FAILED, "5.3.0", err.Error())
+					return
+				}
+				sendNotice(list.Email, rcpt, DSN_NOTIFY_SUCCESS, DSN_ACTION_EXPANDED, "2.0.0", "")
+			}(list)
+		case err, ok := <-chans.error:
+			if !ok {
+				return delivered, nil
 			}
-			loop = false
-		case err := <-chans.error:
 			log.Errorf("error during rule processing: %s", err)
-			return processingError
+			return delivered, processingError
 		case <-timeout:
-			chans.Error(errors.New("timed out"))
+			log.Error("rule processing timed out")
+			return delivered, processingError
 		}
 	}
-
-	return nil
 }
 
 func main() {
-	if err := config.Init(); err != nil {
-		log.Fatalf("failed to init config: %s", err)
-	}
-
-	if !config.CurrConfig.IsInstanceLocal() && config.CurrConfig.ServerJWT == "" {
-		log.Fatal("server JWT is needed")
-	}
-	if v := config.CurrConfig.ForwardingLoopDetectionCount; v > 0 {
-		LOOP_DETECTION_COUNT = v
-	}
-	if v := config.CurrConfig.ForwardingRateLimitingCount; v > 0 {
-		RATE_LIMIT_COUNT = v
+	// the sessions use the configuration of their snapshot, replaced on
+	// SIGHUP
+	snapshot, err := loadSnapshot()
+	if err != nil {
+		log.Fatalf("failed to load config: %s", err)
+	}
+	log.SetLevel(snapshot.Config.GetLogLevel())
+	log.SetFormatter(snapshot.Config.GetLogFormat())
+	setSnapshot(snapshot)
+	if addr := snapshot.Settings.MetricsAddr; addr != "" {
+		go func() {
+			log.Infof("Metrics listening on %s", addr)
+			if err := http.ListenAndServe(addr, expvar.Handler()); err != nil {
+				log.Errorf("metrics server failed: %s", err)
+			}
+		}()
 	}
 
 	apiClient = retryablehttp.NewClient()
@@ -405,33 +809,86 @@ func main() {
 		Timeout: 30 * time.Second,
 	}
 
-	addr := fmt.Sprintf("127.0.0.1:%d", config.CurrConfig.PortForwarding)
-	if err := Run(addr); err != nil {
+	listeners, err := snapshot.Settings.GetListeners(fmt.Sprintf("127.0.0.1:%d", snapshot.Config.PortForwarding))
+	if err != nil {
+		log.Fatalf("invalid listeners: %s", err)
+	}
+	if err := Run(listeners); err != nil {
 		log.Fatal(err)
 	}
 }
 
 func sendMailout(email Email, to string) error {
-	from := email.Envelope.From
-	addr := fmt.Sprintf("127.0.0.1:%d", config.CurrConfig.PortMailout)
-	if err := smtp.SendMail(addr, nil, from, []string{to}, email.Bytes); err != nil {
-		return errors.Wrap(err, "could not send email to mailout")
+	envelope := email.Envelope
+	// The DSN parameters of the original recipient apply to the forwarded
+	// copy, the ORCPT keeps track of the original recipient.
+	if len(envelope.To) > 0 {
+		rcpt := envelope.To[0]
+		rcptDSN := envelope.DSN.Rcpt(rcpt)
+		rcptDSN.ORcpt = envelope.DSN.ORcpt(rcpt)
+		envelope.DSN.Rcpts = map[string]DSNRcpt{to: rcptDSN}
+	}
+
+	dsn, err := sendMailoutEnvelope(email.instance(), envelope, to, email.Reader())
+	if err != nil {
+		return err
+	}
+	if !dsn && len(email.Envelope.To) > 0 {
+		// RFC 3461 section 6.2.7.1, mailout couldn't take over the DSN
+		rcpt := email.Envelope.To[0]
+		sendNotice(email, rcpt, DSN_NOTIFY_SUCCESS, DSN_ACTION_RELAYED, "2.0.0",
+			fmt.Sprintf("relayed to %s", to))
 	}
 	return nil
 }
 
-func sendWebhook(email Email, endpoint string, secretToken string) error {
-	from := email.Envelope.From
-	to := email.Envelope.To
+func sendMailoutData(instance *config.Config, envelope EmailEnvelope, to string, data io.Reader) error {
+	envelope.DSN = DSN{}
+	_, err := sendMailoutEnvelope(instance, envelope, to, data)
+	return err
+}
 
-	buffer := new(bytes.Buffer)
+func sendMailoutEnvelope(instance *config.Config, envelope EmailEnvelope, to string, data io.Reader) (bool, error) {
+	envelope.To = []string{to}
+	return sendMailoutRcpts(instance, envelope, data)
+}
 
-	buffer.WriteString(fmt.Sprintf("Mw-Int-Webhook-URL: %s%s", endpoint, CRLF))
-	buffer.WriteString(fmt.Sprintf("Mw-Int-Webhook-Secret-Token: %s%s", secretToken, CRLF))
-	buffer.Write(email.Bytes)
+// Send the email to all the recipients of the envelope in one transaction,
+// mailout takes all of them or none
+func sendMailoutRcpts(instance *config.Config, envelope EmailEnvelope, data io.Reader) (bool, error) {
+	if !envelope.SMTPUTF8 {
+		// without SMTPUTF8 the domains can only be sent in their ASCII form
+		to := make([]string, len(envelope.To))
+		rcpts := make(map[string]DSNRcpt)
+		for i, rcpt := range envelope.To {
+			to[i] = rcpt
+			if local, domain := splitAddress(rcpt); domain != "" {
+				if ascii, err := normalizeDomain(domain); err == nil {
+					to[i] = local + "@" + ascii
+				}
+			}
+			if rcptDSN, ok := envelope.DSN.Rcpts[rcpt]; ok {
+				rcpts[to[i]] = rcptDSN
+			}
+		}
+		envelope.To = to
+		envelope.DSN.Rcpts = rcpts
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", instance.PortMailout)
+	dsn, err := sendSMTP(addr, envelope, data)
+	if err != nil {
+		return dsn, errors.Wrap(err, "could not send email to mailout")
+	}
+	return dsn, nil
+}
+
+func sendWebhook(email Email, endpoint string, secretToken string) error {
+	headers := fmt.Sprintf("Mw-Int-Webhook-URL: %s%s", endpoint, CRLF) +
+		fmt.Sprintf("Mw-Int-Webhook-Secret-Token: %s%s", secretToken, CRLF)
+	data := io.MultiReader(strings.NewReader(headers), email.Reader())
 
-	addr := fmt.Sprintf("127.0.0.1:%d", config.CurrConfig.PortWebhook)
-	if err := smtp.SendMail(addr, nil, from, to, buffer.Bytes()); err != nil {
+	addr := fmt.Sprintf("127.0.0.1:%d", email.instance().PortWebhook)
+	if _, err := sendSMTP(addr, email.Envelope, data); err != nil {
 		return errors.Wrap(err, "could not send email to webhook")
 	}
 	return nil
@@ -3,6 +3,7 @@ package main
 import (
 	"testing"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -43,3 +44,28 @@ Hello world!
 	`)
 	assert.False(t, hasLoop(&email))
 }
+
+func TestParseAddressIDN(t *testing.T) {
+	a, err := parseAddress("info@Bücher.de")
+	assert.Nil(t, err)
+	assert.Equal(t, a.domain, "xn--bcher-kva.de")
+
+	b, err := parseAddress("info@xn--bcher-kva.de")
+	assert.Nil(t, err)
+	assert.Equal(t, a.domain, b.domain)
+}
+
+func TestGroupRecipients(t *testing.T) {
+	// each recipient has its own record, the session keeps the last one
+	example := &Domain{Name: "example.com"}
+	a := mailRecord{id: uuid.New(), domain: example}
+	c := mailRecord{id: uuid.New(), domain: example}
+	s := &session{rcptMails: map[string]mailRecord{"a@example.com": a, "c@Example.com": c}}
+
+	groups, errs := groupRecipients(s, []string{"a@example.com", "b@other.com", "c@Example.com", "invalid"})
+	assert.Equal(t, []rcptGroup{
+		{domain: "example.com", config: example, rcpts: []string{"a@example.com", "c@Example.com"}, index: []int{0, 2}, mails: []mailRecord{a, c}},
+		{domain: "other.com", rcpts: []string{"b@other.com"}, index: []int{1}},
+	}, groups)
+	assert.Equal(t, []error{nil, nil, nil, parseError}, errs)
+}
@@ -4,11 +4,29 @@
 // - mailHandler is synchronous, ie not ran in a gorouting
 // - pass the session to mailHandler and rcptHandler
 // - add custom fields in session
-// - replace in-memory buffer with file buffer
+// - replace in-memory buffer with file buffer, DATA is streamed to it
 // - additional mail header
 // - pass config in session
 // - new  DATA reader (dotreader)
-// - XCLIENT support, rdns once we get the name
+// - XCLIENT support, following the Postfix semantics
+// - SMTPUTF8 support
+// - CHUNKING (BDAT), 8BITMIME and BINARYMIME support
+// - PIPELINING support, responses are flushed once the input is drained
+// - DSN parameters are kept in the session
+// - PROXY protocol listener, XCLIENT is restricted to trusted networks
+// - connection, command and message limits, tarpitting
+// - graceful shutdown
+// - settings snapshot per session, reloaded at runtime
+// - multiple listeners, including unix sockets, their clients aren't loopback
+// - LMTP mode (RFC 2033), the handler returns an outcome per recipient
+// - SMTP retries a message a recipient failed temporarily, bounces the permanent failures
+// - ConfigureTLS and the certificate store share loadX509KeyPair
+// - client certificate authentication on the listeners with ClientAuth
+// - pass the session to AuthHandler, HandlerMail called on MAIL
+// - AUTH only on the listeners with AuthRequired
+// - HandlerMail and HandlerRcpt return the reply of a rejected command
+// - HandlerConnect called before the banner
+// - greeting delay detecting the early talkers, HandlerHelo called on HELO
 package main
 
 import (
@@ -20,6 +38,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/textproto"
@@ -27,6 +46,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -34,22 +54,42 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	BODY_7BIT       = "7BIT"
+	BODY_8BITMIME   = "8BITMIME"
+	BODY_BINARYMIME = "BINARYMIME"
+)
+
 var (
 	// Debug `true` enables verbose logging.
 	Debug      = false
-	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:\s?<(.+)>`)
-	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:\s?<(.*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
-	mailSizeRE = regexp.MustCompile(`[Ss][Ii][Zz][Ee]=(\d+)`)
+	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:\s?<([^>]+)>(\s(.*))?`)
+	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:\s?<([^>]*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
 )
 
-// Handler function called upon successful receipt of an email.
-type Handler func(session *session, from string, to []string, data []byte) error
+// Handler function called upon successful receipt of an email. The email is
+// read from the file buffer. Returns the outcome of each recipient, in the
+// order of to; a nil slice, or a nil error, means the recipient was accepted.
+type Handler func(session *session, from string, to []string, data *io.SectionReader) []error
+
+// HandlerConnect function called before the banner. Returns nil to accept
+// the client, otherwise the error is the reply and the connection is closed.
+type HandlerConnect func(session *session) error
+
+// HandlerHelo function called on HELO, EHLO and LHLO. Returns nil to accept
+// the name, otherwise the error is the reply.
+type HandlerHelo func(session *session, name string) error
+
+// HandlerMail function called on MAIL. Returns nil to accept the sender,
+// otherwise the error is the reply.
+type HandlerMail func(session *session, from string) error
 
-// HandlerRcpt function called on RCPT. Return accept status.
-type HandlerRcpt func(session *session, from string, to string) bool
+// HandlerRcpt function called on RCPT. Returns nil to accept the recipient,
+// otherwise the error is the reply.
+type HandlerRcpt func(session *session, from string, to string) error
 
 // AuthHandler function called when a login attempt is performed. Returns true if credentials are correct.
-type AuthHandler func(remoteAddr net.Addr, mechanism string, username []byte, password []byte, shared []byte) (bool, error)
+type AuthHandler func(session *session, mechanism string, username []byte, password []byte, shared []byte) (bool, error)
 
 // ListenAndServe listens on the TCP network address addr
 // and then calls Serve with handler to handle requests
@@ -90,31 +130,40 @@ type LogFunc func(remoteIP, verb, line string)
 
 // Server is an SMTP server.
 type Server struct {
-	Addr         string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
-	Appname      string
-	AuthHandler  AuthHandler
-	AuthMechs    map[string]bool // Override list of allowed authentication mechanisms. Currently supported: LOGIN, PLAIN, CRAM-MD5. Enabling LOGIN and PLAIN will reduce RFC 4954 compliance.
-	AuthRequired bool            // Require authentication for every command except AUTH, EHLO, HELO, NOOP, RSET or QUIT as per RFC 4954. Ignored if AuthHandler is not configured.
-	Handler      Handler
-	HandlerRcpt  HandlerRcpt
-	Hostname     string
-	LogRead      LogFunc
-	LogWrite     LogFunc
-	MaxSize      int // Maximum message size allowed, in bytes
-	Timeout      time.Duration
-	TLSConfig    *tls.Config
-	TLSListener  bool // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
-	TLSRequired  bool // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	Addr           string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
+	Appname        string
+	AuthHandler    AuthHandler
+	AuthMechs      map[string]bool // Override list of allowed authentication mechanisms. Currently supported: LOGIN, PLAIN, CRAM-MD5. Enabling LOGIN and PLAIN will reduce RFC 4954 compliance.
+	AuthRequired   bool            // Require authentication for every command except AUTH, EHLO, HELO, NOOP, RSET or QUIT as per RFC 4954. Ignored if AuthHandler is not configured.
+	Handler        Handler
+	HandlerConnect HandlerConnect
+	HandlerHelo    HandlerHelo
+	HandlerMail    HandlerMail
+	HandlerRcpt    HandlerRcpt
+	Hostname       string
+	LogRead        LogFunc
+	LogWrite       LogFunc
+	MaxSize        int // Maximum message size allowed, in bytes
+	Timeout        time.Duration
+	TLSConfig      *tls.Config
+	TLSListener    bool // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
+	TLSRequired    bool // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	LMTP           bool // Speak LMTP (RFC 2033): LHLO instead of HELO and EHLO, and a reply per recipient after the data
+
+	ProxyProtocol   bool         // Read the PROXY protocol header of connections from trusted networks
+	TrustedNetworks []*net.IPNet // Networks allowed to send the PROXY protocol header and XCLIENT
+
+	Listeners []Listener // Addresses to listen on, Addr, TLSListener, TLSRequired, AuthRequired, LMTP and ProxyProtocol are used if empty
+	Limits    Limits
+	Snapshot  func() *Snapshot // Settings of the new sessions, overrides the fields above
+	Workers   *sync.WaitGroup  // Background work of the handlers, waited for on shutdown
+	conns     connTracker
+	state     serverState
 }
 
 // ConfigureTLS creates a TLS configuration from certificate and key files.
 func (srv *Server) ConfigureTLS(certFile string, keyFile string) error {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
-	}
-	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
-	return nil
+	return srv.ConfigureTLSWithPassphrase(certFile, keyFile, "")
 }
 
 // ConfigureTLSWithPassphrase creates a TLS configuration from a certificate,
@@ -124,34 +173,45 @@ func (srv *Server) ConfigureTLSWithPassphrase(
 	keyFile string,
 	passphrase string,
 ) error {
-	certPEMBlock, err := ioutil.ReadFile(certFile)
+	cert, err := loadX509KeyPair(certFile, keyFile, passphrase)
 	if err != nil {
 		return err
 	}
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return nil
+}
+
+// Load a key pair, the key is decrypted with the passphrase if there's one.
+func loadX509KeyPair(certFile string, keyFile string, passphrase string) (tls.Certificate, error) {
+	if passphrase == "" {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	certPEMBlock, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
 	keyPEMBlock, err := ioutil.ReadFile(keyFile)
 	if err != nil {
-		return err
+		return tls.Certificate{}, err
 	}
 	keyDERBlock, _ := pem.Decode(keyPEMBlock)
+	if keyDERBlock == nil {
+		return tls.Certificate{}, errors.New("no PEM data in key file")
+	}
 	keyPEMDecrypted, err := x509.DecryptPEMBlock(keyDERBlock, []byte(passphrase))
 	if err != nil {
-		return err
+		return tls.Certificate{}, err
 	}
 	var pemBlock pem.Block
 	pemBlock.Type = keyDERBlock.Type
 	pemBlock.Bytes = keyPEMDecrypted
 	keyPEMBlock = pem.EncodeToMemory(&pemBlock)
-	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
-	if err != nil {
-		return err
-	}
-	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
-	return nil
+	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
 }
 
-// ListenAndServe listens on the TCP network address srv.Addr and then
-// calls Serve to handle requests on incoming connections.  If
-// srv.Addr is blank, ":25" is used.
+// ListenAndServe listens on the addresses of srv.Listeners, or on the TCP
+// network address srv.Addr, and then calls Serve to handle requests on
+// incoming connections.  If srv.Addr is blank, ":25" is used.
 func (srv *Server) ListenAndServe(config *config.Config) error {
 	if srv.Addr == "" {
 		srv.Addr = ":25"
@@ -166,54 +226,133 @@ func (srv *Server) ListenAndServe(config *config.Config) error {
 		srv.Timeout = 5 * time.Minute
 	}
 
-	var ln net.Listener
-	var err error
+	listeners := srv.Listeners
+	if len(listeners) == 0 {
+		listeners = []Listener{srv.defaultListener()}
+	}
 
-	// If TLSListener is enabled, listen for TLS connections only.
-	if srv.TLSConfig != nil && srv.TLSListener {
-		ln, err = tls.Listen("tcp", srv.Addr, srv.TLSConfig)
-	} else {
-		ln, err = net.Listen("tcp", srv.Addr)
+	lns := make([]net.Listener, 0, len(listeners))
+	for i := range listeners {
+		ln, err := srv.listen(&listeners[i], config)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
 	}
-	if err != nil {
-		return err
+
+	errs := make(chan error, len(lns))
+	for i, ln := range lns {
+		go func(ln net.Listener, l *Listener) {
+			errs <- srv.serve(ln, l, config)
+		}(ln, &listeners[i])
+	}
+	// A listener failed or the server is shut down, stop all of them
+	err := <-errs
+	for _, ln := range lns {
+		ln.Close()
+	}
+	return err
+}
+
+// Settings for a new session, the static ones of the server unless Snapshot
+// is set
+func (srv *Server) snapshot(config *config.Config) *Snapshot {
+	if srv.Snapshot != nil {
+		if snapshot := srv.Snapshot(); snapshot != nil {
+			return snapshot
+		}
+	}
+	return &Snapshot{
+		Config:              config,
+		LoopDetectionCount:  LOOP_DETECTION_COUNT,
+		RateLimitCount:      RATE_LIMIT_COUNT,
+		SubaddressSeparator: SUBADDRESS_SEPARATOR,
+		TrustedNetworks:     srv.TrustedNetworks,
+		Limits:              srv.Limits,
 	}
-	return srv.Serve(ln, config)
 }
 
 // Serve creates a new SMTP session after a network connection is established.
 func (srv *Server) Serve(ln net.Listener, config *config.Config) error {
+	l := srv.defaultListener()
+	return srv.serve(ln, &l, config)
+}
+
+func (srv *Server) serve(ln net.Listener, l *Listener, config *config.Config) error {
 	defer ln.Close()
+	if !srv.trackListener(ln, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(ln, false)
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 				continue
 			}
 			return err
 		}
+		if !srv.conns.open(srv.snapshot(config).Limits) {
+			go srv.reject(conn, "421 4.7.0 %s Too many connections, try again later", srv.Hostname)
+			continue
+		}
 		session := srv.newSession(conn, config)
+		session.listener = l
+		srv.trackSession(session, true)
 		go session.serve()
 	}
 }
 
+// Reply to a connection that isn't served and close it
+func (srv *Server) reject(conn net.Conn, format string, args ...interface{}) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, format+"\r\n", args...)
+}
+
 type session struct {
 	srv           *Server
+	listener      *Listener
 	conn          net.Conn
 	br            *bufio.Reader
 	bw            *bufio.Writer
-	remoteIP      string // Remote IP address
+	remoteIP      string // Remote IP address, or unix:<peer> for the clients of a unix socket
+	remotePort    string // Remote port
 	remoteHost    string // Remote hostname according to reverse DNS lookup
 	remoteName    string // Remote hostname as supplied with EHLO
+	proto         string // SMTP, ESMTP or LMTP, depending on HELO, EHLO or LHLO
+	login         string // SASL login name, as supplied with XCLIENT
+	destAddr      string // Local IP address, as supplied with XCLIENT
+	xclient       bool   // XCLIENT allowed, decided on the address of the peer
+	commands      int    // Commands received in the session
+	messages      int    // Messages received in the session
+	invalid       int    // Invalid commands received in the session
 	tls           bool
 	authenticated bool
+	smtputf8      bool   // RFC 6531, set by the SMTPUTF8 parameter of MAIL
+	body          string // RFC 6152 and RFC 3030, set by the BODY parameter of MAIL
+	dsn           DSN    // RFC 3461, set by the parameters of MAIL and RCPT
 
 	smtpReader *textproto.Reader
 
 	// custom fields
-	domain *Domain
-	id     uuid.UUID
-	config *config.Config
+	buffer        *bufferReader
+	domain        *Domain
+	id            uuid.UUID
+	config        *config.Config
+	snapshot      *Snapshot
+	senderDomains []string              // domains the authenticated user can send from
+	dnsbl         *DNSBLResult          // listing of the client, looked up on first use
+	fcrdns        *FCrDNSResult         // forward-confirmed reverse DNS, looked up on first use
+	rcptMails     map[string]mailRecord // maildb record of the recipients of the transaction
+	earlyTalker   bool                  // sent data before the banner
 }
 
 // Create new session from connection.
@@ -228,8 +367,11 @@ func (srv *Server) newSession(conn net.Conn, config *config.Config) (s *session)
 		// used for reading the DATA
 		smtpReader: textproto.NewReader(br),
 
-		config: config,
+		snapshot: srv.snapshot(config),
 	}
+	l := srv.defaultListener()
+	s.listener = &l
+	s.config = s.snapshot.Config
 
 	s.remoteHost = "unknown"
 
@@ -242,10 +384,71 @@ func (srv *Server) newSession(conn net.Conn, config *config.Config) (s *session)
 // Function called to handle connection requests.
 func (s *session) serve() {
 	defer s.conn.Close()
+	defer s.srv.conns.close()
+	defer s.srv.trackSession(s, false)
+	defer s.flush()
 	var from string
 	var gotFrom bool
 	var to []string
-	var buffer bytes.Buffer
+
+	// BDAT chunks of the current mail transaction (RFC 3030)
+	var chunks *os.File
+	var chunksSize int64
+	var chunksTooBig bool
+	abortChunks := func() {
+		if chunks != nil {
+			chunks.Close()
+			deleteBuffer(s)
+			chunks = nil
+		}
+	}
+	defer abortChunks()
+
+	// Read the PROXY protocol header, or do the TLS handshake, before
+	// anything else to know who the client is.
+	if conn, ok := s.conn.(interface{ Handshake() error }); ok {
+		if s.srv.Timeout > 0 {
+			s.conn.SetDeadline(time.Now().Add(s.srv.Timeout))
+		}
+		if err := conn.Handshake(); err != nil {
+			log.Errorf("handshake failed: %s", err)
+			return
+		}
+		s.authenticateClientCert()
+	}
+	if s.listener.Network == "unix" {
+		s.remoteIP = s.unixPeer()
+		s.remoteHost = "localhost"
+	} else if host, port, err := net.SplitHostPort(s.conn.RemoteAddr().String()); err == nil {
+		s.remoteIP = host
+		s.remotePort = port
+	}
+	s.xclient = isTrustedIP(net.ParseIP(s.remoteIP), s.snapshot.TrustedNetworks)
+
+	clientIP := s.remoteIP
+	if !s.srv.conns.openIP(clientIP, s.snapshot.Limits) {
+		s.writef("421 4.7.0 %s Too many connections from your address, try again later", s.srv.Hostname)
+		return
+	}
+	defer s.srv.conns.closeIP(clientIP)
+	if conn, ok := s.conn.(*proxyConn); ok {
+		if isTLS, version := conn.TLS(); isTLS {
+			log.Debugf("client connected to the proxy with TLS %s", version)
+			s.tls = true
+		}
+	}
+
+	// Clients talking before the banner don't wait for the replies, like the
+	// spam bots. The trusted peers and the submission clients aren't delayed.
+	if delay := s.snapshot.ClientChecks.GreetDelay; delay > 0 && !s.xclient && !s.listener.Submission {
+		s.earlyTalker = s.talksBefore(delay)
+	}
+	if s.srv.HandlerConnect != nil {
+		if err := s.srv.HandlerConnect(s); err != nil {
+			s.writef("%s", err)
+			return
+		}
+	}
 
 	// Send banner.
 	s.writef("220 %s %s ESMTP Service ready", s.srv.Hostname, s.srv.Appname)
@@ -255,81 +458,124 @@ loop:
 		// Attempt to read a line from the socket.
 		// On timeout, send a timeout message and return from serve().
 		// On error, assume the client has gone away i.e. return from serve().
+		// On shutdown, the read is interrupted if no transaction is in progress.
+		if !s.srv.setIdle(s, !gotFrom) {
+			s.writef("421 4.3.2 %s Service shutting down, closing transmission channel", s.srv.Hostname)
+			break
+		}
 		line, err := s.readLine()
+		s.srv.setIdle(s, false)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if s.srv.shuttingDown() {
+				s.writef("421 4.3.2 %s Service shutting down, closing transmission channel", s.srv.Hostname)
+			} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
 			}
 			break
 		}
+		s.commands++
+		if max := s.snapshot.Limits.MaxCommands; max > 0 && s.commands > max {
+			metrics.Add(METRIC_REJECTED_MAX_COMMANDS, 1)
+			s.writef("421 4.7.0 %s Too many commands, closing transmission channel", s.srv.Hostname)
+			break
+		}
 		verb, args := s.parseLine(line)
 
 		switch verb {
 		case "HELO":
+			if s.listener.LMTP {
+				s.writef("500 5.5.1 Syntax error, command unrecognized (LHLO required)")
+				break
+			}
+			if s.srv.HandlerHelo != nil {
+				if err := s.srv.HandlerHelo(s, args); err != nil {
+					s.writef("%s", err)
+					break
+				}
+			}
 			s.remoteName = args
+			s.proto = "SMTP"
 			s.writef("250 %s greets %s", s.srv.Hostname, s.remoteName)
 
 			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET, so reset for HELO too.
 			from = ""
 			gotFrom = false
 			to = nil
-			buffer.Reset()
-		case "EHLO":
+			abortChunks()
+		case "EHLO", "LHLO":
+			// RFC 2033 section 4.1, LHLO replaces HELO and EHLO in LMTP
+			if s.listener.LMTP != (verb == "LHLO") {
+				if s.listener.LMTP {
+					s.writef("500 5.5.1 Syntax error, command unrecognized (LHLO required)")
+				} else {
+					s.writef("500 5.5.2 Syntax error, command unrecognized")
+				}
+				break
+			}
+			if s.srv.HandlerHelo != nil {
+				if err := s.srv.HandlerHelo(s, args); err != nil {
+					s.writef("%s", err)
+					break
+				}
+			}
 			s.remoteName = args
+			s.proto = "ESMTP"
+			if s.listener.LMTP {
+				s.proto = "LMTP"
+			}
 			s.writef(s.makeEHLOResponse())
 
 			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET.
 			from = ""
 			gotFrom = false
 			to = nil
-			buffer.Reset()
+			abortChunks()
 		case "MAIL":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+			if s.srv.TLSConfig != nil && s.listener.TLSRequired && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
-			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+			if s.authRequired() {
 				s.writef("530 5.7.0 Authentication required")
 				break
 			}
+			if max := s.snapshot.Limits.MaxMessages; max > 0 && s.messages >= max {
+				metrics.Add(METRIC_REJECTED_MAX_MESSAGES, 1)
+				s.writef("452 4.7.0 Too many messages in this session, try again later")
+				break
+			}
+
+			to = nil
+			abortChunks()
 
 			match := mailFromRE.FindStringSubmatch(args)
 			if match == nil {
 				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid FROM parameter)")
-			} else {
-				// Validate the SIZE parameter if one was sent.
-				if len(match[2]) > 0 { // A parameter is present
-					sizeMatch := mailSizeRE.FindStringSubmatch(match[3])
-					if sizeMatch == nil {
-						s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-					} else {
-						// Enforce the maximum message size if one is set.
-						size, err := strconv.Atoi(sizeMatch[1])
-						if err != nil { // Bad SIZE parameter
-							s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-						} else if s.srv.MaxSize > 0 && size > s.srv.MaxSize { // SIZE above maximum size, if set
-							err = maxSizeExceeded(s.srv.MaxSize)
-							s.writef(err.Error())
-						} else { // SIZE ok
-							from = match[1]
-							gotFrom = true
-							s.writef("250 2.1.0 Ok")
-						}
-					}
-				} else { // No parameters after FROM
-					from = match[1]
-					gotFrom = true
-					s.writef("250 2.1.0 Ok")
+				break
+			}
+			if err := s.handleMailParams(parseParams(match[3])); err != nil {
+				s.writef("%s", err)
+				break
+			}
+			if !s.smtputf8 && !isASCII(match[1]) {
+				s.writef("553 5.6.7 Non-ASCII addresses require the SMTPUTF8 parameter")
+				break
+			}
+			if s.srv.HandlerMail != nil {
+				if err := s.srv.HandlerMail(s, match[1]); err != nil {
+					s.writef("%s", err)
+					break
 				}
 			}
-			to = nil
-			buffer.Reset()
+			from = match[1]
+			gotFrom = true
+			s.writef("250 2.1.0 Ok")
 		case "RCPT":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+			if s.srv.TLSConfig != nil && s.listener.TLSRequired && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
-			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+			if s.authRequired() {
 				s.writef("530 5.7.0 Authentication required")
 				break
 			}
@@ -337,33 +583,42 @@ loop:
 				s.writef("503 5.5.1 Bad sequence of commands (MAIL required before RCPT)")
 				break
 			}
+			if chunks != nil {
+				s.writef("503 5.5.1 Bad sequence of commands (RCPT not permitted during BDAT)")
+				break
+			}
 
 			match := rcptToRE.FindStringSubmatch(args)
 			if match == nil {
 				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid TO parameter)")
+			} else if !s.smtputf8 && !isASCII(match[1]) {
+				s.writef("553 5.6.7 Non-ASCII addresses require the SMTPUTF8 parameter")
+			} else if rcptDSN, err := parseRcptParams(parseParams(match[3])); err != nil {
+				s.writef("%s", err)
 			} else {
 				// RFC 5321 specifies 100 minimum recipients
 				if len(to) == 100 {
 					s.writef("452 4.5.3 Too many recipients")
 				} else {
-					accept := true
+					var err error
 					if s.srv.HandlerRcpt != nil {
-						accept = s.srv.HandlerRcpt(s, from, match[1])
+						err = s.srv.HandlerRcpt(s, from, match[1])
 					}
-					if accept {
+					if err == nil {
 						to = append(to, match[1])
+						s.dsn.Rcpts[match[1]] = rcptDSN
 						s.writef("250 2.1.5 Ok")
 					} else {
-						s.writef("550 5.1.0 Requested action not taken: mailbox unavailable")
+						s.writef("%s", err)
 					}
 				}
 			}
 		case "DATA":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+			if s.srv.TLSConfig != nil && s.listener.TLSRequired && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
-			if s.srv.AuthHandler != nil && s.srv.AuthRequired && !s.authenticated {
+			if s.authRequired() {
 				s.writef("530 5.7.0 Authentication required")
 				break
 			}
@@ -371,6 +626,19 @@ loop:
 				s.writef("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before DATA)")
 				break
 			}
+			if chunks != nil || s.body == BODY_BINARYMIME {
+				// RFC 3030 section 3, DATA can't be mixed with BDAT or
+				// used with BINARYMIME
+				s.writef("503 5.5.1 Bad sequence of commands (BDAT required)")
+				break
+			}
+
+			// The message is streamed to the file buffer, after our headers.
+			file, err := s.newBufferWithHeaders(from, to)
+			if err != nil {
+				s.writef("%s (message %s)", err, s.id.String())
+				break
+			}
 
 			s.writef("354 Start mail input; end with <CR><LF>.<CR><LF>")
 
@@ -378,8 +646,10 @@ loop:
 			// On timeout, send a timeout message and return from serve().
 			// On net.Error, assume the client has gone away i.e. return from serve().
 			// On other errors, allow the client to try again.
-			data, err := s.readData()
+			err = s.readData(file)
+			file.Close()
 			if err != nil {
+				deleteBuffer(s)
 				switch err.(type) {
 				case net.Error:
 					if err.(net.Error).Timeout() {
@@ -387,37 +657,90 @@ loop:
 					}
 					break loop
 				case maxSizeExceededError:
-					s.writef(err.Error())
+					s.replyData(to, err.Error())
 					continue
 				default:
-					s.writef("451 4.3.0 Requested action aborted: local error in processing")
+					s.replyData(to, "451 4.3.0 Requested action aborted: local error in processing")
 					continue
 				}
 			}
 
-			buffer, err := s.newBuffer()
+			s.deliver(from, to)
+
+			// Reset for next mail.
+			from = ""
+			gotFrom = false
+			to = nil
+		case "BDAT":
+			size, last, err := parseBDAT(args)
 			if err != nil {
-				s.writef("%s (message %s)", err, s.id.String())
-			} else {
-				buffer.Write(s.makeHeaders(to))
-				buffer.Write([]byte(s.makeMailHeader(to, from)))
-				buffer.Write([]byte("\n"))
-				buffer.Write(data)
-				buffer.Sync()
-				buffer.Close()
-
-				// Pass mail on to handler.
-				data, err := s.readBuffer()
+				// The chunk size is unknown, the session can't be recovered.
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid BDAT parameter)")
+				break loop
+			}
+
+			// The chunk is read even when the command is rejected, to stay in
+			// sync with the client.
+			var reject string
+			if s.srv.TLSConfig != nil && s.listener.TLSRequired && !s.tls {
+				reject = "530 5.7.0 Must issue a STARTTLS command first"
+			} else if s.authRequired() {
+				reject = "530 5.7.0 Authentication required"
+			} else if !gotFrom || len(to) == 0 {
+				reject = "503 5.5.1 Bad sequence of commands (MAIL & RCPT required before BDAT)"
+			} else if chunks == nil {
+				chunks, err = s.newBufferWithHeaders(from, to)
 				if err != nil {
-					s.writef("%s (message %s)", err, s.id.String())
+					reject = fmt.Sprintf("%s (message %s)", err, s.id.String())
+				}
+				chunksSize = 0
+				chunksTooBig = false
+			}
+
+			var w io.Writer = ioutil.Discard
+			if reject == "" && !chunksTooBig {
+				// The size limit is enforced while streaming but only
+				// reported after the last chunk.
+				if s.srv.MaxSize > 0 && chunksSize+size > int64(s.srv.MaxSize) {
+					chunksTooBig = true
 				} else {
-					err := s.srv.Handler(s, from, to, data)
-					if err != nil {
-						s.writef("%s (message %s)", err, s.id.String())
-					} else {
-						s.writef("250 2.0.0 Ok: queued as %s", s.id.String())
+					w = chunks
+				}
+			}
+
+			if err := s.readChunk(w, size); err != nil {
+				if netErr, ok := err.(net.Error); ok {
+					if netErr.Timeout() {
+						s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
 					}
+					break loop
+				}
+				if last && reject == "" {
+					s.replyData(to, "451 4.3.0 Requested action aborted: local error in processing")
+				} else {
+					s.writef("451 4.3.0 Requested action aborted: local error in processing")
 				}
+				abortChunks()
+				break
+			}
+
+			if reject != "" {
+				s.writef("%s", reject)
+				break
+			}
+			chunksSize += size
+			if !last {
+				s.writef("250 2.0.0 %d octets received", size)
+				break
+			}
+
+			chunks.Close()
+			chunks = nil
+			if chunksTooBig {
+				deleteBuffer(s)
+				s.replyData(to, maxSizeExceeded(s.srv.MaxSize).Error())
+			} else {
+				s.deliver(from, to)
 			}
 
 			// Reset for next mail.
@@ -428,7 +751,7 @@ loop:
 			s.writef("221 2.0.0 %s %s ESMTP Service closing transmission channel", s.srv.Hostname, s.srv.Appname)
 			break loop
 		case "RSET":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+			if s.srv.TLSConfig != nil && s.listener.TLSRequired && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
@@ -436,7 +759,7 @@ loop:
 			from = ""
 			gotFrom = false
 			to = nil
-			buffer.Reset()
+			abortChunks()
 		case "NOOP":
 			s.writef("250 2.0.0 Ok")
 		case "HELP", "VRFY", "EXPN":
@@ -450,7 +773,7 @@ loop:
 			}
 
 			// Handle case where TLS is requested but not configured (and therefore not listed as a service extension).
-			if s.srv.TLSConfig == nil {
+			if s.srv.TLSConfig == nil || s.listener.TLS == TLS_NONE {
 				s.writef("502 5.5.1 Command not implemented")
 				break
 			}
@@ -462,9 +785,10 @@ loop:
 			}
 
 			s.writef("220 2.0.0 Ready to start TLS")
+			s.flush()
 
 			// Establish a TLS connection with the client.
-			tlsConn := tls.Server(s.conn, s.srv.TLSConfig)
+			tlsConn := tls.Server(s.conn, s.srv.tlsConfig(s.listener))
 			err := tlsConn.Handshake()
 			if err != nil {
 				s.writef("403 4.7.0 TLS handshake failed")
@@ -475,21 +799,23 @@ loop:
 			s.conn = tlsConn
 			s.br = bufio.NewReader(s.conn)
 			s.bw = bufio.NewWriter(s.conn)
+			s.smtpReader = textproto.NewReader(s.br)
 			s.tls = true
+			s.authenticateClientCert()
 
 			// RFC 3207 specifies that the server must discard any prior knowledge obtained from the client.
 			s.remoteName = ""
 			from = ""
 			gotFrom = false
 			to = nil
-			buffer.Reset()
+			abortChunks()
 		case "AUTH":
-			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+			if s.srv.TLSConfig != nil && s.listener.TLSRequired && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
 				break
 			}
 			// Handle case where AUTH is requested but not configured (and therefore not listed as a service extension).
-			if s.srv.AuthHandler == nil {
+			if !s.authEnabled() {
 				s.writef("502 5.5.1 Command not implemented")
 				break
 			}
@@ -548,28 +874,28 @@ loop:
 				s.writef("535 5.7.8 Authentication credentials invalid")
 			}
 		case "XCLIENT":
-			fields := strings.Fields(line)[1:]
-			for _, field := range fields {
-				kv := strings.Split(field, "=")
-				switch kv[0] {
-				case "ADDR":
-					log.Infof("client addr %s", kv[1])
-					s.remoteIP = kv[1]
-
-					// Get remote end info for the Received header.
-					names, err := net.LookupAddr(s.remoteIP)
-					if err == nil && len(names) > 0 {
-						s.remoteHost = names[0]
-					} else {
-						s.remoteHost = "can't resovle"
-					}
-				case "NAME":
-					log.Infof("client name %s", kv[1])
-				default:
-					log.Warnf("XCLIENT attribute %s not supported", kv[0])
-				}
+			// XCLIENT overrides the client attributes, only trusted peers are
+			// allowed to use it.
+			if !s.xclient {
+				s.writef("550 5.7.0 Insufficient authorization")
+				break
 			}
-			s.writef("220 %s %s ESMTP", s.srv.Hostname, s.srv.Appname)
+			if gotFrom || len(to) > 0 {
+				s.writef("503 5.5.1 Bad sequence of commands (mail transaction in progress)")
+				break
+			}
+			if err := s.handleXClient(args); err != nil {
+				s.writef("%s", err)
+				break
+			}
+
+			// The session starts over with the new attributes, the client
+			// has to send HELO or EHLO again.
+			from = ""
+			gotFrom = false
+			to = nil
+			abortChunks()
+			s.writef("220 %s %s ESMTP Service ready", s.srv.Hostname, s.srv.Appname)
 		default:
 			log.Errorf("unexpected command in line: %s", line)
 			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
@@ -579,14 +905,27 @@ loop:
 }
 
 // Wrapper function for writing a complete line to the socket.
+// With PIPELINING (RFC 2920) the responses are only flushed once all the
+// commands sent by the client have been processed.
 func (s *session) writef(format string, args ...interface{}) error {
+	line := fmt.Sprintf(format, args...)
+
+	// Slow down the clients sending too many invalid commands
+	if isInvalidCommandReply(line) {
+		s.invalid++
+		if limits := s.snapshot.Limits; limits.TarpitAfter > 0 && s.invalid > limits.TarpitAfter {
+			metrics.Add(METRIC_TARPITTED, 1)
+			time.Sleep(limits.TarpitDelay)
+		}
+	}
+
 	if s.srv.Timeout > 0 {
 		s.conn.SetWriteDeadline(time.Now().Add(s.srv.Timeout))
 	}
-
-	line := fmt.Sprintf(format, args...)
-	fmt.Fprintf(s.bw, line+"\r\n")
-	err := s.bw.Flush()
+	_, err := io.WriteString(s.bw, line+"\r\n")
+	if err == nil && s.br.Buffered() == 0 {
+		err = s.bw.Flush()
+	}
 
 	if Debug {
 		verb := "WROTE"
@@ -600,8 +939,36 @@ func (s *session) writef(format string, args ...interface{}) error {
 	return err
 }
 
+// Flush the pending responses.
+func (s *session) flush() error {
+	if s.srv.Timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.srv.Timeout))
+	}
+	return s.bw.Flush()
+}
+
+// Flush the pending responses before blocking on a read, the client might be
+// waiting for them.
+func (s *session) flushBeforeRead() error {
+	if s.br.Buffered() == 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+// Wait for delay, returns true if the client sent something meanwhile
+func (s *session) talksBefore(delay time.Duration) bool {
+	s.conn.SetReadDeadline(time.Now().Add(delay))
+	defer s.conn.SetReadDeadline(time.Time{})
+	_, err := s.br.Peek(1)
+	return err == nil
+}
+
 // Read a complete line from the socket.
 func (s *session) readLine() (string, error) {
+	if err := s.flushBeforeRead(); err != nil {
+		return "", err
+	}
 	if s.srv.Timeout > 0 {
 		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
 	}
@@ -624,6 +991,201 @@ func (s *session) readLine() (string, error) {
 	return line, err
 }
 
+type esmtpParam struct {
+	key   string
+	value string
+}
+
+// Parse the ESMTP parameters following the address of MAIL or RCPT, ie
+// "SIZE=1000 SMTPUTF8". Keys are uppercased.
+func parseParams(args string) []esmtpParam {
+	params := []esmtpParam{}
+	for _, field := range strings.Fields(args) {
+		kv := strings.SplitN(field, "=", 2)
+		param := esmtpParam{key: strings.ToUpper(kv[0])}
+		if len(kv) == 2 {
+			param.value = kv[1]
+		}
+		params = append(params, param)
+	}
+	return params
+}
+
+// Validate the MAIL parameters and apply them to the session.
+func (s *session) handleMailParams(params []esmtpParam) error {
+	s.smtputf8 = false
+	s.body = BODY_7BIT
+	s.dsn = DSN{Rcpts: make(map[string]DSNRcpt)}
+	s.rcptMails = nil
+	for _, param := range params {
+		switch param.key {
+		case "RET":
+			switch strings.ToUpper(param.value) {
+			case DSN_RET_FULL, DSN_RET_HDRS:
+				s.dsn.Ret = strings.ToUpper(param.value)
+			default:
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid RET parameter)")
+			}
+		case "ENVID":
+			if _, err := xtextDecode(param.value); err != nil || param.value == "" {
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid ENVID parameter)")
+			}
+			s.dsn.EnvID = param.value
+		case "SIZE":
+			size, err := strconv.Atoi(param.value)
+			if err != nil { // Bad SIZE parameter
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
+			}
+			// Enforce the maximum message size if one is set.
+			if s.srv.MaxSize > 0 && size > s.srv.MaxSize {
+				return maxSizeExceeded(s.srv.MaxSize)
+			}
+		case "BODY":
+			switch strings.ToUpper(param.value) {
+			case BODY_7BIT, BODY_8BITMIME, BODY_BINARYMIME:
+				s.body = strings.ToUpper(param.value)
+			default:
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid BODY parameter)")
+			}
+		case "SMTPUTF8":
+			if param.value != "" {
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid SMTPUTF8 parameter)")
+			}
+			s.smtputf8 = true
+		default:
+			return errors.New("555 5.5.4 MAIL FROM parameters not recognized or not implemented")
+		}
+	}
+	return nil
+}
+
+// Validate the RCPT parameters.
+func parseRcptParams(params []esmtpParam) (DSNRcpt, error) {
+	rcptDSN := DSNRcpt{}
+	for _, param := range params {
+		switch param.key {
+		case "NOTIFY":
+			notify, err := parseNotify(param.value)
+			if err != nil {
+				return rcptDSN, errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid NOTIFY parameter)")
+			}
+			rcptDSN.Notify = notify
+		case "ORCPT":
+			orcpt, err := parseORcpt(param.value)
+			if err != nil {
+				return rcptDSN, errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid ORCPT parameter)")
+			}
+			rcptDSN.ORcpt = orcpt
+		default:
+			return rcptDSN, errors.New("555 5.5.4 RCPT TO parameters not recognized or not implemented")
+		}
+	}
+	return rcptDSN, nil
+}
+
+// Attributes supported by XCLIENT, advertised in EHLO
+var xclientAttrs = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN", "DESTADDR"}
+
+// Override the client attributes with the XCLIENT ones, see
+// http://www.postfix.org/XCLIENT_README.html. Values are xtext encoded,
+// [UNAVAILABLE] and [TEMPUNAVAIL] mean that the proxy doesn't know it.
+func (s *session) handleXClient(args string) error {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return errors.New("501 5.5.4 Syntax error in parameters or arguments (attribute required)")
+	}
+
+	next := *s
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid XCLIENT attribute)")
+		}
+		key := strings.ToUpper(kv[0])
+		value, err := xtextDecode(kv[1])
+		if err != nil {
+			return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid XCLIENT value)")
+		}
+		unavailable := value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]"
+
+		switch key {
+		case "NAME":
+			if unavailable {
+				value = "unknown"
+			}
+			next.remoteHost = value
+		case "ADDR", "DESTADDR":
+			if !unavailable {
+				ip := net.ParseIP(strings.TrimPrefix(strings.ToUpper(value), "IPV6:"))
+				if ip == nil {
+					return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid XCLIENT address)")
+				}
+				value = ip.String()
+			} else {
+				value = "unknown"
+			}
+			if key == "ADDR" {
+				// the reverse DNS of the previous address doesn't apply
+				// anymore, unless NAME is supplied as well
+				next.remoteIP = value
+				if next.remoteHost == s.remoteHost {
+					next.remoteHost = "unknown"
+				}
+			} else {
+				next.destAddr = value
+			}
+		case "PORT":
+			if unavailable {
+				value = ""
+			} else if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid XCLIENT port)")
+			}
+			next.remotePort = value
+		case "PROTO":
+			switch strings.ToUpper(value) {
+			case "SMTP", "ESMTP":
+				next.proto = strings.ToUpper(value)
+			default:
+				return errors.New("501 5.5.4 Syntax error in parameters or arguments (invalid XCLIENT protocol)")
+			}
+		case "HELO":
+			if unavailable {
+				value = ""
+			}
+			next.remoteName = value
+		case "LOGIN":
+			if unavailable {
+				value = ""
+			}
+			next.login = value
+			next.authenticated = value != ""
+		default:
+			return fmt.Errorf("501 5.5.4 Syntax error in parameters or arguments (unsupported XCLIENT attribute %s)", key)
+		}
+	}
+
+	log.Infof("XCLIENT name=%s addr=%s port=%s proto=%s helo=%s login=%s destaddr=%s",
+		next.remoteHost, next.remoteIP, next.remotePort, next.proto, next.remoteName, next.login, next.destAddr)
+	s.remoteHost = next.remoteHost
+	s.remoteIP = next.remoteIP
+	s.remotePort = next.remotePort
+	s.proto = next.proto
+	s.remoteName = next.remoteName
+	s.login = next.login
+	s.authenticated = next.authenticated
+	s.destAddr = next.destAddr
+	return nil
+}
+
+func isASCII(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
 // Parse a line read from the socket.
 func (s *session) parseLine(line string) (verb string, args string) {
 	if idx := strings.Index(line, " "); idx != -1 {
@@ -636,27 +1198,160 @@ func (s *session) parseLine(line string) (verb string, args string) {
 	return verb, args
 }
 
-// Read the message data following a DATA command.
-func (s *session) readData() ([]byte, error) {
+// Create the file buffer of the mail transaction and write our headers.
+func (s *session) newBufferWithHeaders(from string, to []string) (*os.File, error) {
+	file, err := s.newBuffer()
+	if err != nil {
+		return nil, err
+	}
+	file.Write(s.makeHeaders(to))
+	file.Write([]byte(s.makeMailHeader(to, from)))
+	file.Write([]byte("\n"))
+	return file, nil
+}
+
+// Pass the mail in the file buffer on to the handler and reply.
+func (s *session) deliver(from string, to []string) {
+	s.messages++
+	// the buffer is used by all the recipients, the background deliveries
+	// keep their own handle on it
+	defer deleteBuffer(s)
+	data, err := s.readBuffer()
+	if err != nil {
+		s.replyData(to, fmt.Sprintf("%s (message %s)", err, s.id.String()))
+		return
+	}
+	defer s.closeBuffer()
+
+	errs := s.srv.Handler(s, from, to, data)
+	if s.listener.LMTP {
+		// RFC 2033 section 4.2, a reply for each recipient in the order of RCPT
+		for i, rcpt := range to {
+			if i < len(errs) && errs[i] != nil {
+				s.writef("%s (message %s, recipient <%s>)", errs[i], s.id.String(), rcpt)
+			} else {
+				s.writef("250 2.0.0 <%s> Ok: queued as %s", rcpt, s.id.String())
+			}
+		}
+		return
+	}
+	// SMTP has a single reply. A temporary failure of a recipient makes the
+	// client retry the message, the deduplication skips the recipients which
+	// succeeded. The message is refused if all the recipients failed, else
+	// the sender is notified of the permanent failures.
+	var temporary, permanent error
+	accepted := false
+	for i := range to {
+		switch {
+		case i >= len(errs) || errs[i] == nil:
+			accepted = true
+		case isPermanentReply(errs[i].Error()):
+			if permanent == nil {
+				permanent = errs[i]
+			}
+		case temporary == nil:
+			temporary = errs[i]
+		}
+	}
+	if temporary != nil {
+		s.writef("%s (message %s)", temporary, s.id.String())
+		return
+	}
+	if !accepted {
+		s.writef("%s (message %s)", permanent, s.id.String())
+		return
+	}
+	if permanent != nil {
+		notifyFailedRcpts(s, from, to, errs, data)
+	}
+	s.writef("250 2.0.0 Ok: queued as %s", s.id.String())
+}
+
+// Reply to the end of the data, once for each recipient in LMTP.
+func (s *session) replyData(to []string, reply string) {
+	if !s.listener.LMTP {
+		s.writef("%s", reply)
+		return
+	}
+	for range to {
+		s.writef("%s", reply)
+	}
+}
+
+// Parse the arguments of BDAT: the chunk size and the optional LAST keyword.
+func parseBDAT(args string) (int64, bool, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, false, errors.New("invalid BDAT arguments")
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		return 0, false, errors.New("invalid BDAT size")
+	}
+	last := false
+	if len(fields) == 2 {
+		if strings.ToUpper(fields[1]) != "LAST" {
+			return 0, false, errors.New("invalid BDAT arguments")
+		}
+		last = true
+	}
+	return size, last, nil
+}
+
+// Read a BDAT chunk of exactly size bytes and write it to w, the chunk is
+// binary and isn't dot-stuffed. The whole chunk is read even if w fails, the
+// rest of it would be taken for commands.
+func (s *session) readChunk(w io.Writer, size int64) error {
+	if err := s.flushBeforeRead(); err != nil {
+		return err
+	}
+	if s.srv.Timeout > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
+	}
+	chunk := io.LimitReader(s.br, size)
+	n, err := io.Copy(w, chunk)
+	if err == nil && n < size {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		if _, discardErr := io.Copy(ioutil.Discard, chunk); discardErr != nil {
+			return discardErr
+		}
+	}
+	return err
+}
+
+// Read the message data following a DATA command and write it to w. The
+// maximum message size is enforced while streaming, the rest of the message
+// is discarded once it's exceeded.
+func (s *session) readData(w io.Writer) error {
+	if err := s.flushBeforeRead(); err != nil {
+		return err
+	}
 	if s.srv.Timeout > 0 {
 		s.conn.SetReadDeadline(time.Now().Add(s.srv.Timeout))
 	}
 
-	buf := new(bytes.Buffer)
-	n, err := buf.ReadFrom(s.smtpReader.DotReader())
+	dot := s.smtpReader.DotReader()
+	var r io.Reader = dot
+	if s.srv.MaxSize > 0 {
+		r = io.LimitReader(dot, int64(s.srv.MaxSize)+1)
+	}
+
+	n, err := io.Copy(w, r)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Enforce the maximum message size limit.
-	if s.srv.MaxSize > 0 {
-		if n > int64(s.srv.MaxSize) {
-			_, _ = s.br.Discard(s.br.Buffered()) // Discard the buffer remnants.
-			return nil, maxSizeExceeded(s.srv.MaxSize)
+	if s.srv.MaxSize > 0 && n > int64(s.srv.MaxSize) {
+		if _, err := io.Copy(ioutil.Discard, dot); err != nil {
+			return err
 		}
+		return maxSizeExceeded(s.srv.MaxSize)
 	}
 
-	return buf.Bytes(), nil
+	return nil
 }
 
 // Create the Received header to comply with RFC 2821 section 3.8.2.
@@ -665,7 +1360,18 @@ func (s *session) makeHeaders(to []string) []byte {
 	var buffer bytes.Buffer
 	now := time.Now().Format("Mon, _2 Jan 2006 15:04:05 -0700 (MST)")
 	buffer.WriteString(fmt.Sprintf("Received: from %s (%s [%s])\r\n", s.remoteName, s.remoteHost, s.remoteIP))
-	buffer.WriteString(fmt.Sprintf("        by %s (%s) with SMTP\r\n", s.srv.Hostname, s.srv.Appname))
+	if s.login != "" {
+		buffer.WriteString(fmt.Sprintf("        (Authenticated sender: %s)\r\n", s.login))
+	}
+	protocol := "SMTP"
+	if s.proto != "" {
+		protocol = s.proto
+	}
+	if s.smtputf8 {
+		// RFC 6531 section 3.7.3
+		protocol = "UTF8SMTP"
+	}
+	buffer.WriteString(fmt.Sprintf("        by %s (%s) with %s\r\n", s.srv.Hostname, s.srv.Appname, protocol))
 	buffer.WriteString(fmt.Sprintf("        for <%s>; %s\r\n", to[0], now))
 	return buffer.Bytes()
 }
@@ -693,13 +1399,25 @@ func (s *session) makeEHLOResponse() (response string) {
 	// RFC 1870 specifies that "SIZE 0" indicates no maximum size is in force.
 	response += fmt.Sprintf("250-SIZE %d\r\n", s.srv.MaxSize)
 
+	response += "250-PIPELINING\r\n"
+	response += "250-DSN\r\n"
+	response += "250-8BITMIME\r\n"
+	response += "250-CHUNKING\r\n"
+	response += "250-BINARYMIME\r\n"
+	response += "250-SMTPUTF8\r\n"
+
+	// Only list XCLIENT for the peers allowed to use it.
+	if s.xclient {
+		response += "250-XCLIENT " + strings.Join(xclientAttrs, " ") + "\r\n"
+	}
+
 	// Only list STARTTLS if TLS is configured, but not currently in use.
-	if s.srv.TLSConfig != nil && !s.tls {
+	if s.srv.TLSConfig != nil && s.listener.TLS != TLS_NONE && !s.tls {
 		response += "250-STARTTLS\r\n"
 	}
 
-	// Only list AUTH if an AuthHandler is configured and at least one mechanism is allowed.
-	if s.srv.AuthHandler != nil {
+	// Only list AUTH if it's enabled on the listener and at least one mechanism is allowed.
+	if s.authEnabled() {
 		var mechs []string
 		for mech, allowed := range s.authMechs() {
 			if allowed {
@@ -743,7 +1461,10 @@ func (s *session) handleAuthLogin(arg string) (bool, error) {
 	}
 
 	// Validate credentials.
-	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "LOGIN", username, password, nil)
+	authenticated, err := s.srv.AuthHandler(s, "LOGIN", username, password, nil)
+	if authenticated {
+		s.login = string(username)
+	}
 
 	return authenticated, err
 }
@@ -771,7 +1492,10 @@ func (s *session) handleAuthPlain(arg string) (bool, error) {
 	}
 
 	// Validate credentials.
-	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "PLAIN", parts[1], parts[2], nil)
+	authenticated, err := s.srv.AuthHandler(s, "PLAIN", parts[1], parts[2], nil)
+	if authenticated {
+		s.login = string(parts[1])
+	}
 
 	return authenticated, err
 }
@@ -801,7 +1525,10 @@ func (s *session) handleAuthCramMD5() (bool, error) {
 	}
 
 	// Validate credentials.
-	authenticated, err := s.srv.AuthHandler(s.conn.RemoteAddr(), "CRAM-MD5", []byte(fields[0]), []byte(fields[1]), []byte(shared))
+	authenticated, err := s.srv.AuthHandler(s, "CRAM-MD5", []byte(fields[0]), []byte(fields[1]), []byte(shared))
+	if authenticated {
+		s.login = fields[0]
+	}
 
 	return authenticated, err
 }
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mailway-app/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func withBufferLocation(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := BUFFER_LOCATION
+	BUFFER_LOCATION = dir
+	t.Cleanup(func() {
+		BUFFER_LOCATION = prev
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func testRcptHandler(s *session, from string, to string) error {
+	s.id = uuid.New()
+	s.domain = &Domain{Name: "test.local", Status: DOMAIN_ACTIVE}
+	return nil
+}
+
+// testServer is the setup of a server started by startTestServer
+type testServer struct {
+	srv *Server
+	// wrap replaces the listener the server accepts the connections on
+	wrap func(ln net.Listener) net.Listener
+	// served receives the error returned by the server
+	served chan error
+}
+
+type testServerOption func(t *testing.T, ts *testServer)
+
+// withServed sends the error returned by the server to served
+func withServed(served chan error) testServerOption {
+	return func(t *testing.T, ts *testServer) {
+		ts.served = served
+	}
+}
+
+// withCapture sends the data of each message received by the server to received
+func withCapture(received chan string) testServerOption {
+	return func(t *testing.T, ts *testServer) {
+		withBufferLocation(t)
+		ts.srv.HandlerRcpt = testRcptHandler
+		ts.srv.Handler = func(s *session, from string, to []string, data *io.SectionReader) []error {
+			b, err := ioutil.ReadAll(io.NewSectionReader(data, 0, data.Size()))
+			assert.Nil(t, err)
+			received <- string(b)
+			return nil
+		}
+	}
+}
+
+// startTestServer serves on a loopback address, or on the listeners of srv
+// if it has any, and returns the address of the first one
+func startTestServer(t *testing.T, srv *Server, opts ...testServerOption) string {
+	ts := &testServer{srv: srv}
+	for _, opt := range opts {
+		opt(t, ts)
+	}
+	if srv.Hostname == "" {
+		srv.Hostname = "test.local"
+	}
+	if srv.Appname == "" {
+		srv.Appname = "fwdr"
+	}
+
+	var addr string
+	var serve func() error
+	if len(srv.Listeners) > 0 {
+		addr = srv.Listeners[0].Addr
+		serve = func() error { return srv.ListenAndServe(&config.Config{}) }
+	} else {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		addr = ln.Addr().String()
+		l := ln
+		if ts.wrap != nil {
+			l = ts.wrap(ln)
+		}
+		serve = func() error { return srv.Serve(l, &config.Config{}) }
+	}
+	go func() {
+		err := serve()
+		if ts.served != nil {
+			ts.served <- err
+		}
+	}()
+	t.Cleanup(func() {
+		// wait for the sessions before the test environment is restored
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+
+	// wait for every listener to be ready
+	for _, l := range srv.Listeners {
+		for i := 0; ; i++ {
+			conn, err := net.Dial(l.Network, l.Addr)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if i == 50 {
+				t.Fatalf("listener %s not ready: %s", &l, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return addr
+}
+
+// testDial is the setup of a connection opened by dialTestServer
+type testDial struct {
+	network  string
+	preamble []byte
+	code     int
+	greeting *string
+}
+
+type dialOption func(d *testDial)
+
+// withNetwork dials addr on network instead of tcp
+func withNetwork(network string) dialOption {
+	return func(d *testDial) {
+		d.network = network
+	}
+}
+
+// withGreeting expects a greeting with code and stores its message in greeting
+func withGreeting(code int, greeting *string) dialOption {
+	return func(d *testDial) {
+		d.code = code
+		d.greeting = greeting
+	}
+}
+
+// withPreamble writes b before the greeting of the server is read
+func withPreamble(b []byte) dialOption {
+	return func(d *testDial) {
+		d.preamble = b
+	}
+}
+
+func dialTestServer(t *testing.T, addr string, opts ...dialOption) *textproto.Conn {
+	d := &testDial{network: "tcp", code: 220}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	conn, err := net.Dial(d.network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := textproto.NewConn(conn)
+	t.Cleanup(func() { c.Close() })
+	if _, err := conn.Write(d.preamble); err != nil {
+		t.Fatal(err)
+	}
+
+	_, msg, err := c.ReadResponse(d.code)
+	assert.Nil(t, err)
+	if d.greeting != nil {
+		*d.greeting = msg
+	}
+	return c
+}
+
+func cmd(t *testing.T, c *textproto.Conn, expectCode int, format string, args ...interface{}) string {
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	_, msg, err := c.ReadResponse(expectCode)
+	assert.Nil(t, err, "unexpected response to %s: %s", format, msg)
+	return msg
+}
+
+func TestEHLOAdvertiseSMTPUTF8(t *testing.T) {
+	addr := startTestServer(t, &Server{})
+	c := dialTestServer(t, addr)
+
+	msg := cmd(t, c, 250, "EHLO client.local")
+	assert.Contains(t, msg, "SMTPUTF8")
+}
+
+func TestMailParams(t *testing.T) {
+	addr := startTestServer(t, &Server{MaxSize: 1000})
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee> SIZE=100 SMTPUTF8")
+	cmd(t, c, 552, "MAIL FROM:<a@b.ee> SIZE=10000")
+	cmd(t, c, 501, "MAIL FROM:<a@b.ee> SIZE=abc")
+	cmd(t, c, 555, "MAIL FROM:<a@b.ee> FOO=BAR")
+}
+
+func TestNonASCIIAddressRequiresSMTPUTF8(t *testing.T) {
+	addr := startTestServer(t, &Server{})
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 553, "MAIL FROM:<jörg@bücher.de>")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 553, "RCPT TO:<info@bücher.de>")
+
+	cmd(t, c, 250, "MAIL FROM:<jörg@bücher.de> SMTPUTF8")
+	cmd(t, c, 250, "RCPT TO:<info@bücher.de>")
+}
+
+func sendTestData(t *testing.T, c *textproto.Conn, body string) {
+	w := c.DotWriter()
+	if _, err := io.WriteString(w, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataStreamedToBuffer(t *testing.T) {
+	dir := withBufferLocation(t)
+
+	received := make(chan string, 1)
+	addr := startTestServer(t, &Server{
+		MaxSize:     1000,
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			b, err := ioutil.ReadAll(io.NewSectionReader(data, 0, data.Size()))
+			assert.Nil(t, err)
+			received <- string(b)
+			return nil
+		},
+	})
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\nHello world!\r\n")
+	_, _, err := c.ReadResponse(250)
+	assert.Nil(t, err)
+
+	data := <-received
+	assert.True(t, strings.HasPrefix(data, "Received: from client.local"))
+	assert.Contains(t, data, "Mw-Int-Mail-From: a@b.ee")
+	// the dot reader converts the line endings
+	assert.True(t, strings.HasSuffix(data, "Subject: test\n\nHello world!\n"))
+
+	// deleted once delivered
+	cmd(t, c, 250, "NOOP")
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 0)
+}
+
+func TestDataMaxSizeExceeded(t *testing.T) {
+	dir := withBufferLocation(t)
+
+	addr := startTestServer(t, &Server{
+		MaxSize:     100,
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			t.Error("handler should not be called")
+			return nil
+		},
+	})
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\n"+strings.Repeat("a", 10000)+"\r\n")
+	_, _, err := c.ReadResponse(552)
+	assert.Nil(t, err)
+
+	// the session is still usable after the rest of the message was discarded
+	cmd(t, c, 250, "NOOP")
+
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 0)
+}
+
+func sendTestChunk(t *testing.T, c *textproto.Conn, expectCode int, chunk string, last bool) {
+	line := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		line += " LAST"
+	}
+	if _, err := c.W.WriteString(line + "\r\n" + chunk); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.W.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := c.ReadResponse(expectCode)
+	assert.Nil(t, err, "unexpected response to %s: %s", line, msg)
+}
+
+func TestBDAT(t *testing.T) {
+	received := make(chan string, 1)
+	addr := startTestServer(t, &Server{MaxSize: 1000}, withCapture(received))
+	c := dialTestServer(t, addr)
+
+	msg := cmd(t, c, 250, "EHLO client.local")
+	assert.Contains(t, msg, "CHUNKING")
+	assert.Contains(t, msg, "BINARYMIME")
+	assert.Contains(t, msg, "8BITMIME")
+
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee> BODY=BINARYMIME")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 503, "DATA")
+	sendTestChunk(t, c, 250, "Subject: test\r\n\r\n", false)
+	cmd(t, c, 503, "RCPT TO:<d@test.local>")
+	sendTestChunk(t, c, 250, "Hello\r\n.\r\nworld\x00\r\n", false)
+	sendTestChunk(t, c, 250, "", true)
+
+	data := <-received
+	// chunks are kept as is, without line ending conversion or dot-unstuffing
+	assert.True(t, strings.HasSuffix(data, "Subject: test\r\n\r\nHello\r\n.\r\nworld\x00\r\n"))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestReadChunkWriteError(t *testing.T) {
+	s := &session{
+		srv: &Server{},
+		br:  bufio.NewReader(strings.NewReader(strings.Repeat("a", 100000) + "NOOP\r\n")),
+		bw:  bufio.NewWriter(ioutil.Discard),
+	}
+	assert.EqualError(t, s.readChunk(failingWriter{}, 100000), "disk full")
+	// the rest of the chunk isn't taken for a command
+	line, err := s.br.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "NOOP\r\n", line)
+}
+
+func TestBDATMaxSizeExceeded(t *testing.T) {
+	addr := startTestServer(t, &Server{MaxSize: 100}, withCapture(make(chan string, 1)))
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	sendTestChunk(t, c, 250, strings.Repeat("a", 80), false)
+	// the limit is only reported after the last chunk
+	sendTestChunk(t, c, 250, strings.Repeat("a", 80), false)
+	sendTestChunk(t, c, 552, strings.Repeat("a", 10), true)
+
+	cmd(t, c, 250, "NOOP")
+	files, err := ioutil.ReadDir(BUFFER_LOCATION)
+	assert.Nil(t, err)
+	assert.Len(t, files, 0)
+}
+
+func TestBDATWithoutTransaction(t *testing.T) {
+	addr := startTestServer(t, &Server{MaxSize: 1000}, withCapture(make(chan string, 1)))
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "EHLO client.local")
+	// the chunk is consumed even if the command is rejected
+	sendTestChunk(t, c, 503, "NOOP\r\n", true)
+	cmd(t, c, 250, "NOOP")
+}
+
+// Conn counting the writes of the server, to check that pipelined responses
+// are batched
+type countingConn struct {
+	net.Conn
+	writes chan int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes <- strings.Count(string(b), "\r\n")
+	return c.Conn.Write(b)
+}
+
+func TestPipelining(t *testing.T) {
+	withBufferLocation(t)
+
+	received := make(chan string, 1)
+	srv := &Server{
+		Hostname:    "test.local",
+		Appname:     "fwdr",
+		MaxSize:     1000,
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			received <- "ok"
+			return nil
+		},
+	}
+
+	server, client := net.Pipe()
+	writes := make(chan int, 100)
+	s := srv.newSession(&countingConn{server, writes}, &config.Config{})
+	go s.serve()
+	t.Cleanup(func() { client.Close() })
+
+	c := textproto.NewConn(client)
+	_, _, err := c.ReadResponse(220)
+	assert.Nil(t, err)
+	assert.Equal(t, <-writes, 1)
+
+	msg := cmd(t, c, 250, "EHLO client.local")
+	assert.Contains(t, msg, "PIPELINING")
+	assert.Contains(t, msg, "ENHANCEDSTATUSCODES")
+	<-writes
+
+	// a pipelined group, sent in a single write
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		c.W.WriteString("MAIL FROM:<a@b.ee>\r\n" +
+			"RCPT TO:<c@test.local>\r\n" +
+			"RCPT TO:bad\r\n" +
+			"RCPT TO:<d@test.local>\r\n" +
+			"DATA\r\n")
+		c.W.Flush()
+	}()
+
+	for _, code := range []int{250, 250, 501, 250, 354} {
+		_, _, err := c.ReadResponse(code)
+		assert.Nil(t, err)
+	}
+	// all the responses of the group were flushed at once
+	assert.Equal(t, <-writes, 5)
+	<-sent
+
+	sent = make(chan struct{})
+	go func() {
+		defer close(sent)
+		w := c.DotWriter()
+		io.WriteString(w, "Subject: test\r\n\r\nHello\r\n")
+		w.Close()
+	}()
+	_, _, err = c.ReadResponse(250)
+	assert.Nil(t, err)
+	assert.Equal(t, <-received, "ok")
+	<-sent
+
+	// the session continues normally after a group
+	cmd(t, c, 250, "NOOP")
+}
+
+// withTrustedNetworks trusts the clients of the networks
+func withTrustedNetworks(trusted ...string) testServerOption {
+	return func(t *testing.T, ts *testServer) {
+		networks, err := parseNetworks(trusted)
+		assert.Nil(t, err)
+		ts.srv.TrustedNetworks = networks
+	}
+}
+
+func TestXCLIENT(t *testing.T) {
+	received := make(chan string, 1)
+	addr := startTestServer(t, &Server{}, withTrustedNetworks("127.0.0.0/8"), withCapture(received))
+	c := dialTestServer(t, addr)
+
+	assert.Contains(t, cmd(t, c, 250, "EHLO proxy.local"), "XCLIENT NAME ADDR PORT PROTO HELO LOGIN DESTADDR")
+	cmd(t, c, 220, "XCLIENT NAME=mail.example.org ADDR=IPV6:2001:DB8::1 PORT=4242")
+	cmd(t, c, 220, "XCLIENT HELO=client.example.org PROTO=ESMTP LOGIN=alice+40example.org DESTADDR=192.0.2.2")
+	cmd(t, c, 250, "EHLO client.example.org")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\nHello\r\n")
+	_, _, err := c.ReadResponse(250)
+	assert.Nil(t, err)
+
+	data := <-received
+	assert.Contains(t, data, "Received: from client.example.org (mail.example.org [2001:db8::1])")
+	assert.Contains(t, data, "(Authenticated sender: alice@example.org)")
+	assert.Contains(t, data, "with ESMTP")
+}
+
+func TestXCLIENTUnavailable(t *testing.T) {
+	received := make(chan string, 1)
+	addr := startTestServer(t, &Server{}, withTrustedNetworks("127.0.0.0/8"), withCapture(received))
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 220, "XCLIENT NAME=[TEMPUNAVAIL] ADDR=192.0.2.1 HELO=[UNAVAILABLE] LOGIN=[UNAVAILABLE]")
+	cmd(t, c, 250, "HELO client.example.org")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\nHello\r\n")
+	_, _, err := c.ReadResponse(250)
+	assert.Nil(t, err)
+
+	data := <-received
+	assert.Contains(t, data, "Received: from client.example.org (unknown [192.0.2.1])")
+	assert.NotContains(t, data, "Authenticated sender")
+	assert.Contains(t, data, "with SMTP")
+}
+
+func TestXCLIENTInvalid(t *testing.T) {
+	addr := startTestServer(t, &Server{}, withTrustedNetworks("127.0.0.0/8"), withCapture(make(chan string, 1)))
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "EHLO proxy.local")
+	cmd(t, c, 501, "XCLIENT")
+	cmd(t, c, 501, "XCLIENT FOO=bar")
+	cmd(t, c, 501, "XCLIENT ADDR=not-an-ip")
+	cmd(t, c, 501, "XCLIENT PORT=123456")
+	cmd(t, c, 501, "XCLIENT PROTO=LMTP")
+	// nothing is applied when an attribute is invalid
+	cmd(t, c, 501, "XCLIENT ADDR=192.0.2.1 PORT=abc")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 503, "XCLIENT ADDR=192.0.2.1")
+	cmd(t, c, 250, "RSET")
+	cmd(t, c, 220, "XCLIENT ADDR=192.0.2.1")
+}
+
+// failingMailboxHandler fails the recipients full@ and unknown@
+func failingMailboxHandler(s *session, from string, to []string, data *io.SectionReader) []error {
+	errs := make([]error, len(to))
+	for i, rcpt := range to {
+		switch {
+		case strings.HasPrefix(rcpt, "full@"):
+			errs[i] = errors.New("452 4.2.2 Mailbox full")
+		case strings.HasPrefix(rcpt, "unknown@"):
+			errs[i] = errors.New("550 5.1.1 Mailbox unavailable")
+		}
+	}
+	return errs
+}
+
+func TestLMTP(t *testing.T) {
+	withBufferLocation(t)
+
+	addr := startTestServer(t, &Server{
+		LMTP:        true,
+		MaxSize:     1000,
+		HandlerRcpt: testRcptHandler,
+		Handler:     failingMailboxHandler,
+	})
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 500, "HELO client.local")
+	cmd(t, c, 500, "EHLO client.local")
+	msg := cmd(t, c, 250, "LHLO client.local")
+	assert.Contains(t, msg, "PIPELINING")
+
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 250, "RCPT TO:<full@test.local>")
+	cmd(t, c, 250, "RCPT TO:<d@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\nHello world!\r\n")
+
+	// a reply for each recipient, in order
+	_, msg, err := c.ReadResponse(250)
+	assert.Nil(t, err)
+	assert.Contains(t, msg, "<c@test.local>")
+	_, msg, err = c.ReadResponse(452)
+	assert.Nil(t, err)
+	assert.Contains(t, msg, "<full@test.local>")
+	_, msg, err = c.ReadResponse(250)
+	assert.Nil(t, err)
+	assert.Contains(t, msg, "<d@test.local>")
+
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<full@test.local>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	sendTestChunk(t, c, 452, "Subject: test\r\n\r\nHello\r\n", true)
+	_, _, err = c.ReadResponse(250)
+	assert.Nil(t, err)
+}
+
+func TestLMTPMaxSizeExceeded(t *testing.T) {
+	withBufferLocation(t)
+
+	addr := startTestServer(t, &Server{
+		LMTP:        true,
+		MaxSize:     1000,
+		HandlerRcpt: testRcptHandler,
+		Handler:     failingMailboxHandler,
+	})
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 250, "LHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 250, "RCPT TO:<d@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\n"+strings.Repeat("a", 1000)+"\r\n")
+	for i := 0; i < 2; i++ {
+		_, _, err := c.ReadResponse(552)
+		assert.Nil(t, err)
+	}
+	cmd(t, c, 250, "NOOP")
+}
+
+func TestSMTPPartialFailure(t *testing.T) {
+	withBufferLocation(t)
+
+	// mailout
+	notices := make(chan string, 1)
+	mailout := startTestServer(t, &Server{
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			b, _ := ioutil.ReadAll(io.NewSectionReader(data, 0, data.Size()))
+			notices <- strings.Join(to, ",") + "\n" + string(b)
+			return nil
+		},
+	})
+	_, port, err := net.SplitHostPort(mailout)
+	assert.Nil(t, err)
+	instance := &config.Config{InstanceHostname: "mx.test.local"}
+	instance.PortMailout, _ = strconv.Atoi(port)
+
+	addr := startTestServer(t, &Server{
+		HandlerRcpt: testRcptHandler,
+		Handler:     failingMailboxHandler,
+		Snapshot: func() *Snapshot {
+			return &Snapshot{Config: instance}
+		},
+	})
+	c := dialTestServer(t, addr)
+
+	cmd(t, c, 500, "LHLO client.local")
+	cmd(t, c, 250, "EHLO client.local")
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 250, "RCPT TO:<unknown@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\nHello world!\r\n")
+
+	// accepted for the others, the sender is notified of the permanent failure
+	_, _, err = c.ReadResponse(250)
+	assert.Nil(t, err)
+	notice := <-notices
+	assert.True(t, strings.HasPrefix(notice, "a@b.ee\n"))
+	assert.Contains(t, notice, "Final-Recipient: rfc822; unknown@test.local")
+	assert.Contains(t, notice, "Action: failed")
+	assert.Contains(t, notice, "Status: 5.1.1")
+	assert.NotContains(t, notice, "Final-Recipient: rfc822; c@test.local")
+
+	// a temporary failure makes the client retry the message
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<c@test.local>")
+	cmd(t, c, 250, "RCPT TO:<unknown@test.local>")
+	cmd(t, c, 250, "RCPT TO:<full@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\nHello world!\r\n")
+	_, _, err = c.ReadResponse(452)
+	assert.Nil(t, err)
+	cmd(t, c, 250, "NOOP")
+	assert.Len(t, notices, 0)
+
+	// refused when all of them failed
+	cmd(t, c, 250, "MAIL FROM:<a@b.ee>")
+	cmd(t, c, 250, "RCPT TO:<unknown@test.local>")
+	cmd(t, c, 354, "DATA")
+	sendTestData(t, c, "Subject: test\r\n\r\nHello world!\r\n")
+	_, _, err = c.ReadResponse(550)
+	assert.Nil(t, err)
+	cmd(t, c, 250, "NOOP")
+	assert.Len(t, notices, 0)
+}
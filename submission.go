@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mailway-app/config"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	authError         = errors.New("454 4.7.0 Temporary authentication failure")
+	headerSenderError = errors.New("550 5.7.1 Header sender rejected: not owned by user")
+)
+
+// Credentials of the users of the submission listeners
+type CredentialStore interface {
+	// Returns the domains the user can send from, none if the credentials
+	// are invalid
+	Authenticate(username string, password string) ([]string, error)
+}
+
+func newCredentialStore(instance *config.Config) CredentialStore {
+	if instance.IsInstanceLocal() {
+		return &fileCredentials{dir: path.Join(config.ROOT_LOCATION, "domain.d")}
+	}
+	return &apiCredentials{instance: instance}
+}
+
+// The users of a domain are in <domain>.passwd next to its configuration,
+// one local part and password hash (bcrypt or argon2) per line:
+//
+//	alice:$2y$10$...
+//	bob:$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+type fileCredentials struct {
+	dir string
+}
+
+func (store *fileCredentials) Authenticate(username string, password string) ([]string, error) {
+	local, domain := splitAddress(username)
+	if local == "" || domain == "" {
+		return nil, nil
+	}
+	domain, err := normalizeDomain(domain)
+	if err != nil {
+		return nil, nil
+	}
+
+	file, err := os.Open(path.Join(store.dir, domain+".passwd"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open credentials")
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], local) {
+			continue
+		}
+		ok, err := checkPassword(parts[1], password)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid password hash for %s", username)
+		}
+		if !ok {
+			return nil, nil
+		}
+		return []string{domain}, nil
+	}
+	return nil, errors.Wrap(scanner.Err(), "could not read credentials")
+}
+
+type apiCredentials struct {
+	instance *config.Config
+}
+
+func (store *apiCredentials) Authenticate(username string, password string) ([]string, error) {
+	domains, err := getAPIUserDomains(store.instance, username, password)
+	if err != nil {
+		return nil, err
+	}
+	for i, domain := range domains {
+		if ascii, err := normalizeDomain(domain); err == nil {
+			domains[i] = ascii
+		}
+	}
+	return domains, nil
+}
+
+// Compare a password with its bcrypt or argon2 (PHC string format) hash
+func checkPassword(hash string, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+
+	case strings.HasPrefix(hash, "$argon2id$"), strings.HasPrefix(hash, "$argon2i$"):
+		// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, errors.New("invalid argon2 hash")
+		}
+		var version int
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+			return false, errors.New("unsupported argon2 version")
+		}
+		var memory, time uint32
+		var threads uint8
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+			return false, errors.Wrap(err, "invalid argon2 parameters")
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, errors.Wrap(err, "invalid argon2 salt")
+		}
+		key, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, errors.Wrap(err, "invalid argon2 key")
+		}
+		var other []byte
+		if parts[1] == "argon2id" {
+			other = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+		} else {
+			other = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(key)))
+		}
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+	return false, errors.New("unsupported password hash")
+}
+
+func authHandler(store CredentialStore) AuthHandler {
+	return func(s *session, mechanism string, username []byte, password []byte, shared []byte) (bool, error) {
+		domains, err := store.Authenticate(string(username), string(password))
+		if err != nil {
+			log.Errorf("could not authenticate %s: %s", username, err)
+			return false, authError
+		}
+		if len(domains) == 0 {
+			log.Warnf("authentication of %s from %s failed", username, s.remoteIP)
+			return false, nil
+		}
+		log.Infof("%s authenticated as %s", s.remoteIP, username)
+		s.senderDomains = domains
+		return true, nil
+	}
+}
+
+// Users can only send from the addresses of their domains
+func mailFromHandler(s *session, from string) error {
+	if !s.listener.Submission {
+		return checkSenderRateLimits(s, from)
+	}
+	e, err := parseAddress(from)
+	if err != nil {
+		log.Warnf("mailFromHandler: failed to parse from: %s", err)
+		return senderError
+	}
+	if !isSenderDomain(s, e.domain) {
+		log.Warnf("%s isn't allowed to send as %s", s.login, from)
+		return senderError
+	}
+	s.domain = &Domain{Name: e.domain, Status: DOMAIN_ACTIVE}
+	return checkSenderRateLimits(s, from)
+}
+
+func isSenderDomain(s *session, domain string) bool {
+	for _, d := range s.senderDomains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// The header From and Sender are also limited to the domains of the user,
+// the recipients see them rather than the envelope
+func checkHeaderSenders(s *session, header mail.Header) error {
+	for _, key := range []string{"From", "Sender"} {
+		v := header.Get(key)
+		if v == "" {
+			continue
+		}
+		addrs, err := parseAddresses(v)
+		if err != nil {
+			log.Warnf("failed to parse header `%s` %s", strings.ToLower(key), v)
+			return headerSenderError
+		}
+		for _, addr := range addrs {
+			e, err := parseAddress(addr)
+			if err != nil || !isSenderDomain(s, e.domain) {
+				log.Warnf("%s isn't allowed to send as %s in the header %s", s.login, addr, key)
+				return headerSenderError
+			}
+		}
+	}
+	return nil
+}
+
+// The recipients of the submitted mail can be anywhere
+func submissionRcptHandler(s *session, from string, to string) error {
+	if _, err := parseAddress(to); err != nil {
+		log.Errorf("submissionRcptHandler: failed to parse to: %s", err)
+		return rcptError
+	}
+	if err := checkRecipientRateLimits(s, s.domain, to); err != nil {
+		return err
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		log.Errorf("submissionRcptHandler: failed to generate uuid: %s", err)
+		return rcptError
+	}
+	s.id = id
+	return nil
+}
+
+// Relay the mail of an authenticated user to mailout
+func submissionHandler(s *session, from string, to []string, data *io.SectionReader) []error {
+	errs := make([]error, len(to))
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	msg, err := mail.ReadMessage(io.NewSectionReader(data, 0, data.Size()))
+	if err != nil {
+		log.Errorf("could not read message: %s", err)
+		return fail(parseError)
+	}
+	if err := checkHeaderSenders(s, msg.Header); err != nil {
+		return fail(err)
+	}
+
+	envelope := EmailEnvelope{
+		From:     from,
+		To:       to,
+		SMTPUTF8: s.smtputf8,
+		Body:     s.body,
+		DSN:      s.dsn,
+		Login:    s.login,
+	}
+	// the ORCPT keeps track of the recipients given by the user
+	envelope.DSN.Rcpts = make(map[string]DSNRcpt)
+	for _, rcpt := range to {
+		rcptDSN := s.dsn.Rcpt(rcpt)
+		rcptDSN.ORcpt = s.dsn.ORcpt(rcpt)
+		envelope.DSN.Rcpts[rcpt] = rcptDSN
+	}
+	email := NewEmail(envelope, msg, data)
+	email.settings = s.snapshot
+
+	// a single transaction, the message is relayed to all the recipients or
+	// refused for all of them
+	log.Infof("submit from %s to %s", from, strings.Join(to, ", "))
+	dsn, err := sendMailoutRcpts(email.instance(), envelope, email.Reader())
+	if err != nil {
+		log.Errorf("error sending email out: %s", err)
+		return fail(processingError)
+	}
+	if !dsn {
+		// RFC 3461 section 6.2.7.1, mailout couldn't take over the DSN
+		for _, rcpt := range to {
+			sendNotice(email, rcpt, DSN_NOTIFY_SUCCESS, DSN_ACTION_RELAYED, "2.0.0",
+				fmt.Sprintf("relayed to %s", rcpt))
+		}
+	}
+	countDelivered(s, s.domain, to)
+	countSent(s, from)
+	return errs
+}
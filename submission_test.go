@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/mailway-app/config"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func argon2Hash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func withCredentials(t *testing.T, domain string, content string) *fileCredentials {
+	dir, err := ioutil.TempDir("", "domain.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(path.Join(dir, domain+".passwd"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &fileCredentials{dir: dir}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	for _, hash := range []string{string(hash), argon2Hash("secret")} {
+		ok, err := checkPassword(hash, "secret")
+		assert.Nil(t, err)
+		assert.True(t, ok)
+
+		ok, err = checkPassword(hash, "wrong")
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	}
+
+	_, err = checkPassword("secret", "secret")
+	assert.NotNil(t, err)
+	_, err = checkPassword("$argon2id$v=19$m=64,t=1$salt$key", "secret")
+	assert.NotNil(t, err)
+}
+
+func TestFileCredentials(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	store := withCredentials(t, "xn--bcher-kva.de", fmt.Sprintf(`# users
+alice:%s
+bob:%s
+`, hash, argon2Hash("password")))
+
+	domains, err := store.Authenticate("alice@bücher.de", "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"xn--bcher-kva.de"}, domains)
+
+	domains, err = store.Authenticate("bob@xn--bcher-kva.de", "password")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"xn--bcher-kva.de"}, domains)
+
+	for _, credentials := range [][2]string{
+		{"alice@bücher.de", "password"},
+		{"carol@bücher.de", "secret"},
+		{"alice@example.com", "secret"},
+		{"alice", "secret"},
+	} {
+		domains, err = store.Authenticate(credentials[0], credentials[1])
+		assert.Nil(t, err)
+		assert.Empty(t, domains)
+	}
+}
+
+func TestSubmission(t *testing.T) {
+	withBufferLocation(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.Nil(t, err)
+	store := withCredentials(t, "example.com", "alice:"+string(hash)+"\n")
+
+	// mailout
+	received := make(chan []string, 1)
+	mailout := startTestServer(t, &Server{
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			received <- append([]string{from}, to...)
+			return nil
+		},
+	})
+	_, port, err := net.SplitHostPort(mailout)
+	assert.Nil(t, err)
+	instance := &config.Config{InstanceHostname: "mx.test.local"}
+	instance.PortMailout, _ = strconv.Atoi(port)
+
+	addr := freeTCPAddr(t)
+	mxAddr := freeTCPAddr(t)
+	startTestServer(t, &Server{
+		Snapshot: func() *Snapshot {
+			return &Snapshot{Config: instance, LoopDetectionCount: LOOP_DETECTION_COUNT, SubaddressSeparator: SUBADDRESS_SEPARATOR}
+		},
+		Handler:     mailHandler,
+		HandlerMail: mailFromHandler,
+		HandlerRcpt: rcptHandler,
+		AuthHandler: authHandler(store),
+		AuthMechs:   map[string]bool{"PLAIN": true},
+		Listeners: []Listener{
+			{Network: "tcp", Addr: addr, AuthRequired: true, Submission: true},
+			{Network: "tcp", Addr: mxAddr},
+		},
+	})
+
+	// no AUTH on the other listeners
+	mx := dialTestServer(t, mxAddr)
+	assert.NotContains(t, cmd(t, mx, 250, "EHLO client.local"), "AUTH")
+	cmd(t, mx, 502, "AUTH PLAIN AGFsaWNlQGV4YW1wbGUuY29tAHNlY3JldA==")
+
+	dial := func() *smtp.Client {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	c := dial()
+	assert.NotNil(t, c.Mail("alice@example.com"))
+	assert.NotNil(t, c.Auth(smtp.PlainAuth("", "alice@example.com", "wrong", "127.0.0.1")))
+
+	c = dial()
+	assert.Nil(t, c.Auth(smtp.PlainAuth("", "alice@example.com", "secret", "127.0.0.1")))
+
+	// only from the domains of the user
+	assert.NotNil(t, c.Mail("alice@other.com"))
+	assert.Nil(t, c.Mail("alias@example.com"))
+	assert.Nil(t, c.Rcpt("someone@elsewhere.org"))
+	assert.Nil(t, c.Rcpt("other@elsewhere.org"))
+	w, err := c.Data()
+	assert.Nil(t, err)
+	w.Write([]byte("From: alias@example.com\r\nSubject: test\r\n\r\nHello\r\n"))
+	assert.Nil(t, w.Close())
+	// in one transaction
+	assert.Equal(t, []string{"alias@example.com", "someone@elsewhere.org", "other@elsewhere.org"}, <-received)
+
+	// nor in the header
+	for _, header := range []string{"From: alias@other.com", "From: alias@example.com\r\nSender: bob@other.com"} {
+		assert.Nil(t, c.Mail("alias@example.com"))
+		assert.Nil(t, c.Rcpt("someone@elsewhere.org"))
+		w, err = c.Data()
+		assert.Nil(t, err)
+		w.Write([]byte(header + "\r\nSubject: test\r\n\r\nHello\r\n"))
+		err = w.Close()
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "5.7.1 Header sender rejected")
+		}
+	}
+	assert.Len(t, received, 0)
+}
+
+func TestSubmissionListener(t *testing.T) {
+	settings := Settings{SubmissionAddr: ":587"}
+	listeners, err := settings.GetListeners("127.0.0.1:2525")
+	assert.Nil(t, err)
+	assert.Len(t, listeners, 2)
+	assert.Equal(t, Listener{
+		Name:         "submission",
+		Network:      "tcp",
+		Addr:         ":587",
+		TLSRequired:  true,
+		AuthRequired: true,
+		Submission:   true,
+	}, listeners[1])
+
+	settings = Settings{Listeners: []ListenerSettings{{Address: ":587", Submission: true}}}
+	listeners, err = settings.GetListeners("127.0.0.1:2525")
+	assert.Nil(t, err)
+	assert.True(t, listeners[0].AuthRequired)
+
+	l := Listener{Network: "tcp", Addr: ":587", Submission: true}
+	assert.NotNil(t, l.Validate())
+}
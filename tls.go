@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of the files in the per-domain directories of the certificate
+// directory, as in the live directory of certbot
+const (
+	TLS_CERT_FILE = "fullchain.pem"
+	TLS_KEY_FILE  = "privkey.pem"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, errors.Errorf("invalid TLS version %s", version)
+	}
+	return v, nil
+}
+
+// Only the secure cipher suites can be chosen. The TLS 1.3 ones aren't
+// configurable.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, len(names))
+	for i, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, errors.Errorf("invalid or insecure cipher suite %s", name)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+type storedCert struct {
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// Certificates read from disk. The files are checked on every handshake and
+// read again when they are modified, a renewal doesn't need a restart.
+type certStore struct {
+	sync.Mutex
+	certFile   string // default certificate
+	keyFile    string
+	passphrase string
+	dir        string // per-domain certificates, selected by SNI
+	certs      map[string]*storedCert
+}
+
+func (store *certStore) load(certFile string, keyFile string) (*tls.Certificate, error) {
+	certInfo, err := os.Stat(certFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read certificate")
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read key")
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	stored, ok := store.certs[certFile]
+	if ok && stored.certMod.Equal(certInfo.ModTime()) && stored.keyMod.Equal(keyInfo.ModTime()) {
+		return stored.cert, nil
+	}
+
+	cert, err := loadX509KeyPair(certFile, keyFile, store.passphrase)
+	if err != nil {
+		if ok {
+			// the files can be in the middle of a renewal
+			log.Warnf("could not reload certificate %s, keeping the current one: %s", certFile, err)
+			return stored.cert, nil
+		}
+		return nil, errors.Wrapf(err, "could not load certificate %s", certFile)
+	}
+	if store.certs == nil {
+		store.certs = make(map[string]*storedCert)
+	}
+	store.certs[certFile] = &storedCert{cert: &cert, certMod: certInfo.ModTime(), keyMod: keyInfo.ModTime()}
+	log.Infof("loaded certificate %s", certFile)
+	return &cert, nil
+}
+
+// The certificate of the domain in the SNI extension if there's one in the
+// directory, otherwise the default certificate
+func (store *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if store.dir != "" && hello.ServerName != "" {
+		name, err := normalizeDomain(strings.TrimSuffix(hello.ServerName, "."))
+		if err == nil && name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`) {
+			dir := path.Join(store.dir, name)
+			if fileExists(path.Join(dir, TLS_CERT_FILE)) {
+				return store.load(path.Join(dir, TLS_CERT_FILE), path.Join(dir, TLS_KEY_FILE))
+			}
+		}
+	}
+	if store.certFile == "" {
+		return nil, errors.Errorf("no certificate for %s", hello.ServerName)
+	}
+	return store.load(store.certFile, store.keyFile)
+}
+
+// The TLS configuration of the settings, nil if TLS isn't configured
+func newTLSConfig(settings *Settings) (*tls.Config, error) {
+	if settings.TLSCert == "" && settings.TLSCertDir == "" {
+		return nil, nil
+	}
+	minVersion, err := parseTLSVersion(settings.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := parseCipherSuites(settings.TLSCiphers)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &certStore{
+		certFile:   settings.TLSCert,
+		keyFile:    settings.TLSKey,
+		passphrase: settings.TLSKeyPassphrase,
+		dir:        settings.TLSCertDir,
+	}
+	if store.certFile != "" {
+		// fail early on a broken configuration
+		if _, err := store.load(store.certFile, store.keyFile); err != nil {
+			return nil, err
+		}
+	}
+	config := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   ciphers,
+	}
+	if settings.TLSClientCA != "" {
+		if config.ClientCAs, err = loadCertPool(settings.TLSClientCA); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// CAs of the client certificates, only requested by the listeners with
+// ClientAuth
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read client CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("no certificate in client CA %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/smtp"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestCert(t *testing.T, dir string, name string) (string, string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := path.Join(dir, TLS_CERT_FILE)
+	keyFile := path.Join(dir, TLS_KEY_FILE)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func certName(t *testing.T, cert *tls.Certificate) string {
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Subject.CommonName
+}
+
+func withCertDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir := withCertDir(t)
+	certFile, keyFile := writeTestCert(t, path.Join(dir, "default"), "mx.test.local")
+	writeTestCert(t, path.Join(dir, "live", "example.com"), "example.com")
+
+	store := &certStore{certFile: certFile, keyFile: keyFile, dir: path.Join(dir, "live")}
+	for serverName, expected := range map[string]string{
+		"example.com":  "example.com",
+		"Example.COM.": "example.com",
+		"other.com":    "mx.test.local",
+		"":             "mx.test.local",
+		"..":           "mx.test.local",
+	} {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, certName(t, cert), serverName)
+	}
+
+	store = &certStore{dir: path.Join(dir, "live")}
+	_, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.com"})
+	assert.NotNil(t, err)
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := withCertDir(t)
+	certFile, keyFile := writeTestCert(t, dir, "old.test.local")
+	store := &certStore{certFile: certFile, keyFile: keyFile}
+
+	cert, err := store.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, "old.test.local", certName(t, cert))
+
+	// renewed
+	writeTestCert(t, dir, "new.test.local")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, "new.test.local", certName(t, cert))
+
+	// the current certificate is kept while the files are invalid
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	cert, err = store.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	assert.Equal(t, "new.test.local", certName(t, cert))
+}
+
+func TestTLSSettings(t *testing.T) {
+	dir := withCertDir(t)
+	certFile, keyFile := writeTestCert(t, dir, "mx.test.local")
+
+	config, err := newTLSConfig(&Settings{})
+	assert.Nil(t, err)
+	assert.Nil(t, config)
+
+	config, err = newTLSConfig(&Settings{
+		TLSCert:       certFile,
+		TLSKey:        keyFile,
+		TLSMinVersion: "1.2",
+		TLSCiphers:    []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), config.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, config.CipherSuites)
+
+	_, err = newTLSConfig(&Settings{TLSCert: path.Join(dir, "missing.pem"), TLSKey: keyFile})
+	assert.NotNil(t, err)
+
+	for _, settings := range []Settings{
+		{TLSCert: certFile},
+		{TLSMinVersion: "1.4"},
+		{TLSCiphers: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+	} {
+		assert.NotNil(t, settings.Validate())
+	}
+}
+
+func TestSTARTTLSWithSNI(t *testing.T) {
+	dir := withCertDir(t)
+	certFile, keyFile := writeTestCert(t, path.Join(dir, "default"), "mx.test.local")
+	writeTestCert(t, path.Join(dir, "live", "example.com"), "example.com")
+	config, err := newTLSConfig(&Settings{
+		TLSCert:       certFile,
+		TLSKey:        keyFile,
+		TLSCertDir:    path.Join(dir, "live"),
+		TLSMinVersion: "1.3",
+	})
+	assert.Nil(t, err)
+	addr := startTestServer(t, &Server{TLSConfig: config})
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.StartTLS(&tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	state, ok := c.TLSConnectionState()
+	assert.True(t, ok)
+	assert.Equal(t, "example.com", state.PeerCertificates[0].Subject.CommonName)
+
+	// below the minimum version
+	c, err = smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.StartTLS(&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	assert.NotNil(t, err)
+}
+
+func TestClientCertAuth(t *testing.T) {
+	withBufferLocation(t)
+	dir := withCertDir(t)
+	certFile, keyFile := writeTestCert(t, path.Join(dir, "server"), "mx.test.local")
+	caFile, caKeyFile := writeTestCert(t, path.Join(dir, "client"), "relay.test.local")
+	otherFile, otherKeyFile := writeTestCert(t, path.Join(dir, "other"), "other.test.local")
+	config, err := newTLSConfig(&Settings{TLSCert: certFile, TLSKey: keyFile, TLSClientCA: caFile})
+	assert.Nil(t, err)
+
+	logins := make(chan string, 1)
+	addr := freeTCPAddr(t)
+	startTestServer(t, &Server{
+		TLSConfig:   config,
+		HandlerRcpt: testRcptHandler,
+		Handler: func(s *session, from string, to []string, data *io.SectionReader) []error {
+			logins <- s.login
+			return nil
+		},
+		Listeners: []Listener{{Network: "tcp", Addr: addr, AuthRequired: true, ClientAuth: true}},
+	})
+
+	dial := func(certFile, keyFile string) (*smtp.Client, error) {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if certFile == "" {
+			return c, c.StartTLS(&tls.Config{InsecureSkipVerify: true})
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, c.StartTLS(&tls.Config{
+			InsecureSkipVerify: true,
+			// sent even if it isn't signed by one of the CAs of the server
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			},
+		})
+	}
+
+	c, err := dial(caFile, caKeyFile)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Mail("a@b.ee"))
+	assert.Nil(t, c.Rcpt("c@test.local"))
+	w, err := c.Data()
+	assert.Nil(t, err)
+	w.Write([]byte("Subject: test\r\n\r\nHello\r\n"))
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "relay.test.local", <-logins)
+
+	// without a certificate
+	c, err = dial("", "")
+	assert.Nil(t, err)
+	assert.NotNil(t, c.Mail("a@b.ee"))
+
+	// not signed by the client CA
+	_, err = dial(otherFile, otherKeyFile)
+	assert.NotNil(t, err)
+}
+
+func TestCertIdentity(t *testing.T) {
+	assert.Equal(t, "relay@example.com", certIdentity(&x509.Certificate{
+		EmailAddresses: []string{"relay@example.com"},
+		DNSNames:       []string{"relay.example.com"},
+		Subject:        pkix.Name{CommonName: "relay"},
+	}))
+	assert.Equal(t, "relay.example.com", certIdentity(&x509.Certificate{
+		DNSNames: []string{"relay.example.com"},
+		Subject:  pkix.Name{CommonName: "relay"},
+	}))
+	assert.Equal(t, "relay", certIdentity(&x509.Certificate{Subject: pkix.Name{CommonName: "relay"}}))
+}